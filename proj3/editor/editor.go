@@ -1,31 +1,43 @@
 package main
 
 import (
+	"flag"
 	"fmt"
-	"os"
 	"proj3/scheduler"
 	"strconv"
 	"time"
 )
 
-const usage = "Usage: editor data_dir mode [number of threads]\n" +
+const usage = "Usage: editor [-linear] [-optimize exact|safe|unclamped] data_dir mode [number of threads]\n" +
+	"-linear  = Applies the effects of every image in linear light, unless its task sets \"linear\".\n" +
+	"-optimize = How far the effect lists may be rewritten: exact (as written, the default), safe or unclamped.\n" +
 	"data_dir = The data directory to use to load the images.\n" +
-	"mode     = (s) run sequentially, (parfiles) process multiple files in parallel, (parslices) process slices of each image in parallel \n" +
-	"[number of threads] = Runs the parallel version of the program with the specified number of threads.\n"
+	"mode     = (s) run sequentially, (parfiles) process multiple files in parallel, (parslices) process slices of each image in parallel, (stream) process images row by row in constant memory\n" +
+	"[number of threads] = Runs the parallel version of the program with the specified number of threads."
 
 func main() {
 
-	if len(os.Args) < 2 {
+	linear := flag.Bool("linear", false, "apply the effects in linear light")
+	optimize := flag.String("optimize", "", "optimization of the effect lists: exact, safe or unclamped")
+	flag.Usage = func() { fmt.Println(usage) }
+	flag.Parse()
+	args := flag.Args()
+
+	if len(args) < 1 {
 		fmt.Println(usage)
 		return
 	}
 	config := scheduler.Config{DataDirs: "", Mode: "", ThreadCount: 0}
-	config.DataDirs = os.Args[1]
+	config.DataDirs = args[0]
+	config.Linear = *linear
+	config.Optimize = *optimize
 
-	if len(os.Args) >= 3 {
-		config.Mode = os.Args[2]
-		threads, _ := strconv.Atoi(os.Args[3])
-		config.ThreadCount = threads
+	if len(args) >= 2 {
+		config.Mode = args[1]
+		if len(args) >= 3 {
+			threads, _ := strconv.Atoi(args[2])
+			config.ThreadCount = threads
+		}
 	} else {
 		config.Mode = "s"
 	}
@@ -0,0 +1,197 @@
+// Package png allows for loading png images and applying image flitering effects on them
+// Tonal and color adjustments: point operations that map every pixel on its own
+// With the safe and unclamped optimizations consecutive adjustments of a task are fused, so that the whole run costs
+// a single pass over the image: neighboring tonal curves compose into one 16-bit lookup table and neighboring color
+// mixes into one 3x3 matrix; the exact default runs every adjustment in a pass of its own (see optimize.go)
+package png
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// pointStage is one step of a fused adjustment: either a lookup table or a color matrix
+type pointStage struct {
+	lut    *[65536]uint16
+	matrix *[9]float64 // row-major, applied to straight colors
+}
+
+// adjustment is a fused run of adjustments; consecutive stages never have the same kind
+type adjustment []pointStage
+
+// newAdjustment fuses a run of adjustment effects
+// linear is the transfer curve of pixels that are already in linear light, nil otherwise; ancillary gives the
+// transfer function that exposure uses to reach linear light from encoded pixels
+func newAdjustment(effects []EffectSpec, linear *transferCurve, ancillary []Chunk) adjustment {
+	var adj adjustment
+	for _, e := range effects {
+		var stage pointStage
+		if m := e.colorMatrix(); m != nil {
+			stage.matrix = m
+		} else {
+			stage.lut = e.toneLUT(linear, ancillary)
+		}
+		if n := len(adj); n > 0 {
+			last := &adj[n-1]
+			switch {
+			case stage.lut != nil && last.lut != nil:
+				for i, v := range last.lut {
+					last.lut[i] = stage.lut[v]
+				}
+				continue
+			case stage.matrix != nil && last.matrix != nil:
+				last.matrix = multiply(stage.matrix, last.matrix)
+				continue
+			}
+		}
+		adj = append(adj, stage)
+	}
+	return adj
+}
+
+// curveLUT tabulates a tonal curve on values from 0 to 1
+func curveLUT(f func(x float64) float64) *[65536]uint16 {
+	lut := &[65536]uint16{}
+	for i := range lut {
+		lut[i] = clamp(math.Round(f(float64(i)/65535) * 65535))
+	}
+	return lut
+}
+
+// toneLUT returns the lookup table of a tonal adjustment
+func (e EffectSpec) toneLUT(linear *transferCurve, ancillary []Chunk) *[65536]uint16 {
+	switch e.Name {
+	case BrightnessEffect:
+		a := e.Number("amount", 0)
+		return curveLUT(func(x float64) float64 { return x + a })
+	case ContrastEffect:
+		a := e.Number("amount", 0)
+		return curveLUT(func(x float64) float64 { return (x-0.5)*(1+a) + 0.5 })
+	case GammaEffect:
+		a := e.Number("amount", 1)
+		return curveLUT(func(x float64) float64 { return math.Pow(x, 1/a) })
+	case ExposureEffect:
+		gain := math.Pow(2, e.Number("amount", 0))
+		if linear != nil {
+			return curveLUT(func(x float64) float64 { return x * gain })
+		}
+		// exposure scales light, so encoded pixels go through linear light and back
+		curve := transferCurveFor(ancillary)
+		lut := &[65536]uint16{}
+		for i := range lut {
+			lut[i] = curve.fromLinear[clamp(math.Round(float64(curve.toLinear[i])*gain))]
+		}
+		return lut
+	case InvertEffect:
+		return curveLUT(func(x float64) float64 { return 1 - x })
+	case PosterizeEffect:
+		levels := float64(e.Int("levels", 4))
+		return curveLUT(func(x float64) float64 { return math.Round(x*(levels-1)) / (levels - 1) })
+	case ThresholdEffect:
+		a := e.Number("amount", 0.5)
+		return curveLUT(func(x float64) float64 {
+			if x >= a {
+				return 1
+			}
+			return 0
+		})
+	}
+	return nil
+}
+
+// Rec. 709 luma weights, kept by the saturation and hue matrices
+const lumaR, lumaG, lumaB = 0.2126, 0.7152, 0.0722
+
+// colorMatrix returns the matrix of a color adjustment, or nil for a tonal one
+// The matrices are those of the CSS filter effects: https://www.w3.org/TR/filter-effects-1/#feColorMatrixElement
+func (e EffectSpec) colorMatrix() *[9]float64 {
+	switch e.Name {
+	case SaturationEffect:
+		s := 1 + e.Number("amount", 0)
+		return &[9]float64{
+			lumaR + (1-lumaR)*s, lumaG - lumaG*s, lumaB - lumaB*s,
+			lumaR - lumaR*s, lumaG + (1-lumaG)*s, lumaB - lumaB*s,
+			lumaR - lumaR*s, lumaG - lumaG*s, lumaB + (1-lumaB)*s,
+		}
+	case HueEffect:
+		sin, cos := math.Sincos(e.Number("amount", 0) * math.Pi / 180)
+		return &[9]float64{
+			lumaR + cos*(1-lumaR) - sin*lumaR, lumaG - cos*lumaG - sin*lumaG, lumaB - cos*lumaB + sin*(1-lumaB),
+			lumaR - cos*lumaR + sin*0.143, lumaG + cos*(1-lumaG) + sin*0.140, lumaB - cos*lumaB - sin*0.283,
+			lumaR - cos*lumaR - sin*(1-lumaR), lumaG - cos*lumaG + sin*lumaG, lumaB + cos*(1-lumaB) + sin*lumaB,
+		}
+	case SepiaEffect:
+		a := e.Number("amount", 1)
+		return &[9]float64{
+			0.393 + 0.607*(1-a), 0.769 - 0.769*(1-a), 0.189 - 0.189*(1-a),
+			0.349 - 0.349*(1-a), 0.686 + 0.314*(1-a), 0.168 - 0.168*(1-a),
+			0.272 - 0.272*(1-a), 0.534 - 0.534*(1-a), 0.131 + 0.869*(1-a),
+		}
+	}
+	return nil
+}
+
+// multiply returns the matrix that applies m1 and then m2
+func multiply(m2, m1 *[9]float64) *[9]float64 {
+	var m [9]float64
+	for r := 0; r < 3; r++ {
+		for c := 0; c < 3; c++ {
+			for k := 0; k < 3; k++ {
+				m[3*r+c] += m2[3*r+k] * m1[3*k+c]
+			}
+		}
+	}
+	return &m
+}
+
+// apply adjusts the straight color of one premultiplied pixel
+func (adj adjustment) apply(c color.RGBA64) color.RGBA64 {
+	if c.A == 0 {
+		return c
+	}
+	a := uint32(c.A)
+	r, g, b := uint32(c.R), uint32(c.G), uint32(c.B)
+	if a != 0xffff {
+		r, g, b = unpremultiply(r, a), unpremultiply(g, a), unpremultiply(b, a)
+	}
+	for _, stage := range adj {
+		if stage.lut != nil {
+			r, g, b = uint32(stage.lut[r]), uint32(stage.lut[g]), uint32(stage.lut[b])
+			continue
+		}
+		m := stage.matrix
+		fr, fg, fb := float64(r), float64(g), float64(b)
+		r = uint32(clamp(math.Round(m[0]*fr + m[1]*fg + m[2]*fb)))
+		g = uint32(clamp(math.Round(m[3]*fr + m[4]*fg + m[5]*fb)))
+		b = uint32(clamp(math.Round(m[6]*fr + m[7]*fg + m[8]*fb)))
+	}
+	if a != 0xffff {
+		r, g, b = r*a/0xffff, g*a/0xffff, b*a/0xffff
+	}
+	return color.RGBA64{uint16(r), uint16(g), uint16(b), c.A}
+}
+
+// Adjust applies a run of consecutive adjustment effects in a single pass
+func (img *Image) Adjust(effects []EffectSpec) {
+	img.BSPAdjust(effects, 1)
+}
+
+// BSPAdjust parallelly applies a run of consecutive adjustment effects in a single superstep
+func (img *Image) BSPAdjust(effects []EffectSpec, numThreads int) {
+	img.applyRows(newAdjustment(effects, img.linear, img.Ancillary), numThreads)
+}
+
+// an adjustment is the effect of a run of adjustments (see registry.go)
+func (adj adjustment) Info() EffectInfo                          { return EffectInfo{Pointwise: true, KeepsAlpha: true} }
+func (adj adjustment) Bounds(in image.Rectangle) image.Rectangle { return in }
+
+// Apply adjusts rows of in into out
+func (adj adjustment) Apply(in, out *image.RGBA64, rows Rows) {
+	bounds := in.Bounds()
+	for y := rows.Min; y < rows.Max; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			out.SetRGBA64(x, y, adj.apply(in.RGBA64At(x, y)))
+		}
+	}
+}
@@ -0,0 +1,67 @@
+// Package png allows for loading png images and applying image flitering effects on them
+// Alpha handling of the convolution effects
+// https://en.wikipedia.org/wiki/Alpha_compositing#Straight_versus_premultiplied
+package png
+
+import "fmt"
+
+// AlphaMode selects how convolution effects treat the alpha channel
+// The pixel buffers always hold premultiplied values, as image.RGBA64 and RGBA() do
+type AlphaMode string
+
+const (
+	// AlphaIgnore convolves the premultiplied color channels and keeps the alpha of the center pixel
+	// This is the original behavior: it produces halos and colors that exceed alpha on transparent images
+	AlphaIgnore AlphaMode = "ignore"
+	// AlphaPremultiplied convolves all four premultiplied channels and clamps each color to the new alpha
+	AlphaPremultiplied AlphaMode = "premultiplied"
+	// AlphaStraight convolves the straight colors of the neighbors weighted by their alpha, so that fully transparent
+	// neighbors, whose straight color is black, add no color, then premultiplies them by the new alpha
+	AlphaStraight AlphaMode = "straight"
+)
+
+// ParseAlphaMode validates the "alpha" value of an ImageTask; the empty string selects AlphaIgnore
+func ParseAlphaMode(s string) (AlphaMode, error) {
+	switch AlphaMode(s) {
+	case "", AlphaIgnore:
+		return AlphaIgnore, nil
+	case AlphaPremultiplied, AlphaStraight:
+		return AlphaMode(s), nil
+	}
+	return "", fmt.Errorf("png: unknown alpha mode %q", s)
+}
+
+// unpremultiply turns a premultiplied color channel back into a straight one
+// colors that exceed their alpha (which AlphaIgnore can produce) are clamped to full intensity
+func unpremultiply(c, a uint32) uint32 {
+	if a == 0 {
+		return 0
+	}
+	if c >= a {
+		return 0xffff
+	}
+	return c * 0xffff / a
+}
+
+// finishAlpha converts the convolution sums of one pixel into the premultiplied output pixel
+// For AlphaStraight the color sums are straight colors and are premultiplied by the new alpha
+func finishAlpha(mode AlphaMode, sumR, sumG, sumB, sumA float64) (r, g, b, a uint16) {
+	r, g, b, a = clamp(sumR), clamp(sumG), clamp(sumB), clamp(sumA)
+	switch mode {
+	case AlphaPremultiplied:
+		// a premultiplied color can never exceed its alpha
+		r, g, b = minUint16(r, a), minUint16(g, a), minUint16(b, a)
+	case AlphaStraight:
+		r = uint16(uint32(r) * uint32(a) / 0xffff)
+		g = uint16(uint32(g) * uint32(a) / 0xffff)
+		b = uint16(uint32(b) * uint32(a) / 0xffff)
+	}
+	return r, g, b, a
+}
+
+func minUint16(x, y uint16) uint16 {
+	if x < y {
+		return x
+	}
+	return y
+}
@@ -0,0 +1,141 @@
+package png
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// edgeImage returns an opaque white left half next to a white right half of the given alpha
+func edgeImage(width, height int, alpha uint16) *Image {
+	bounds := image.Rect(0, 0, width, height)
+	img := &Image{In: image.NewRGBA64(bounds), Out: image.NewRGBA64(bounds), Bounds: bounds}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.RGBA64{0xffff, 0xffff, 0xffff, 0xffff}
+			if x >= width/2 {
+				c = color.RGBA64{alpha, alpha, alpha, alpha}
+			}
+			img.In.SetRGBA64(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestParseAlphaMode(t *testing.T) {
+	for s, want := range map[string]AlphaMode{"": AlphaIgnore, "ignore": AlphaIgnore, "premultiplied": AlphaPremultiplied, "straight": AlphaStraight} {
+		if got, err := ParseAlphaMode(s); err != nil || got != want {
+			t.Errorf("ParseAlphaMode(%q) = %q, %v, want %q", s, got, err, want)
+		}
+	}
+	if _, err := ParseAlphaMode("multiply"); err == nil {
+		t.Error("ParseAlphaMode accepts an unknown mode")
+	}
+}
+
+func TestAlphaModesKeepColorsWithinAlpha(t *testing.T) {
+	// the sharpen kernel overshoots, and the valid border copies the input unchanged
+	kernels := map[string]Kernel{"sharpen": sharpenKernel, "edge": edgeDetectionKernel, "gaussian": gaussianKernel(2, 0)}
+	for _, alpha := range []AlphaMode{AlphaPremultiplied, AlphaStraight} {
+		for name, kernel := range kernels {
+			for _, border := range testBorders {
+				kernel.Border = border
+				img := testImage(21, 13, 11)
+				img.AlphaMode = alpha
+				img.BSPConvolution(kernel, 3)
+				for y := 0; y < 13; y++ {
+					for x := 0; x < 21; x++ {
+						if c := img.Out.RGBA64At(x, y); c.R > c.A || c.G > c.A || c.B > c.A {
+							t.Fatalf("%s %s %s: pixel (%d, %d) is %v, whose color exceeds its alpha", alpha, name, border, x, y, c)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestStraightAlphaRemovesHalo(t *testing.T) {
+	img := edgeImage(16, 5, 0x8000)
+	img.AlphaMode = AlphaStraight
+	kernel := blurKernel
+	kernel.Border = BorderClamp
+	img.Convolution(kernel)
+	// every color is white, so every output pixel stays white whatever alpha the blur gives it
+	for y := 0; y < 5; y++ {
+		for x := 0; x < 16; x++ {
+			c := img.Out.RGBA64At(x, y)
+			if diff(c.R, c.A) > 1 || diff(c.G, c.A) > 1 || diff(c.B, c.A) > 1 {
+				t.Fatalf("pixel (%d, %d) is %v, which is not white", x, y, c)
+			}
+		}
+	}
+	// the alpha is blurred across the edge
+	if a := img.Out.RGBA64At(7, 2).A; a == 0xffff || a <= 0x8000 {
+		t.Errorf("the alpha next to the edge is %#x, want a value between the two halves", a)
+	}
+}
+
+func TestStraightAlphaIgnoresTransparentNeighbors(t *testing.T) {
+	// the direct, separable, FFT and box blurs next to a fully transparent area, whose color is black
+	blurs := map[string]func(img *Image){
+		"direct": func(img *Image) {
+			kernel := blurKernel
+			kernel.Border = BorderClamp
+			img.Convolution(kernel)
+		},
+		"separable": func(img *Image) { img.Convolution(gaussianKernel(2, 0)) },
+		"fft":       func(img *Image) { img.fftConvolution(gaussianKernel(3, 0), 2) },
+		"box":       func(img *Image) { img.BoxFilter(2) },
+	}
+	for name, blur := range blurs {
+		img := edgeImage(24, 9, 0)
+		img.AlphaMode = AlphaStraight
+		blur(img)
+		// the opaque white spreads into the transparent half as white of a lower alpha, without a dark halo
+		for y := 0; y < 9; y++ {
+			for x := 0; x < 24; x++ {
+				c := img.Out.RGBA64At(x, y)
+				if diff(c.R, c.A) > 1 || diff(c.G, c.A) > 1 || diff(c.B, c.A) > 1 {
+					t.Fatalf("%s: pixel (%d, %d) is %v, which is not white", name, x, y, c)
+				}
+			}
+		}
+		if a := img.Out.RGBA64At(12, 4).A; a == 0 || a == 0xffff {
+			t.Errorf("%s: the alpha next to the edge is %#x, want it blurred", name, a)
+		}
+	}
+}
+
+func TestIgnoreAlphaKeepsBaseline(t *testing.T) {
+	img := edgeImage(16, 5, 0x8000)
+	img.AlphaMode = AlphaIgnore
+	kernel := blurKernel
+	kernel.Border = BorderClamp
+	img.Convolution(kernel)
+	// the original behavior: the premultiplied colors are blurred and every pixel keeps its alpha
+	for y := 0; y < 5; y++ {
+		for x := 0; x < 16; x++ {
+			var sum float64
+			for dx := -1; dx <= 1; dx++ {
+				nx := x + dx
+				if nx < 0 {
+					nx = 0
+				} else if nx > 15 {
+					nx = 15
+				}
+				sum += 3 * float64(img.In.RGBA64At(nx, y).R) / 9
+			}
+			want := uint16(math.Min(65535, sum))
+			c, in := img.Out.RGBA64At(x, y), img.In.RGBA64At(x, y)
+			if c.A != in.A || diff(c.R, want) > 1 || c.G != c.R || c.B != c.R {
+				t.Fatalf("pixel (%d, %d) is %v, want red %#x and alpha %#x", x, y, c, want, in.A)
+			}
+		}
+	}
+	// which darkens the opaque side of the edge
+	if c := img.Out.RGBA64At(7, 2); c.R >= c.A {
+		t.Errorf("the opaque pixel at the edge is %v, want the dark halo of the baseline", c)
+	}
+}
@@ -0,0 +1,279 @@
+// Package png allows for loading png images and applying image flitering effects on them
+// Bilateral filter: a blur that only averages pixels of similar intensity, so edges stay sharp
+// https://en.wikipedia.org/wiki/Bilateral_filter
+// J. Chen, S. Paris, F. Durand, "Real-time Edge-Aware Image Processing with the Bilateral Grid", 2007
+package png
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// Bilateral weighs every neighbor by its distance (a Gaussian of Sigma pixels) and by how much its luma differs
+// from the center (a Gaussian of Range, as a fraction of full intensity)
+// The exact filter visits a window of Radius pixels (0 is ceil(2 Sigma)); Grid selects the bilateral grid
+// approximation, whose cost does not depend on Sigma
+// The colors are filtered premultiplied and every pixel keeps its alpha
+type Bilateral struct {
+	Sigma  float64
+	Range  float64
+	Radius int
+	Grid   bool
+}
+
+// rangeWeights tabulates the range Gaussian for every luma difference
+func (f Bilateral) rangeWeights() []float64 {
+	w := make([]float64, 65536)
+	for d := range w {
+		x := float64(d) / 65535 / f.Range
+		w[d] = math.Exp(-x * x / 2)
+	}
+	return w
+}
+
+// lumaPlane returns the straight luma of every pixel of In, computed in one superstep
+func (img *Image) lumaPlane(numThreads int) []uint16 {
+	bounds := img.Bounds
+	width := bounds.Dx()
+	luma := make([]uint16, width*bounds.Dy())
+	img.bspRows(numThreads, func(startY, endY int) {
+		for y := startY; y < endY; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				luma[(y-bounds.Min.Y)*width+x-bounds.Min.X] = uint16(straightLuma(img.In.RGBA64At(x, y)))
+			}
+		}
+	})
+	return luma
+}
+
+// finishSmooth writes the filtered premultiplied colors of pixel (x, y), which keeps its alpha
+func (img *Image) finishSmooth(x, y int, r, g, b float64) {
+	a := img.In.RGBA64At(x, y).A
+	img.Out.SetRGBA64(x, y, color.RGBA64{
+		minUint16(clamp(math.Round(r)), a), minUint16(clamp(math.Round(g)), a), minUint16(clamp(math.Round(b)), a), a,
+	})
+}
+
+// Bilateral applies a bilateral filter to the image
+func (img *Image) Bilateral(f Bilateral) {
+	img.BSPBilateral(f, 1)
+}
+
+// BSPBilateral parallelly applies a bilateral filter to the image
+func (img *Image) BSPBilateral(f Bilateral, numThreads int) {
+	if f.Grid {
+		img.applyRows(&bilateralGridEffect{rowImage: img.rowImage(), f: f}, numThreads)
+		return
+	}
+	img.applyRows(img.bilateralEffect(f), numThreads)
+}
+
+// bilateralEffect is the effect of the exact bilateral filter
+type bilateralEffect struct {
+	rowImage
+	f       Bilateral
+	radius  int
+	spatial []float64 // the spatial Gaussian over the window
+	rangeW  []float64
+}
+
+func (img *Image) bilateralEffect(f Bilateral) *bilateralEffect {
+	r := f.Radius
+	if r == 0 {
+		r = int(math.Ceil(2 * f.Sigma))
+	}
+	spatial := make([]float64, (2*r+1)*(2*r+1))
+	for dy := -r; dy <= r; dy++ {
+		for dx := -r; dx <= r; dx++ {
+			spatial[(dy+r)*(2*r+1)+dx+r] = math.Exp(-float64(dx*dx+dy*dy) / (2 * f.Sigma * f.Sigma))
+		}
+	}
+	return &bilateralEffect{rowImage: img.rowImage(), f: f, radius: r, spatial: spatial, rangeW: f.rangeWeights()}
+}
+
+func (e *bilateralEffect) Info() EffectInfo { return EffectInfo{Halo: e.radius, KeepsAlpha: true} }
+
+// Apply filters rows of in into out, from the luma of the rows within the radius of them
+func (e *bilateralEffect) Apply(in, out *image.RGBA64, rows Rows) {
+	img := e.bandView(in, out, rows, e.radius)
+	bounds := img.Bounds
+	width, height := bounds.Dx(), bounds.Dy()
+	r, spatial, rangeW := e.radius, e.spatial, e.rangeW
+	luma := img.lumaPlane(1)
+
+	for y := rows.Min; y < rows.Max; y++ {
+		cy := y - bounds.Min.Y
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			cx := x - bounds.Min.X
+			center := int(luma[cy*width+cx])
+			var sumR, sumG, sumB, sumW float64
+			for dy := -r; dy <= r; dy++ {
+				ny := cy + dy
+				if ny < 0 || ny >= height {
+					continue // neighbors outside the image are left out of the average
+				}
+				for dx := -r; dx <= r; dx++ {
+					nx := cx + dx
+					if nx < 0 || nx >= width {
+						continue
+					}
+					w := spatial[(dy+r)*(2*r+1)+dx+r] * rangeW[abs(int(luma[ny*width+nx])-center)]
+					c := in.RGBA64At(bounds.Min.X+nx, bounds.Min.Y+ny)
+					sumR += w * float64(c.R)
+					sumG += w * float64(c.G)
+					sumB += w * float64(c.B)
+					sumW += w
+				}
+			}
+			img.finishSmooth(x, y, sumR/sumW, sumG/sumW, sumB/sumW)
+		}
+	}
+}
+
+// gridPad is the margin of empty cells around the bilateral grid, as wide as the blur reaches
+const gridPad = 2
+
+// bilateralGridEffect approximates the bilateral filter on a grid of cells Sigma pixels wide and Range deep:
+// every pixel is added to the cell of its position and luma (splat), the grid is blurred along its three axes
+// and every pixel reads its result back by trilinear interpolation (slice)
+// The workers own whole rows of cells, so that the splat needs no locks and adds the pixels in a fixed order
+// Every pixel may reach every cell, so Prepare builds the grid from the whole image and Apply slices it
+type bilateralGridEffect struct {
+	rowImage
+	f          Bilateral
+	gw, gh, gd int
+	grid       []float64 // the blurred grid
+	luma       []uint16
+}
+
+func (e *bilateralGridEffect) Info() EffectInfo {
+	return EffectInfo{Halo: WholeImage, KeepsAlpha: true}
+}
+
+// cell returns the index of a cell of the grid, which holds the premultiplied color sums and the number of pixels
+func (e *bilateralGridEffect) cell(gx, gy, gz int) int { return ((gy*e.gw+gx)*e.gd + gz) * 4 }
+
+// depth returns the position of a luma along the third axis of the grid
+func (e *bilateralGridEffect) depth(l uint16) float64 { return float64(l)/65535/e.f.Range + gridPad }
+
+// Prepare splats the image into the grid and blurs it
+func (e *bilateralGridEffect) Prepare(in *image.RGBA64, numThreads int) {
+	img, f := e.view(in, nil), e.f
+	bounds := img.Bounds
+	width, height := bounds.Dx(), bounds.Dy()
+	e.gw = int(math.Round(float64(width-1)/f.Sigma)) + 1 + 2*gridPad
+	e.gh = int(math.Round(float64(height-1)/f.Sigma)) + 1 + 2*gridPad
+	e.gd = int(math.Round(1/f.Range)) + 1 + 2*gridPad
+	gw, gh, gd, cell := e.gw, e.gh, e.gd, e.cell
+	grid, tmp := make([]float64, gw*gh*gd*4), make([]float64, gw*gh*gd*4)
+	rows := image.Rect(0, 0, gw, gh)
+	luma := img.lumaPlane(numThreads)
+
+	// splat
+	bspSlices(rows, numThreads, func(startGY, endGY int) {
+		for y := 0; y < height; y++ {
+			gy := int(math.Round(float64(y)/f.Sigma)) + gridPad
+			if gy < startGY || gy >= endGY {
+				continue
+			}
+			for x := 0; x < width; x++ {
+				gx := int(math.Round(float64(x)/f.Sigma)) + gridPad
+				gz := int(math.Round(e.depth(luma[y*width+x])))
+				c := img.In.RGBA64At(bounds.Min.X+x, bounds.Min.Y+y)
+				i := cell(gx, gy, gz)
+				grid[i] += float64(c.R)
+				grid[i+1] += float64(c.G)
+				grid[i+2] += float64(c.B)
+				grid[i+3]++
+			}
+		}
+	})
+
+	// blur with the binomial [1 4 6 4 1]/16, whose variance of one cell matches Sigma and Range
+	taps := [2*gridPad + 1]float64{1.0 / 16, 4.0 / 16, 6.0 / 16, 4.0 / 16, 1.0 / 16}
+	for axis := 0; axis < 3; axis++ {
+		src, dst := grid, tmp
+		if axis == 1 {
+			src, dst = tmp, grid
+		}
+		bspSlices(rows, numThreads, func(startGY, endGY int) {
+			for gy := startGY; gy < endGY; gy++ {
+				for gx := 0; gx < gw; gx++ {
+					for gz := 0; gz < gd; gz++ {
+						var sum [4]float64
+						for t, k := range taps {
+							nx, ny, nz := gx, gy, gz
+							switch axis {
+							case 0:
+								nx += t - gridPad
+							case 1:
+								ny += t - gridPad
+							case 2:
+								nz += t - gridPad
+							}
+							if nx < 0 || nx >= gw || ny < 0 || ny >= gh || nz < 0 || nz >= gd {
+								continue
+							}
+							j := cell(nx, ny, nz)
+							for c := range sum {
+								sum[c] += k * src[j+c]
+							}
+						}
+						copy(dst[cell(gx, gy, gz):], sum[:])
+					}
+				}
+			}
+		})
+	}
+	// the three passes went grid -> tmp -> grid -> tmp
+	e.grid, e.luma = tmp, luma
+}
+
+// Apply slices the grid at the pixels of rows
+func (e *bilateralGridEffect) Apply(in, out *image.RGBA64, rows Rows) {
+	img, f := e.view(in, out), e.f
+	bounds := img.Bounds
+	width := bounds.Dx()
+	for y := rows.Min; y < rows.Max; y++ {
+		fy := float64(y-bounds.Min.Y)/f.Sigma + gridPad
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			fx := float64(x-bounds.Min.X)/f.Sigma + gridPad
+			fz := e.depth(e.luma[(y-bounds.Min.Y)*width+x-bounds.Min.X])
+			x0, y0, z0 := int(fx), int(fy), int(fz)
+			wx, wy, wz := fx-float64(x0), fy-float64(y0), fz-float64(z0)
+			var sum [4]float64
+			for corner := 0; corner < 8; corner++ {
+				w := 1.0
+				cx, cy, cz := x0, y0, z0
+				if corner&1 != 0 {
+					cx, w = cx+1, w*wx
+				} else {
+					w *= 1 - wx
+				}
+				if corner&2 != 0 {
+					cy, w = cy+1, w*wy
+				} else {
+					w *= 1 - wy
+				}
+				if corner&4 != 0 {
+					cz, w = cz+1, w*wz
+				} else {
+					w *= 1 - wz
+				}
+				if w == 0 {
+					continue
+				}
+				j := e.cell(cx, cy, cz)
+				for c := range sum {
+					sum[c] += w * e.grid[j+c]
+				}
+			}
+			if sum[3] <= 0 {
+				img.Out.SetRGBA64(x, y, img.In.RGBA64At(x, y))
+				continue
+			}
+			img.finishSmooth(x, y, sum[0]/sum[3], sum[1]/sum[3], sum[2]/sum[3])
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package png
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+// stepImage returns an opaque gray image, dark on the left half and bright on the right, with some noise
+func stepImage(width, height int) *Image {
+	rng := rand.New(rand.NewSource(1))
+	bounds := image.Rect(0, 0, width, height)
+	img := &Image{In: image.NewRGBA64(bounds), Out: image.NewRGBA64(bounds), Bounds: bounds}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := 0x2000
+			if x >= width/2 {
+				v = 0xe000
+			}
+			v += rng.Intn(0x1000) - 0x800
+			img.In.SetRGBA64(x, y, color.RGBA64{uint16(v), uint16(v), uint16(v), 0xffff})
+		}
+	}
+	return img
+}
+
+// edgeFilters are the edge-preserving filters, each applied with the given number of threads
+var edgeFilters = map[string]func(img *Image, numThreads int){
+	"bilateral": func(img *Image, numThreads int) {
+		img.BSPBilateral(Bilateral{Sigma: 3, Range: 0.1}, numThreads)
+	},
+	"bilateral grid": func(img *Image, numThreads int) {
+		img.BSPBilateral(Bilateral{Sigma: 3, Range: 0.1, Grid: true}, numThreads)
+	},
+	"guided": func(img *Image, numThreads int) {
+		img.BSPGuided(Guided{Radius: 4, Eps: 0.001}, numThreads)
+	},
+}
+
+// columnMean returns the mean red of column x of img
+func columnMean(img *image.RGBA64, x int) float64 {
+	var sum float64
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		sum += float64(img.RGBA64At(x, y).R)
+	}
+	return sum / float64(img.Rect.Dy())
+}
+
+// columnSpread returns the mean absolute deviation of the red of column x of img from mean
+func columnSpread(img *image.RGBA64, x int, mean float64) float64 {
+	var sum float64
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		d := float64(img.RGBA64At(x, y).R) - mean
+		if d < 0 {
+			d = -d
+		}
+		sum += d
+	}
+	return sum / float64(img.Rect.Dy())
+}
+
+func TestEdgePreservingFiltersKeepEdges(t *testing.T) {
+	const width, height = 40, 24
+	for name, apply := range edgeFilters {
+		img := stepImage(width, height)
+		apply(img, 1)
+		// the columns on either side of the step keep their levels, while a blur would meet halfway
+		dark, bright := columnMean(img.Out, width/2-1), columnMean(img.Out, width/2)
+		if dark > 0x2800 || bright < 0xd800 {
+			t.Errorf("%s: the columns next to the step are %#x and %#x, want about 0x2000 and 0xe000", name, int(dark), int(bright))
+		}
+		// while the noise of the flat areas is smoothed
+		for _, x := range []int{width / 4, 3 * width / 4} {
+			before := columnSpread(img.In, x, columnMean(img.In, x))
+			after := columnSpread(img.Out, x, columnMean(img.Out, x))
+			if after > before/2 {
+				t.Errorf("%s: the noise of column %d goes from %.0f to %.0f, want it halved", name, x, before, after)
+			}
+		}
+	}
+}
+
+func TestGaussianBlursEdges(t *testing.T) {
+	// the reference the edge-preserving filters are measured against
+	img := stepImage(40, 24)
+	img.Convolution(gaussianKernel(3, 0))
+	if dark, bright := columnMean(img.Out, 19), columnMean(img.Out, 20); bright-dark > 0x4000 {
+		t.Errorf("the gaussian keeps a step of %#x", int(bright-dark))
+	}
+}
+
+func TestEdgePreservingFiltersBSPMatchesSequential(t *testing.T) {
+	for name, apply := range edgeFilters {
+		for _, base := range []*Image{stepImage(40, 24), testImage(31, 17, 9)} {
+			height := base.Bounds.Dy()
+			want := cloneImage(base)
+			apply(want, 1)
+			for _, threads := range []int{2, 3, 7, height + 3} {
+				got := cloneImage(base)
+				apply(got, threads)
+				samePixels(t, fmt.Sprintf("%s, height %d, %d threads", name, height, threads), want.Out, got.Out)
+			}
+		}
+	}
+}
@@ -0,0 +1,266 @@
+// Package png allows for loading png images and applying image flitering effects on them
+// BMP codec: uncompressed and bitfield bitmaps with 1, 4, 8, 16, 24 and 32 bits per pixel
+// Format reference: https://learn.microsoft.com/en-us/windows/win32/gdi/bitmap-storage
+package png
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math/bits"
+)
+
+// BMP compression methods
+const (
+	biRGB       = 0
+	biBitfields = 3
+)
+
+const bmpFileHeaderSize = 14
+
+// bmpMask extracts one channel from a 16 or 32 bit pixel described by a bitfield mask
+type bmpMask struct {
+	mask  uint32
+	shift uint
+	max   uint32
+}
+
+func newBMPMask(mask uint32) bmpMask {
+	if mask == 0 {
+		return bmpMask{}
+	}
+	shift := uint(bits.TrailingZeros32(mask))
+	return bmpMask{mask: mask, shift: shift, max: mask >> shift}
+}
+
+func (m bmpMask) value(px uint32) uint16 {
+	if m.mask == 0 {
+		return 0
+	}
+	v := (px & m.mask) >> m.shift
+	return uint16(uint64(v) * 65535 / uint64(m.max))
+}
+
+// decodeBMP reads a BMP file into a straight-alpha NRGBA64 image
+func decodeBMP(r io.Reader) (image.Image, error) {
+	br := bufio.NewReader(r)
+	var fileHeader [bmpFileHeaderSize]byte
+	if _, err := io.ReadFull(br, fileHeader[:]); err != nil {
+		return nil, err
+	}
+	if fileHeader[0] != 'B' || fileHeader[1] != 'M' {
+		return nil, errors.New("bmp: not a BMP file")
+	}
+	pixelOffset := int(binary.LittleEndian.Uint32(fileHeader[10:14]))
+
+	var sizeBuf [4]byte
+	if _, err := io.ReadFull(br, sizeBuf[:]); err != nil {
+		return nil, err
+	}
+	infoSize := int(binary.LittleEndian.Uint32(sizeBuf[:]))
+	if infoSize < 12 || infoSize > 1<<10 {
+		return nil, fmt.Errorf("bmp: invalid header size %d", infoSize)
+	}
+	info := make([]byte, infoSize)
+	copy(info, sizeBuf[:])
+	if _, err := io.ReadFull(br, info[4:]); err != nil {
+		return nil, err
+	}
+	consumed := bmpFileHeaderSize + infoSize
+
+	var width, height, bpp, compression, colorsUsed int
+	paletteEntrySize := 4
+	if infoSize == 12 {
+		// BITMAPCOREHEADER
+		width = int(binary.LittleEndian.Uint16(info[4:6]))
+		height = int(int16(binary.LittleEndian.Uint16(info[6:8])))
+		bpp = int(binary.LittleEndian.Uint16(info[10:12]))
+		paletteEntrySize = 3
+	} else {
+		if infoSize < 40 {
+			return nil, fmt.Errorf("bmp: invalid header size %d", infoSize)
+		}
+		width = int(int32(binary.LittleEndian.Uint32(info[4:8])))
+		height = int(int32(binary.LittleEndian.Uint32(info[8:12])))
+		bpp = int(binary.LittleEndian.Uint16(info[14:16]))
+		compression = int(binary.LittleEndian.Uint32(info[16:20]))
+		colorsUsed = int(binary.LittleEndian.Uint32(info[32:36]))
+	}
+	topDown := height < 0
+	if topDown {
+		height = -height
+	}
+	if width <= 0 || height <= 0 {
+		return nil, errors.New("bmp: invalid image size")
+	}
+	if compression != biRGB && compression != biBitfields {
+		return nil, fmt.Errorf("bmp: unsupported compression %d", compression)
+	}
+
+	// default channel masks of uncompressed 16 (5-5-5) and 32 (x-8-8-8) bit pixels
+	var masks [4]uint32
+	switch bpp {
+	case 16:
+		masks = [4]uint32{0x7c00, 0x03e0, 0x001f, 0}
+	case 32:
+		masks = [4]uint32{0xff0000, 0xff00, 0xff, 0}
+	}
+	if compression == biBitfields {
+		if bpp != 16 && bpp != 32 {
+			return nil, errors.New("bmp: bitfields require 16 or 32 bits per pixel")
+		}
+		if infoSize >= 52 {
+			for i := 0; i < 3; i++ {
+				masks[i] = binary.LittleEndian.Uint32(info[40+4*i:])
+			}
+			if infoSize >= 56 {
+				masks[3] = binary.LittleEndian.Uint32(info[52:56])
+			}
+		} else {
+			// plain BITMAPINFOHEADER: the three masks follow the header
+			var m [12]byte
+			if _, err := io.ReadFull(br, m[:]); err != nil {
+				return nil, err
+			}
+			consumed += len(m)
+			for i := 0; i < 3; i++ {
+				masks[i] = binary.LittleEndian.Uint32(m[4*i:])
+			}
+		}
+	}
+	channelMasks := [4]bmpMask{newBMPMask(masks[0]), newBMPMask(masks[1]), newBMPMask(masks[2]), newBMPMask(masks[3])}
+
+	var palette []color.NRGBA64
+	switch bpp {
+	case 1, 4, 8:
+		if colorsUsed == 0 || colorsUsed > 1<<uint(bpp) {
+			colorsUsed = 1 << uint(bpp)
+		}
+		entries := make([]byte, colorsUsed*paletteEntrySize)
+		if _, err := io.ReadFull(br, entries); err != nil {
+			return nil, err
+		}
+		consumed += len(entries)
+		palette = make([]color.NRGBA64, colorsUsed)
+		for i := range palette {
+			e := entries[i*paletteEntrySize:]
+			palette[i] = color.NRGBA64{uint16(e[2]) * 0x101, uint16(e[1]) * 0x101, uint16(e[0]) * 0x101, 0xffff}
+		}
+	case 16, 24, 32:
+	default:
+		return nil, fmt.Errorf("bmp: unsupported bit depth %d", bpp)
+	}
+
+	if pixelOffset < consumed {
+		return nil, errors.New("bmp: invalid pixel data offset")
+	}
+	if _, err := io.CopyN(io.Discard, br, int64(pixelOffset-consumed)); err != nil {
+		return nil, err
+	}
+
+	img := image.NewNRGBA64(image.Rect(0, 0, width, height))
+	stride := ((width*bpp + 31) / 32) * 4
+	row := make([]byte, stride)
+	for i := 0; i < height; i++ {
+		if _, err := io.ReadFull(br, row); err != nil {
+			return nil, err
+		}
+		y := height - 1 - i
+		if topDown {
+			y = i
+		}
+		for x := 0; x < width; x++ {
+			var c color.NRGBA64
+			switch bpp {
+			case 1, 4, 8:
+				perByte := 8 / bpp
+				shift := uint(8 - bpp*(x%perByte+1))
+				idx := int(row[x/perByte]>>shift) & (1<<uint(bpp) - 1)
+				if idx < len(palette) {
+					c = palette[idx]
+				} else {
+					c = color.NRGBA64{A: 0xffff}
+				}
+			case 24:
+				c = color.NRGBA64{uint16(row[3*x+2]) * 0x101, uint16(row[3*x+1]) * 0x101, uint16(row[3*x]) * 0x101, 0xffff}
+			case 16, 32:
+				var px uint32
+				if bpp == 16 {
+					px = uint32(binary.LittleEndian.Uint16(row[2*x:]))
+				} else {
+					px = binary.LittleEndian.Uint32(row[4*x:])
+				}
+				c = color.NRGBA64{channelMasks[0].value(px), channelMasks[1].value(px), channelMasks[2].value(px), 0xffff}
+				if channelMasks[3].mask != 0 {
+					c.A = channelMasks[3].value(px)
+				}
+			}
+			img.SetNRGBA64(x, y, c)
+		}
+	}
+	return img, nil
+}
+
+// encodeBMP writes opaque images as 24-bit BI_RGB bitmaps and images with transparency
+// as 32-bit BITMAPV4 bitmaps with an alpha channel mask
+func encodeBMP(w io.Writer, img *image.RGBA64) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	opaque := img.Opaque()
+
+	bpp, infoSize := 32, 108
+	if opaque {
+		bpp, infoSize = 24, 40
+	}
+	stride := ((width*bpp + 31) / 32) * 4
+	pixelOffset := bmpFileHeaderSize + infoSize
+	fileSize := pixelOffset + stride*height
+
+	header := make([]byte, pixelOffset)
+	header[0], header[1] = 'B', 'M'
+	binary.LittleEndian.PutUint32(header[2:], uint32(fileSize))
+	binary.LittleEndian.PutUint32(header[10:], uint32(pixelOffset))
+	info := header[bmpFileHeaderSize:]
+	binary.LittleEndian.PutUint32(info[0:], uint32(infoSize))
+	binary.LittleEndian.PutUint32(info[4:], uint32(width))
+	binary.LittleEndian.PutUint32(info[8:], uint32(height)) // positive height: bottom-up rows
+	binary.LittleEndian.PutUint16(info[12:], 1)
+	binary.LittleEndian.PutUint16(info[14:], uint16(bpp))
+	binary.LittleEndian.PutUint32(info[20:], uint32(stride*height))
+	binary.LittleEndian.PutUint32(info[24:], 2835) // 72 DPI
+	binary.LittleEndian.PutUint32(info[28:], 2835)
+	if !opaque {
+		binary.LittleEndian.PutUint32(info[16:], biBitfields)
+		binary.LittleEndian.PutUint32(info[40:], 0x00ff0000)
+		binary.LittleEndian.PutUint32(info[44:], 0x0000ff00)
+		binary.LittleEndian.PutUint32(info[48:], 0x000000ff)
+		binary.LittleEndian.PutUint32(info[52:], 0xff000000)
+		copy(info[56:60], "BGRs") // LCS_sRGB, stored little-endian
+	}
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(header); err != nil {
+		return err
+	}
+	row := make([]byte, stride)
+	for y := bounds.Max.Y - 1; y >= bounds.Min.Y; y-- {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			i := x - bounds.Min.X
+			if opaque {
+				c := img.RGBA64At(x, y)
+				row[3*i], row[3*i+1], row[3*i+2] = uint8(c.B>>8), uint8(c.G>>8), uint8(c.R>>8)
+			} else {
+				c := color.NRGBA64Model.Convert(img.RGBA64At(x, y)).(color.NRGBA64)
+				row[4*i], row[4*i+1], row[4*i+2], row[4*i+3] = uint8(c.B>>8), uint8(c.G>>8), uint8(c.R>>8), uint8(c.A>>8)
+			}
+		}
+		if _, err := bw.Write(row); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,75 @@
+// Package png allows for loading png images and applying image flitering effects on them
+// Border modes: which pixels a kernel sees where it reaches beyond the edges of the image
+package png
+
+import "fmt"
+
+// BorderMode selects how the neighbors outside the image are made up, shown for the row abcdefgh
+type BorderMode string
+
+const (
+	BorderZero       BorderMode = "zero"       // 000|abcdefgh|000, the original behaviour, which darkens blurred borders
+	BorderClamp      BorderMode = "clamp"      // aaa|abcdefgh|hhh
+	BorderReflect    BorderMode = "reflect"    // cba|abcdefgh|hgf
+	BorderReflect101 BorderMode = "reflect101" // dcb|abcdefgh|gfe
+	BorderWrap       BorderMode = "wrap"       // fgh|abcdefgh|abc
+	BorderValid      BorderMode = "valid"      // pixels whose neighborhood leaves the image are left untouched
+)
+
+// ParseBorderMode validates the "border" parameter of an effect; the empty string selects BorderZero
+func ParseBorderMode(s string) (BorderMode, error) {
+	switch m := BorderMode(s); m {
+	case "":
+		return BorderZero, nil
+	case "replicate":
+		return BorderClamp, nil
+	case "reflect-101":
+		return BorderReflect101, nil
+	case BorderZero, BorderClamp, BorderReflect, BorderReflect101, BorderWrap, BorderValid:
+		return m, nil
+	}
+	return "", fmt.Errorf("png: unknown border mode %q", s)
+}
+
+// index maps the coordinate i, which may lie outside [0, n), to the pixel that stands in for it,
+// or returns -1 when the neighbor counts as zero
+// Kernels wider than the image make reflect and wrap go around more than once
+func (m BorderMode) index(i, n int) int {
+	if i >= 0 && i < n {
+		return i
+	}
+	switch m {
+	case BorderClamp:
+		if i < 0 {
+			return 0
+		}
+		return n - 1
+	case BorderReflect:
+		i = mod(i, 2*n)
+		if i >= n {
+			i = 2*n - 1 - i
+		}
+		return i
+	case BorderReflect101:
+		if n == 1 {
+			return 0
+		}
+		i = mod(i, 2*n-2)
+		if i >= n {
+			i = 2*n - 2 - i
+		}
+		return i
+	case BorderWrap:
+		return mod(i, n)
+	}
+	return -1
+}
+
+// mod is the remainder of i/n with the sign of n
+func mod(i, n int) int {
+	i %= n
+	if i < 0 {
+		i += n
+	}
+	return i
+}
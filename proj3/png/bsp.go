@@ -0,0 +1,99 @@
+// Package png allows for loading png images and applying image flitering effects on them
+// BSP primitives: the barrier that ends a superstep and the slicing of rows among the workers
+package png
+
+import (
+	"image"
+	"sync"
+)
+
+type Barrier struct {
+	sync.Mutex
+	cond       *sync.Cond
+	count      int // Number of waiting threads
+	threshold  int // Total required participants required to release the barrier
+	generation int // Phase counter (prevent spurious wakeups between phases)
+}
+
+func NewBarrier(threshold int) *Barrier {
+	b := &Barrier{threshold: threshold}
+	b.cond = sync.NewCond(&b.Mutex)
+	return b
+}
+
+func (b *Barrier) Wait() {
+	b.Lock()
+	defer b.Unlock()
+
+	localGen := b.generation
+	b.count++
+
+	if b.count == b.threshold {
+		b.count = 0
+		b.generation++
+		b.cond.Broadcast()
+	} else {
+		for localGen == b.generation {
+			b.cond.Wait()
+		}
+	}
+}
+
+// bspRows splits the image into numThreads horizontal slices and runs fn on each of them as one superstep
+func (img *Image) bspRows(numThreads int, fn func(startY, endY int)) {
+	bspSlices(img.Bounds, numThreads, fn)
+}
+
+// bspSlices splits the rows of bounds into numThreads slices and runs fn on each of them as one superstep
+func bspSlices(bounds image.Rectangle, numThreads int, fn func(startY, endY int)) {
+	if numThreads <= 1 {
+		fn(bounds.Min.Y, bounds.Max.Y)
+		return
+	}
+	barrier := NewBarrier(numThreads + 1)
+
+	for i := 0; i < numThreads; i++ {
+		start, end := sliceStart(bounds, i, numThreads), sliceStart(bounds, i+1, numThreads)
+		if i == numThreads-1 {
+			end = bounds.Max.Y
+		}
+		go func(startY, endY int) {
+			fn(startY, endY)
+			barrier.Wait()
+		}(start, end)
+	}
+	barrier.Wait()
+}
+
+// bspReduce is the map-reduce superstep: partial maps each of the numThreads slices of bounds to a partial result,
+// which it stores under the index of its slice, and once the barrier releases all workers
+// the main thread merges the partial results in slice order, so that the result never depends on scheduling
+func bspReduce(bounds image.Rectangle, numThreads int, partial func(slice, startY, endY int), merge func(slice int)) {
+	if numThreads <= 1 {
+		partial(0, bounds.Min.Y, bounds.Max.Y)
+		merge(0)
+		return
+	}
+	barrier := NewBarrier(numThreads + 1)
+
+	for i := 0; i < numThreads; i++ {
+		start, end := sliceStart(bounds, i, numThreads), sliceStart(bounds, i+1, numThreads)
+		if i == numThreads-1 {
+			end = bounds.Max.Y
+		}
+		go func(slice, startY, endY int) {
+			partial(slice, startY, endY)
+			barrier.Wait()
+		}(i, start, end)
+	}
+	barrier.Wait()
+
+	for i := 0; i < numThreads; i++ {
+		merge(i)
+	}
+}
+
+// sliceStart returns the first row of slice i when bspSlices splits bounds into numThreads slices
+func sliceStart(bounds image.Rectangle, i, numThreads int) int {
+	return bounds.Min.Y + i*(bounds.Dy()/numThreads)
+}
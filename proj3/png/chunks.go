@@ -0,0 +1,177 @@
+// Package png allows for loading png images and applying image flitering effects on them
+// Chunk-level PNG reader/writer used to carry ancillary chunks (color space, DPI, text)
+// from the input file to the output file and to record how an output image was made
+package png
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// ProvenanceKeyword is the iTXt keyword under which Save records the Provenance of an image
+const ProvenanceKeyword = "proj3:provenance"
+
+// Chunk is a raw PNG chunk
+type Chunk struct {
+	Type string
+	Data []byte
+}
+
+// Provenance describes the task that produced an output image
+type Provenance struct {
+	Effects     []EffectSpec `json:"effects"`
+	Mode        string       `json:"mode"`
+	Threads     int          `json:"threads"`
+	Linear      bool         `json:"linear,omitempty"`
+	Optimize    string       `json:"optimize,omitempty"`
+	InputPath   string       `json:"input"`
+	InputSHA256 string       `json:"inputSHA256"`
+}
+
+// ancillaryTypes are the chunks carried from the input to the output image
+// chunks that describe the pixel layout (sBIT, bKGD, hIST, ...) are dropped since the encoder picks its own layout
+var ancillaryTypes = map[string]bool{
+	"tEXt": true, "zTXt": true, "iTXt": true,
+	"gAMA": true, "cHRM": true, "sRGB": true, "iCCP": true,
+	"pHYs": true,
+}
+
+// readAncillaryChunks scans the chunks of a PNG file and returns the ancillary ones listed in ancillaryTypes;
+// the payloads of all other chunks (most importantly IDAT) are skipped without being read
+func readAncillaryChunks(rs io.ReadSeeker) ([]Chunk, error) {
+	sig := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(rs, sig); err != nil {
+		return nil, err
+	}
+	if string(sig) != pngSignature {
+		return nil, errors.New("png: not a PNG file")
+	}
+
+	var chunks []Chunk
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(rs, header[:]); err != nil {
+			return nil, err
+		}
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		typ := string(header[4:8])
+		if typ == "IEND" {
+			return chunks, nil
+		}
+		if !ancillaryTypes[typ] {
+			if _, err := rs.Seek(length+4, io.SeekCurrent); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		data := make([]byte, length+4)
+		if _, err := io.ReadFull(rs, data); err != nil {
+			return nil, err
+		}
+		crc := crc32.NewIEEE()
+		crc.Write(header[4:8])
+		crc.Write(data[:length])
+		if crc.Sum32() != binary.BigEndian.Uint32(data[length:]) {
+			return nil, fmt.Errorf("png: invalid checksum in %s chunk", typ)
+		}
+		chunks = append(chunks, Chunk{Type: typ, Data: data[:length]})
+	}
+}
+
+// writeChunk writes a single chunk with its length and checksum
+func writeChunk(w io.Writer, c Chunk) error {
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(c.Data)))
+	copy(header[4:], c.Type)
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(c.Data)
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc.Sum32())
+	for _, b := range [][]byte{header[:], c.Data, sum[:]} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// iTXtChunk builds an uncompressed international text chunk
+func iTXtChunk(keyword, text string) Chunk {
+	var data bytes.Buffer
+	data.WriteString(keyword)
+	data.WriteByte(0) // keyword terminator
+	data.WriteByte(0) // compression flag: uncompressed
+	data.WriteByte(0) // compression method
+	data.WriteByte(0) // empty language tag
+	data.WriteByte(0) // empty translated keyword
+	data.WriteString(text)
+	return Chunk{Type: "iTXt", Data: data.Bytes()}
+}
+
+// textKeyword returns the keyword of a tEXt, zTXt or iTXt chunk
+func textKeyword(c Chunk) string {
+	if i := bytes.IndexByte(c.Data, 0); i >= 0 {
+		return string(c.Data[:i])
+	}
+	return ""
+}
+
+// outputChunks returns the chunks Save inserts into a PNG output: the carried ancillary chunks,
+// minus any provenance of an earlier run, plus the provenance of this one
+func (img *Image) outputChunks() ([]Chunk, error) {
+	chunks := make([]Chunk, 0, len(img.Ancillary)+1)
+	for _, c := range img.Ancillary {
+		if c.Type == "iTXt" && textKeyword(c) == ProvenanceKeyword {
+			continue
+		}
+		chunks = append(chunks, c)
+	}
+	if img.Provenance != nil {
+		prov := *img.Provenance
+		prov.InputSHA256 = img.InputSHA256
+		text, err := json.Marshal(prov)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, iTXtChunk(ProvenanceKeyword, string(text)))
+	}
+	return chunks, nil
+}
+
+// chunkInserter passes an encoded PNG stream through and writes extra chunks right after IHDR,
+// which is a valid position for every ancillary chunk (color space chunks must precede PLTE and IDAT)
+type chunkInserter struct {
+	w       io.Writer
+	chunks  []Chunk
+	written int
+}
+
+// ihdrEnd is the offset right after the signature and the 13 byte IHDR chunk
+const ihdrEnd = len(pngSignature) + 8 + 13 + 4
+
+func (ci *chunkInserter) Write(p []byte) (int, error) {
+	n := 0
+	if ci.written < ihdrEnd && ci.written+len(p) >= ihdrEnd {
+		head := ihdrEnd - ci.written
+		if _, err := ci.w.Write(p[:head]); err != nil {
+			return 0, err
+		}
+		for _, c := range ci.chunks {
+			if err := writeChunk(ci.w, c); err != nil {
+				return head, err
+			}
+		}
+		ci.written += head
+		n, p = head, p[head:]
+	}
+	m, err := ci.w.Write(p)
+	ci.written += m
+	return n + m, err
+}
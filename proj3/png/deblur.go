@@ -0,0 +1,279 @@
+// Package png allows for loading png images and applying image flitering effects on them
+// Deconvolution of images blurred by a known point-spread function (PSF)
+// https://en.wikipedia.org/wiki/Wiener_deconvolution
+// https://en.wikipedia.org/wiki/Richardson%E2%80%93Lucy_deconvolution
+package png
+
+import (
+	"errors"
+	"image"
+	"math"
+)
+
+// Built-in point-spread functions
+const (
+	PSFDisk   = "disk"   // defocus: a uniform disk
+	PSFMotion = "motion" // linear motion: a segment
+)
+
+// normalizedPSF makes the values of a PSF sum to 1, or turns an empty one into a single point
+func normalizedPSF(k Kernel) Kernel {
+	if k.Sum() <= 0 {
+		for i := range k.Values {
+			k.Values[i] = 0
+		}
+		k.Values[len(k.Values)/2] = 1
+		return k
+	}
+	return k.Normalize()
+}
+
+// DiskPSF returns the PSF of a defocus blur: a disk of the given radius, with its edge pixels weighed
+// by the part of them the disk covers
+func DiskPSF(radius float64) Kernel {
+	half := int(math.Ceil(radius))
+	size := 2*half + 1
+	k := Kernel{Width: size, Height: size, Values: make([]float64, size*size), Scale: 1}
+	const samples = 8
+	for y := -half; y <= half; y++ {
+		for x := -half; x <= half; x++ {
+			covered := 0
+			for sy := 0; sy < samples; sy++ {
+				for sx := 0; sx < samples; sx++ {
+					fx := float64(x) + (float64(sx)+0.5)/samples - 0.5
+					fy := float64(y) + (float64(sy)+0.5)/samples - 0.5
+					if fx*fx+fy*fy <= radius*radius {
+						covered++
+					}
+				}
+			}
+			k.Values[(y+half)*size+x+half] = float64(covered)
+		}
+	}
+	return normalizedPSF(k)
+}
+
+// MotionPSF returns the PSF of a linear motion of length pixels, angle degrees counter-clockwise from the x axis:
+// a segment centered on the origin, drawn with bilinear weights
+func MotionPSF(length, angle float64) Kernel {
+	half := int(math.Ceil(length/2)) + 1
+	size := 2*half + 1
+	k := Kernel{Width: size, Height: size, Values: make([]float64, size*size), Scale: 1}
+	sin, cos := math.Sincos(angle * math.Pi / 180)
+	steps := int(math.Ceil(length*10)) + 1
+	for i := 0; i < steps; i++ {
+		t := 0.0
+		if steps > 1 {
+			t = length * (float64(i)/float64(steps-1) - 0.5)
+		}
+		// y grows downwards in images
+		fx, fy := t*cos+float64(half), -t*sin+float64(half)
+		x0, y0 := int(math.Floor(fx)), int(math.Floor(fy))
+		wx, wy := fx-float64(x0), fy-float64(y0)
+		k.Values[y0*size+x0] += (1 - wx) * (1 - wy)
+		k.Values[y0*size+x0+1] += wx * (1 - wy)
+		k.Values[(y0+1)*size+x0] += (1 - wx) * wy
+		k.Values[(y0+1)*size+x0+1] += wx * wy
+	}
+	return normalizedPSF(k)
+}
+
+// LoadPSF reads a PSF from an image file: the luma of its pixels, centered on the middle of the image
+// Images of even width or height get an empty last column or row, so that the PSF has a center pixel
+func LoadPSF(filePath string) (Kernel, error) {
+	img, err := Load(filePath)
+	if err != nil {
+		return Kernel{}, err
+	}
+	bounds := img.Bounds
+	width, height := bounds.Dx()|1, bounds.Dy()|1
+	k := Kernel{Width: width, Height: height, Values: make([]float64, width*height), Scale: 1}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			k.Values[(y-bounds.Min.Y)*width+x-bounds.Min.X] = float64(straightLuma(img.In.RGBA64At(x, y)))
+		}
+	}
+	if k.Sum() == 0 {
+		return Kernel{}, errors.New("png: the PSF image is black")
+	}
+	return k.Normalize(), nil
+}
+
+// Wiener restores an image blurred by psf with a Wiener filter
+func (img *Image) Wiener(psf Kernel, noise float64) {
+	img.BSPWiener(psf, noise, 1)
+}
+
+// BSPWiener parallelly restores an image blurred by psf: in the frequency domain the estimate is
+// G conj(H) / (|H|^2 + noise), where G and H are the spectra of the image and the PSF and noise is the ratio of
+// the noise power to the signal power; it runs on the transforms of fft.go, two supersteps each
+// The blur is modeled as a convolution with the PSF, its image of a single point
+// The image is mirrored around its borders up to twice the PSF size and the transforms wrap around, so that the
+// restoration does not ring along the borders; the colors are restored premultiplied and every pixel keeps its alpha
+func (img *Image) BSPWiener(psf Kernel, noise float64, numThreads int) {
+	bounds := img.Bounds
+	width, height := bounds.Dx(), bounds.Dy()
+	hx, hy := psf.halo()
+	mx, my := 2*hx, 2*hy
+	w, h := fftSize(width+2*mx), fftSize(height+2*my)
+
+	planes := [][]complex128{make([]complex128, w*h), make([]complex128, w*h), make([]complex128, w*h)}
+	spectrum := planes[0]
+	for dy := -hy; dy <= hy; dy++ {
+		for dx := -hx; dx <= hx; dx++ {
+			spectrum[mod(dy, h)*w+mod(dx, w)] = complex(psf.Values[(dy+hy)*psf.Width+dx+hx], 0)
+		}
+	}
+	bspSlices(image.Rect(0, 0, w, h), numThreads, func(startY, endY int) {
+		for y := startY; y < endY; y++ {
+			ny := BorderReflect.index(y-my, height)
+			for x := 0; x < w; x++ {
+				c := img.In.RGBA64At(bounds.Min.X+BorderReflect.index(x-mx, width), bounds.Min.Y+ny)
+				planes[1][y*w+x] = complex(float64(c.R), float64(c.G))
+				planes[2][y*w+x] = complex(float64(c.B), 0)
+			}
+		}
+	})
+	fft2D(planes, w, h, false, numThreads)
+
+	// the filter is the spectrum of a real function, so it restores both colors of a plane at once
+	n := float64(w * h)
+	bspSlices(image.Rect(0, 0, w, h), numThreads, func(startY, endY int) {
+		for i := startY * w; i < endY*w; i++ {
+			H := spectrum[i]
+			power := real(H)*real(H) + imag(H)*imag(H)
+			filter := complex(real(H)/(power+noise)/n, -imag(H)/(power+noise)/n)
+			planes[1][i] *= filter
+			planes[2][i] *= filter
+		}
+	})
+	fft2D(planes[1:], w, h, true, numThreads)
+
+	img.bspRows(numThreads, func(startY, endY int) {
+		for y := startY; y < endY; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				i := (y-bounds.Min.Y+my)*w + x - bounds.Min.X + mx
+				img.finishSmooth(x, y, real(planes[1][i]), imag(planes[1][i]), real(planes[2][i]))
+			}
+		}
+	})
+}
+
+// psfTap is one nonzero value of a PSF, at offset (dx, dy) from its center
+type psfTap struct {
+	dx, dy int
+	w      float64
+}
+
+// RichardsonLucy restores an image blurred by psf with iterations steps of the Richardson-Lucy algorithm
+func (img *Image) RichardsonLucy(psf Kernel, iterations int) {
+	img.BSPRichardsonLucy(psf, iterations, 1)
+}
+
+// BSPRichardsonLucy parallelly restores an image blurred by psf with the Richardson-Lucy algorithm, which
+// refines the estimate f of the sharp image observed as g by f * (PSF' conv (g / (PSF conv f))), where PSF' is
+// the PSF mirrored; it converges towards the most likely image under Poisson noise and never goes negative
+// Every iteration is two supersteps, the ratios and then the update: the estimate is In and the update writes
+// the next one to Out, and the buffers are swapped between iterations, like between effects
+// Only the nonzero PSF values are visited, which keeps the sparse motion PSFs cheap; neighbors outside the image
+// are clamped to its borders, and the colors are restored premultiplied and every pixel keeps its alpha
+func (img *Image) BSPRichardsonLucy(psf Kernel, iterations, numThreads int) {
+	bounds := img.Bounds
+	width, height := bounds.Dx(), bounds.Dy()
+	hx, hy := psf.halo()
+	var taps []psfTap
+	for dy := -hy; dy <= hy; dy++ {
+		for dx := -hx; dx <= hx; dx++ {
+			if v := psf.Values[(dy+hy)*psf.Width+dx+hx]; v != 0 {
+				taps = append(taps, psfTap{dx, dy, v})
+			}
+		}
+	}
+
+	// the observed image, and the ratio of every color to its reblurred estimate
+	observed, ratio := make([][3]float64, width*height), make([][3]float64, width*height)
+	img.bspRows(numThreads, func(startY, endY int) {
+		for y := startY; y < endY; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				c := img.In.RGBA64At(x, y)
+				observed[(y-bounds.Min.Y)*width+x-bounds.Min.X] = [3]float64{float64(c.R), float64(c.G), float64(c.B)}
+			}
+		}
+	})
+	at := func(x, y int) (int, int) {
+		return bounds.Min.X + BorderClamp.index(x-bounds.Min.X, width), bounds.Min.Y + BorderClamp.index(y-bounds.Min.Y, height)
+	}
+
+	for it := 0; it < iterations; it++ {
+		img.bspRows(numThreads, func(startY, endY int) {
+			for y := startY; y < endY; y++ {
+				for x := bounds.Min.X; x < bounds.Max.X; x++ {
+					var blurred [3]float64
+					for _, t := range taps {
+						c := img.In.RGBA64At(at(x-t.dx, y-t.dy))
+						blurred[0] += t.w * float64(c.R)
+						blurred[1] += t.w * float64(c.G)
+						blurred[2] += t.w * float64(c.B)
+					}
+					i := (y-bounds.Min.Y)*width + x - bounds.Min.X
+					for c := range blurred {
+						// a reblurred value under one unit would blow the ratio up
+						ratio[i][c] = observed[i][c] / math.Max(blurred[c], 1)
+					}
+				}
+			}
+		})
+		img.bspRows(numThreads, func(startY, endY int) {
+			for y := startY; y < endY; y++ {
+				for x := bounds.Min.X; x < bounds.Max.X; x++ {
+					var correction [3]float64
+					for _, t := range taps {
+						nx, ny := at(x+t.dx, y+t.dy)
+						r := ratio[(ny-bounds.Min.Y)*width+nx-bounds.Min.X]
+						correction[0] += t.w * r[0]
+						correction[1] += t.w * r[1]
+						correction[2] += t.w * r[2]
+					}
+					c := img.In.RGBA64At(x, y)
+					img.finishSmooth(x, y, float64(c.R)*correction[0], float64(c.G)*correction[1], float64(c.B)*correction[2])
+				}
+			}
+		})
+		if it < iterations-1 {
+			img.SwapBuffers() // the new estimate becomes the input of the next iteration
+		}
+	}
+}
+
+// deblurEffect is the effect of the deconvolutions, which restore the whole image at once: Prepare runs the
+// restoration and Apply copies its rows
+type deblurEffect struct {
+	rowImage
+	psf        Kernel
+	noise      float64 // the noise to signal ratio of the Wiener filter
+	iterations int     // the iterations of Richardson-Lucy, 0 for the Wiener filter
+	restored   *image.RGBA64
+}
+
+func (e *deblurEffect) Info() EffectInfo { return EffectInfo{Halo: WholeImage, KeepsAlpha: true} }
+
+// Prepare restores the whole image
+func (e *deblurEffect) Prepare(in *image.RGBA64, numThreads int) {
+	img := e.view(in, image.NewRGBA64(e.bounds))
+	if e.iterations == 0 {
+		img.BSPWiener(e.psf, e.noise, numThreads)
+	} else {
+		if e.iterations > 1 {
+			// the iterations swap the buffers, and in is not theirs to overwrite
+			img.In = image.NewRGBA64(e.bounds)
+			copy(img.In.Pix, in.Pix)
+		}
+		img.BSPRichardsonLucy(e.psf, e.iterations, numThreads)
+	}
+	e.restored = img.Out
+}
+
+// Apply copies rows of the restored image to out
+func (e *deblurEffect) Apply(in, out *image.RGBA64, rows Rows) {
+	copyRows(out, e.restored, rows)
+}
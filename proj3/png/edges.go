@@ -0,0 +1,457 @@
+// Package png allows for loading png images and applying image flitering effects on them
+// Gradient operators (Sobel, Scharr, Prewitt) and Canny edge detection
+// https://en.wikipedia.org/wiki/Sobel_operator
+// https://en.wikipedia.org/wiki/Canny_edge_detector
+package png
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"sync/atomic"
+)
+
+// GradientOperator selects the 3x3 derivative kernels of the gradient effects
+type GradientOperator string
+
+const (
+	Sobel   GradientOperator = "sobel"
+	Scharr  GradientOperator = "scharr"
+	Prewitt GradientOperator = "prewitt"
+)
+
+// ParseGradientOperator validates an operator name; the empty string selects Sobel
+func ParseGradientOperator(s string) (GradientOperator, error) {
+	switch op := GradientOperator(s); op {
+	case "":
+		return Sobel, nil
+	case Sobel, Scharr, Prewitt:
+		return op, nil
+	}
+	return "", fmt.Errorf("png: unknown gradient operator %q", s)
+}
+
+// weights returns the smoothing across the derivative, e.g. Gx = [1 2 1]^T * [-1 0 1] for Sobel
+func (op GradientOperator) weights() [3]float64 {
+	switch op {
+	case Scharr:
+		return [3]float64{3, 10, 3}
+	case Prewitt:
+		return [3]float64{1, 1, 1}
+	}
+	return [3]float64{1, 2, 1}
+}
+
+// Outputs of the gradient effects
+const (
+	GradientMagnitude   = "magnitude"   // gray level of the gradient magnitude
+	GradientOrientation = "orientation" // hue of the gradient direction, brightness of its magnitude
+)
+
+// Gradient describes a Sobel, Scharr or Prewitt effect
+// The operators work on the Rec. 709 luma of the image, and a unit step gives a magnitude of 1 (full intensity)
+type Gradient struct {
+	Operator GradientOperator
+	Output   string
+	Border   BorderMode
+}
+
+// Canny describes a Canny edge detection: Gaussian smoothing of standard deviation Sigma, the gradient of Operator,
+// non-maximum suppression, and the Low and High thresholds of the double threshold (fractions of full intensity)
+type Canny struct {
+	Operator GradientOperator
+	Sigma    float64
+	Low      float64
+	High     float64
+}
+
+// plane is a single-channel float image used by the multi-stage effects, indexed from (0, 0)
+type plane struct {
+	width  int
+	height int
+	values []float64
+}
+
+func newPlane(width, height int) *plane {
+	return &plane{width: width, height: height, values: make([]float64, width*height)}
+}
+
+// at returns the value at (x, y), which may lie outside the plane
+func (p *plane) at(x, y int, border BorderMode) float64 {
+	if x < 0 || x >= p.width || y < 0 || y >= p.height {
+		if x, y = border.index(x, p.width), border.index(y, p.height); x < 0 || y < 0 {
+			return 0
+		}
+	}
+	return p.values[y*p.width+x]
+}
+
+// lumaRows stores the Rec. 709 luma of rows [startY, endY) of In, from 0 to 1
+func (img *Image) lumaRows(p *plane, startY, endY int) {
+	bounds := img.Bounds
+	for y := startY; y < endY; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := img.In.RGBA64At(x, y)
+			luma := 0.2126*float64(c.R) + 0.7152*float64(c.G) + 0.0722*float64(c.B)
+			p.values[(y-bounds.Min.Y)*p.width+x-bounds.Min.X] = luma / 65535
+		}
+	}
+}
+
+// gradientAt applies the operator to the neighborhood of (x, y)
+func gradientAt(p *plane, x, y int, op GradientOperator, border BorderMode) (gx, gy float64) {
+	w := op.weights()
+	for i := -1; i <= 1; i++ {
+		gx += w[i+1] * (p.at(x+1, y+i, border) - p.at(x-1, y+i, border))
+		gy += w[i+1] * (p.at(x+i, y+1, border) - p.at(x+i, y-1, border))
+	}
+	sum := w[0] + w[1] + w[2]
+	return gx / sum, gy / sum
+}
+
+// hsv converts a hue in radians and a value from 0 to 1 of a fully saturated color to RGB
+func hsv(hue, value float64) (r, g, b float64) {
+	h := (hue + math.Pi) / (2 * math.Pi) * 6
+	i := math.Floor(h)
+	f := h - i
+	q, t := value*(1-f), value*f
+	switch int(i) % 6 {
+	case 0:
+		return value, t, 0
+	case 1:
+		return q, value, 0
+	case 2:
+		return 0, value, t
+	case 3:
+		return 0, q, value
+	case 4:
+		return t, 0, value
+	}
+	return value, 0, q
+}
+
+// gradientRows writes the gradient of rows [startY, endY) to Out
+func (img *Image) gradientRows(g Gradient, p *plane, startY, endY int) {
+	bounds := img.Bounds
+	for y := startY; y < endY; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			gx, gy := gradientAt(p, x-bounds.Min.X, y-bounds.Min.Y, g.Operator, g.Border)
+			magnitude := math.Min(1, math.Hypot(gx, gy))
+			a := img.In.RGBA64At(x, y).A
+			// the luma is premultiplied, and so is the output: no channel may exceed alpha
+			if g.Output == GradientOrientation {
+				r, gr, b := hsv(math.Atan2(gy, gx), magnitude)
+				img.Out.SetRGBA64(x, y, color.RGBA64{
+					minUint16(clamp(r*65535), a), minUint16(clamp(gr*65535), a), minUint16(clamp(b*65535), a), a})
+				continue
+			}
+			v := minUint16(clamp(magnitude*65535), a)
+			img.Out.SetRGBA64(x, y, color.RGBA64{v, v, v, a})
+		}
+	}
+}
+
+// Gradient applies a Sobel, Scharr or Prewitt effect to the image
+func (img *Image) Gradient(g Gradient) {
+	img.BSPGradient(g, 1)
+}
+
+// BSPGradient parallelly applies a Sobel, Scharr or Prewitt effect to the image
+// The gradient of a row needs the luma of the rows around it, so every slice computes the luma of its rows and of
+// the row on either side, and the whole superstep needs no barrier in between (see gradientEffect)
+func (img *Image) BSPGradient(g Gradient, numThreads int) {
+	img.applyRows(&gradientEffect{rowImage: img.rowImage(), g: g}, numThreads)
+}
+
+// gradientEffect is the effect of the gradient operators
+type gradientEffect struct {
+	rowImage
+	g    Gradient
+	luma *plane // the luma of the whole image, prepared for the wrap border
+}
+
+func (e *gradientEffect) Info() EffectInfo {
+	return EffectInfo{Halo: borderHalo(1, e.g.Border), KeepsAlpha: true}
+}
+
+// Prepare computes the luma of the whole image, once, when the wrap border makes every row read the far edge
+func (e *gradientEffect) Prepare(in *image.RGBA64, numThreads int) {
+	if e.g.Border != BorderWrap {
+		return
+	}
+	img := e.view(in, nil)
+	e.luma = newPlane(e.bounds.Dx(), e.bounds.Dy())
+	img.bspRows(numThreads, func(startY, endY int) {
+		img.lumaRows(e.luma, startY, endY)
+	})
+}
+
+// Apply writes the gradient of rows of in to out
+func (e *gradientEffect) Apply(in, out *image.RGBA64, rows Rows) {
+	img, p := e.view(in, out), e.luma
+	if p == nil {
+		img = e.bandView(in, out, rows, 1)
+		p = newPlane(img.Bounds.Dx(), img.Bounds.Dy())
+		img.lumaRows(p, img.Bounds.Min.Y, img.Bounds.Max.Y)
+	}
+	img.gradientRows(e.g, p, rows.Min, rows.Max)
+}
+
+// Canny applies a Canny edge detection to the image
+func (img *Image) Canny(c Canny) {
+	img.BSPCanny(c, 1)
+}
+
+// nmsOffsets are the neighbors along the gradient direction, quantized to 0, 45, 90 and 135 degrees
+var nmsOffsets = [4][2]int{{1, 0}, {1, 1}, {0, 1}, {-1, 1}}
+
+// Pixel classes of the double threshold
+const (
+	cannyNone   = 0
+	cannyWeak   = 1
+	cannyStrong = 2
+)
+
+// BSPCanny parallelly applies a Canny edge detection to the image; every stage is one superstep
+// Edges become white (with the alpha of the input), everything else black
+func (img *Image) BSPCanny(c Canny, numThreads int) {
+	img.applyRows(&cannyEffect{rowImage: img.rowImage(), c: c}, numThreads)
+}
+
+// cannyEffect is the effect of a Canny edge detection: the hysteresis connects edges across the whole image,
+// so Prepare runs every stage up to it and Apply writes the edges
+type cannyEffect struct {
+	rowImage
+	c      Canny
+	class  []uint8  // the class of every pixel after the double threshold
+	roots  []int32  // the root of the component of every weak or strong pixel
+	strong []uint32 // set at the roots of the components with a strong pixel
+}
+
+func (e *cannyEffect) Info() EffectInfo { return EffectInfo{Halo: WholeImage, KeepsAlpha: true} }
+
+// Prepare runs the stages of the edge detection on the whole image
+func (e *cannyEffect) Prepare(in *image.RGBA64, numThreads int) {
+	img, c := e.view(in, nil), e.c
+	bounds := img.Bounds
+	width, height := bounds.Dx(), bounds.Dy()
+	// rows returns the plane rows of a slice
+	rows := func(fn func(y int)) func(startY, endY int) {
+		return func(startY, endY int) {
+			for y := startY - bounds.Min.Y; y < endY-bounds.Min.Y; y++ {
+				fn(y)
+			}
+		}
+	}
+
+	luma := newPlane(width, height)
+	img.bspRows(numThreads, func(startY, endY int) {
+		img.lumaRows(luma, startY, endY)
+	})
+
+	// 1. Gaussian smoothing, as a horizontal and a vertical pass
+	smooth := luma
+	if c.Sigma > 0 {
+		col, row, _ := gaussianKernel(c.Sigma, 0).separable()
+		r := len(row) / 2
+		tmp := newPlane(width, height)
+		smooth = newPlane(width, height)
+		img.bspRows(numThreads, rows(func(y int) {
+			for x := 0; x < width; x++ {
+				sum := 0.0
+				for i, k := range row {
+					sum += k * luma.at(x+i-r, y, BorderClamp)
+				}
+				tmp.values[y*width+x] = sum
+			}
+		}))
+		img.bspRows(numThreads, rows(func(y int) {
+			for x := 0; x < width; x++ {
+				sum := 0.0
+				for i, k := range col {
+					sum += k * tmp.at(x, y+i-r, BorderClamp)
+				}
+				smooth.values[y*width+x] = sum
+			}
+		}))
+	}
+
+	// 2. gradient magnitude and direction
+	magnitude := newPlane(width, height)
+	direction := make([]uint8, width*height)
+	img.bspRows(numThreads, rows(func(y int) {
+		for x := 0; x < width; x++ {
+			gx, gy := gradientAt(smooth, x, y, c.Operator, BorderClamp)
+			magnitude.values[y*width+x] = math.Hypot(gx, gy)
+			angle := math.Atan2(gy, gx) * 180 / math.Pi
+			if angle < 0 {
+				angle += 180
+			}
+			switch {
+			case angle < 22.5 || angle >= 157.5:
+				direction[y*width+x] = 0
+			case angle < 67.5:
+				direction[y*width+x] = 1
+			case angle < 112.5:
+				direction[y*width+x] = 2
+			default:
+				direction[y*width+x] = 3
+			}
+		}
+	}))
+
+	// 3. non-maximum suppression thins the edges to one pixel across
+	thin := newPlane(width, height)
+	img.bspRows(numThreads, rows(func(y int) {
+		for x := 0; x < width; x++ {
+			m := magnitude.values[y*width+x]
+			d := nmsOffsets[direction[y*width+x]]
+			// the strict comparison on one side keeps a single pixel of a plateau
+			if m > magnitude.at(x+d[0], y+d[1], BorderZero) && m >= magnitude.at(x-d[0], y-d[1], BorderZero) {
+				thin.values[y*width+x] = m
+			}
+		}
+	}))
+
+	// 4. double threshold
+	class := make([]uint8, width*height)
+	img.bspRows(numThreads, rows(func(y int) {
+		for x := 0; x < width; x++ {
+			switch m := thin.values[y*width+x]; {
+			case m >= c.High:
+				class[y*width+x] = cannyStrong
+			case m >= c.Low:
+				class[y*width+x] = cannyWeak
+			}
+		}
+	}))
+
+	// 5. hysteresis keeps the weak pixels connected to a strong one
+	e.class = class
+	e.roots, e.strong = img.hysteresis(class, numThreads)
+}
+
+// Apply writes the edges of rows to out
+func (e *cannyEffect) Apply(in, out *image.RGBA64, rows Rows) {
+	bounds := e.bounds
+	width := bounds.Dx()
+	for y := rows.Min; y < rows.Max; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			i := (y-bounds.Min.Y)*width + x - bounds.Min.X
+			a := in.RGBA64At(x, y).A
+			var v uint16
+			if e.class[i] != cannyNone && e.strong[e.roots[i]] == 1 {
+				v = a // premultiplied white
+			}
+			out.SetRGBA64(x, y, color.RGBA64{v, v, v, a})
+		}
+	}
+}
+
+// hysteresis finds the edges of Canny: the pixels of every 8-connected component of weak and strong pixels that
+// contains at least one strong pixel; it returns the root of the component of every pixel, and strong is set at the
+// roots of the edges
+// The components are labeled with a union-find in three steps: every slice labels its own rows
+// in parallel, the main thread stitches the slices together along their boundary rows, and a
+// last parallel pass marks the components with a strong pixel
+func (img *Image) hysteresis(class []uint8, numThreads int) (roots []int32, strong []uint32) {
+	bounds := img.Bounds
+	width, height := bounds.Dx(), bounds.Dy()
+	parent := make([]int32, len(class))
+
+	// label each slice on its own; unions never leave the slice, so the slices share no state
+	img.bspRows(numThreads, func(startY, endY int) {
+		y0, y1 := startY-bounds.Min.Y, endY-bounds.Min.Y
+		for i := y0 * width; i < y1*width; i++ {
+			parent[i] = int32(i)
+		}
+		for y := y0; y < y1; y++ {
+			for x := 0; x < width; x++ {
+				i := y*width + x
+				if class[i] == cannyNone {
+					continue
+				}
+				// the neighbors visited before: west, north-west, north and north-east
+				for _, d := range [4][2]int{{-1, 0}, {-1, -1}, {0, -1}, {1, -1}} {
+					nx, ny := x+d[0], y+d[1]
+					if nx < 0 || nx >= width || ny < y0 {
+						continue
+					}
+					if j := ny*width + nx; class[j] != cannyNone {
+						union(parent, int32(i), int32(j))
+					}
+				}
+			}
+		}
+	})
+
+	// stitch the slices along the first row of every slice
+	for t := 1; t < numThreads; t++ {
+		y := sliceStart(bounds, t, numThreads) - bounds.Min.Y
+		if y <= 0 || y >= height {
+			continue
+		}
+		for x := 0; x < width; x++ {
+			i := y*width + x
+			if class[i] == cannyNone {
+				continue
+			}
+			for nx := x - 1; nx <= x+1; nx++ {
+				if nx < 0 || nx >= width {
+					continue
+				}
+				if j := (y-1)*width + nx; class[j] != cannyNone {
+					union(parent, int32(i), int32(j))
+				}
+			}
+		}
+	}
+
+	// mark the components with a strong pixel; the trees are final now and only read
+	roots = make([]int32, len(class))
+	strong = make([]uint32, len(class))
+	img.bspRows(numThreads, func(startY, endY int) {
+		for i := (startY - bounds.Min.Y) * width; i < (endY-bounds.Min.Y)*width; i++ {
+			if class[i] == cannyNone {
+				continue
+			}
+			r := root(parent, int32(i))
+			roots[i] = r
+			if class[i] == cannyStrong {
+				// several slices may mark the same component
+				atomic.StoreUint32(&strong[r], 1)
+			}
+		}
+	})
+
+	return roots, strong
+}
+
+// find returns the root of i, halving the path on the way
+func find(parent []int32, i int32) int32 {
+	for parent[i] != i {
+		parent[i] = parent[parent[i]]
+		i = parent[i]
+	}
+	return i
+}
+
+// root returns the root of i without modifying the trees, so that several goroutines may call it
+func root(parent []int32, i int32) int32 {
+	for parent[i] != i {
+		i = parent[i]
+	}
+	return i
+}
+
+// union merges the components of i and j under the smaller root
+func union(parent []int32, i, j int32) {
+	ri, rj := find(parent, i), find(parent, j)
+	switch {
+	case ri < rj:
+		parent[rj] = ri
+	case rj < ri:
+		parent[ri] = rj
+	}
+}
@@ -4,147 +4,236 @@
 package png
 
 import (
+	"image"
 	"image/color"
-	"sync"
 )
 
-type Barrier struct {
-	sync.Mutex
-	cond       *sync.Cond
-	count      int // Number of waiting threads
-	threshold  int // Total required participants required to release the barrier
-	generation int // Phase counter (prevent spurious wakeups between phases)
+// ImageTask is used to unmarshal each JSON object from effects.txt
+// https://www.youtube.com/watch?v=hzSkpuL2I_Y&t=695s
+// https://stackoverflow.com/questions/21197239/decoding-json-using-json-unmarshal-vs-json-newdecoder-decode
+type ImageTask struct {
+	InPath   string       `json:"inPath"`
+	OutPath  string       `json:"outPath"`
+	Effects  []EffectSpec `json:"effects"`
+	Quality  int          `json:"quality"`  // JPEG quality of the output image, optional
+	Depth    int          `json:"depth"`    // Bits per sample of Netpbm output images (8 or 16), optional
+	Alpha    string       `json:"alpha"`    // Alpha mode of the convolution effects (see alpha.go), optional
+	Linear   *bool        `json:"linear"`   // Apply the effects in linear light (see linear.go), optional: nil follows the editor
+	Optimize string       `json:"optimize"` // How far the effect list may be rewritten (see optimize.go), optional
+	DataDir  string       `json:"-"`
+	Mode     string       `json:"-"` // Scheduler mode running the task, recorded in the output provenance
+	Threads  int          `json:"-"` // Thread count of the scheduler, recorded in the output provenance
+}
+
+// Provenance returns the provenance record of the task for an image loaded from inPath
+func (task ImageTask) Provenance(inPath string) *Provenance {
+	return &Provenance{Effects: task.Effects, Mode: task.Mode, Threads: task.Threads, Linear: task.LinearLight(), Optimize: task.Optimize, InputPath: inPath}
+}
+
+// LinearLight reports whether the effects of the task run in linear light
+func (task ImageTask) LinearLight() bool {
+	return task.Linear != nil && *task.Linear
 }
 
-func NewBarrier(threshold int) *Barrier {
-	b := &Barrier{threshold: threshold}
-	b.cond = sync.NewCond(&b.Mutex)
-	return b
+// Plan returns the passes that apply the effects of the task and the report of the optimizer (see optimize.go)
+func (task ImageTask) Plan() ([]Pass, []string, error) {
+	opt, err := ParseOptimization(task.Optimize)
+	if err != nil {
+		return nil, nil, err
+	}
+	alpha, err := ParseAlphaMode(task.Alpha)
+	if err != nil {
+		return nil, nil, err
+	}
+	passes, report := Optimize(task.Effects, opt, alpha)
+	return passes, report, nil
 }
 
-func (b *Barrier) Wait() {
-	b.Lock()
-	defer b.Unlock()
+// 3x3 kernels of the built-in effects, flattened row by row
+var (
+	sharpenKernel       = kernel3([9]float64{0, -1, 0, -1, 5, -1, 0, -1, 0})
+	edgeDetectionKernel = kernel3([9]float64{-1, -1, -1, -1, 8, -1, -1, -1, -1})
+	blurKernel          = kernel3([9]float64{1.0 / 9, 1.0 / 9, 1.0 / 9, 1.0 / 9, 1.0 / 9, 1.0 / 9, 1.0 / 9, 1.0 / 9, 1.0 / 9})
+)
+
+// CNN: https://www.youtube.com/watch?v=FrKWiRv254g&list=PLJV_el3uVTsPy9oCRY30oBPNLCo89yu49&index=19
+// Apply a convolution kernel of any odd size to the image (see kernel.go); large kernels go through the FFT (see fft.go)
+func (img *Image) Convolution(kernel Kernel) {
+	img.applyRows(img.convolutionEffect(kernel), 1)
+}
 
-	localGen := b.generation
-	b.count++
+// convolutionEffect is the effect of a convolution
+type convolutionEffect struct {
+	rowImage
+	kernel   Kernel
+	col, row []float64     // the factors of a separable kernel, nil for the direct convolution
+	fft      *image.RGBA64 // the result of the FFT convolution, once prepared
+	tmp      []float64     // the horizontal pass over the whole image, prepared for the wrap border
+	weight   float64       // the sum of the kernel values
+}
 
-	if b.count == b.threshold {
-		b.count = 0
-		b.generation++
-		b.cond.Broadcast()
-	} else {
-		for localGen == b.generation {
-			b.cond.Wait()
-		}
+func (img *Image) convolutionEffect(kernel Kernel) *convolutionEffect {
+	e := &convolutionEffect{rowImage: img.rowImage(), kernel: kernel, weight: kernel.weight()}
+	if col, row, ok := kernel.useSeparable(); ok {
+		e.col, e.row = col, row
 	}
+	return e
 }
 
-// ImageTask is used to unmarshal each JSON object from effects.txt
-// https://www.youtube.com/watch?v=hzSkpuL2I_Y&t=695s
-// https://stackoverflow.com/questions/21197239/decoding-json-using-json-unmarshal-vs-json-newdecoder-decode
-type ImageTask struct {
-	InPath  string   `json:"inPath"`
-	OutPath string   `json:"outPath"`
-	Effects []string `json:"effects"`
-	DataDir string
+func (e *convolutionEffect) Info() EffectInfo {
+	hx, hy := e.kernel.halo()
+	if hy > hx {
+		hx = hy
+	}
+	return EffectInfo{Halo: borderHalo(hx, e.kernel.Border), KeepsAlpha: e.alpha == AlphaIgnore || e.alpha == ""}
 }
 
-// CNN: https://www.youtube.com/watch?v=FrKWiRv254g&list=PLJV_el3uVTsPy9oCRY30oBPNLCo89yu49&index=19
-// Apply a 3x3 convolution kernel to the image
-func (img *Image) convolution(kernel [9]float64) {
-	bounds := img.Bounds // get the bounds of the input image
-	// iterate over each pixel in the image
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			// apply kernel to the current pixel, returning new RGB values
-			r, g, b := img.convolve(x, y, kernel)
-			// retrieve the alpha value (transparency) of the current pixel from the input image
-			_, _, _, a := img.In.At(x, y).RGBA()
-			// set the new RGB values and original alpha to the output image
-			img.Out.Set(x, y, color.RGBA64{r, g, b, uint16(a)})
+// Prepare runs the FFT convolution of large kernels, and the horizontal pass of a separable kernel when the wrap
+// border makes every row read the far edge of the image
+func (e *convolutionEffect) Prepare(in *image.RGBA64, numThreads int) {
+	if e.kernel.useFFT() {
+		img := e.view(in, image.NewRGBA64(e.bounds))
+		img.fftConvolution(e.kernel, numThreads)
+		e.fft = img.Out
+		return
+	}
+	if e.row != nil && e.kernel.Border == BorderWrap {
+		img := e.view(in, nil)
+		e.tmp = make([]float64, 4*e.bounds.Dx()*e.bounds.Dy())
+		img.bspRows(numThreads, func(startY, endY int) {
+			img.horizontalPass(e.row, e.kernel.Border, e.kernel.Gray, e.tmp, e.bounds.Min.Y, startY, endY)
+		})
+	}
+}
+
+// Apply convolves rows of in into out
+func (e *convolutionEffect) Apply(in, out *image.RGBA64, rows Rows) {
+	if e.fft != nil {
+		copyRows(out, e.fft, rows)
+		return
+	}
+	if e.row != nil {
+		e.separableRows(in, out, rows)
+		return
+	}
+	img := e.view(in, out)
+	for y := rows.Min; y < rows.Max; y++ {
+		for x := e.bounds.Min.X; x < e.bounds.Max.X; x++ {
+			// apply kernel to the current pixel, returning new RGBA values (see alpha.go for the alpha modes)
+			r, g, b, a := img.convolve(x, y, e.kernel, e.weight)
+			// set the new RGBA values to the output image
+			out.SetRGBA64(x, y, color.RGBA64{r, g, b, a})
 		}
 	}
 }
 
-// Convolve applies the convolution kernel to a single pixel
-func (img *Image) convolve(x int, y int, kernel [9]float64) (r, g, b uint16) {
-	var sumR, sumG, sumB float64 // new sum variables for each color channel
+// Convolve applies the convolution kernel, whose values add up to weight, to a single pixel
+// With AlphaIgnore the alpha value (transparency) of the current pixel is kept as is
+func (img *Image) convolve(x int, y int, kernel Kernel, weight float64) (r, g, b, a uint16) {
+	var sumR, sumG, sumB, sumA float64 // new sum variables for each color channel
 	bounds := img.Bounds
+	hx, hy := kernel.halo()
+
+	// fast path: the whole neighborhood lies inside the image, so no coordinate needs checking
+	if kernel.interior(x, y, bounds) {
+		for dy := -hy; dy <= hy; dy++ {
+			for dx := -hx; dx <= hx; dx++ {
+				c := img.In.RGBA64At(x+dx, y+dy)
+				r, g, b, a := uint32(c.R), uint32(c.G), uint32(c.B), uint32(c.A)
+				k := kernel.Values[(dy+hy)*kernel.Width+(dx+hx)]
+				sumR += float64(r) * k
+				sumA += float64(a) * k
+				if !kernel.Gray {
+					sumG += float64(g) * k
+					sumB += float64(b) * k
+				}
+			}
+		}
+		if kernel.Gray {
+			sumG, sumB = sumR, sumR
+		}
+		return img.convolved(x, y, kernel, weight, sumR, sumG, sumB, sumA)
+	}
+	if kernel.Border == BorderValid {
+		c := img.In.RGBA64At(x, y)
+		return c.R, c.G, c.B, c.A
+	}
 
-	// iterate over the 3x3 neighborhood of the current pixel
-	for dy := -1; dy <= 1; dy++ {
-		for dx := -1; dx <= 1; dx++ {
-			neighborX := x + dx
-			neighborY := y + dy
-
+	// iterate over the kernel-sized neighborhood of the current pixel
+	width, height := bounds.Dx(), bounds.Dy()
+	for dy := -hy; dy <= hy; dy++ {
+		for dx := -hx; dx <= hx; dx++ {
 			/*
 				Image convolution involves applying kernels to each pixel and its surrounding pixels in the image
 				For pixels at the edges of the image, some of the surrounding pixels required for the convolution operation don't exist
-				To handle this, we use "zero-padding" that imaginary pixels with a value of zero are added around the edges of the image
-				The results for these edge pixels will not be as accurate as for pixels in the center of the image
+				By default we use "zero-padding" that imaginary pixels with a value of zero are added around the edges of the image
+				The results for these edge pixels will not be as accurate as for pixels in the center of the image,
+				which the other border modes avoid by standing in pixels of the image for the missing ones
 			*/
-			// valid coordinates range: [Min.X, Max.X) and [Min.Y, Max.Y)
-			if neighborX < bounds.Min.X || neighborX >= bounds.Max.X || neighborY < bounds.Min.Y || neighborY >= bounds.Max.Y {
+			neighborX := kernel.Border.index(x+dx-bounds.Min.X, width)
+			neighborY := kernel.Border.index(y+dy-bounds.Min.Y, height)
+			if neighborX < 0 || neighborY < 0 {
 				continue // skip this pixel: zero padding
 			}
 
-			// get the RGB values of the neighboring pixel
-			r, g, b, _ := img.In.At(neighborX, neighborY).RGBA()
+			// get the RGBA values of the neighboring pixel
+			r, g, b, a := img.In.At(bounds.Min.X+neighborX, bounds.Min.Y+neighborY).RGBA()
 			// map the 2D kernel coordinates to a 1D array index
-			index := (dy+1)*3 + (dx + 1)
+			k := kernel.Values[(dy+hy)*kernel.Width+(dx+hx)]
 			// accumulate the kernel value to each color channel
-			sumR += float64(r) * kernel[index]
-			sumG += float64(g) * kernel[index]
-			sumB += float64(b) * kernel[index]
+			sumR += float64(r) * k
+			sumA += float64(a) * k
+			if !kernel.Gray {
+				sumG += float64(g) * k
+				sumB += float64(b) * k
+			}
 		}
 	}
+	if kernel.Gray {
+		sumG, sumB = sumR, sumR
+	}
 
-	return clamp(sumR), clamp(sumG), clamp(sumB)
+	return img.convolved(x, y, kernel, weight, sumR, sumG, sumB, sumA)
+}
+
+// convolved turns the kernel sums of the premultiplied channels of pixel (x, y) into its new RGBA values
+// For AlphaStraight they are the straight colors weighted by alpha, so that the sums divided by that of alpha
+// are the straight colors of the kernel, whose values add up to weight, and a transparent neighbor adds no color
+func (img *Image) convolved(x, y int, kernel Kernel, weight, sumR, sumG, sumB, sumA float64) (r, g, b, a uint16) {
+	if img.AlphaMode == AlphaStraight {
+		if sumA <= 0 {
+			return 0, 0, 0, 0
+		}
+		scale := weight * 0xffff / sumA
+		sumR, sumG, sumB = sumR*scale, sumG*scale, sumB*scale
+	}
+	sumR, sumG, sumB = kernel.finish(sumR), kernel.finish(sumG), kernel.finish(sumB)
+
+	if mode := img.AlphaMode; mode != AlphaIgnore && mode != "" {
+		return finishAlpha(mode, sumR, sumG, sumB, sumA)
+	}
+	_, _, _, a32 := img.In.At(x, y).RGBA()
+	return clamp(sumR), clamp(sumG), clamp(sumB), uint16(a32)
 }
 
 // Sharpen() applies a sharpening effect to a image
 func (img *Image) Sharpen() {
-	kernel := [9]float64{0, -1, 0, -1, 5, -1, 0, -1, 0}
-	img.convolution(kernel)
+	img.Convolution(sharpenKernel)
 }
 
 // EdgeDetection() applies an edge detection effect to a image
 func (img *Image) EdgeDetection() {
-	kernel := [9]float64{-1, -1, -1, -1, 8, -1, -1, -1, -1}
-	img.convolution(kernel)
+	img.Convolution(edgeDetectionKernel)
 }
 
 // Blur() applies a blur effect to a image
 func (img *Image) Blur() {
-	kernel := [9]float64{1.0 / 9, 1.0 / 9, 1.0 / 9, 1.0 / 9, 1.0 / 9, 1.0 / 9, 1.0 / 9, 1.0 / 9, 1.0 / 9}
-	img.convolution(kernel)
+	img.Convolution(blurKernel)
 }
 
-// Grayscale() applies a grayscale filtering effect to a image
+// Grayscale() applies a grayscale filtering effect to a image, averaging the three channels
 func (img *Image) Grayscale() {
-
-	// Bounds returns defines the dimensions of the image. Always
-	// use the bounds Min and Max fields to get out the width
-	// and height for the image
-	bounds := img.Out.Bounds()
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			// Returns the pixel (i.e., RGBA) value at a (x,y) position
-			// Note: These get returned as int32 so based on the math you'll
-			// be performing you'll need to do a conversion to float64(..)
-			r, g, b, a := img.In.At(x, y).RGBA()
-
-			// Note: The values for r,g,b,a for this assignment will range between [0, 65535].
-			// For certain computations (i.e., convolution) the values might fall outside this
-			// range so you need to clamp them between those values.
-			greyC := clamp(float64(r+g+b) / 3)
-
-			// Note: The values need to be stored back as uint16 (I know weird..but there's valid reasons
-			// for this that I won't get into right now).
-			img.Out.Set(x, y, color.RGBA64{greyC, greyC, greyC, uint16(a)})
-		}
-	}
+	img.GrayscaleWith(GrayAverage)
 }
 
 ////// Below is the BSP version //////
@@ -161,82 +250,30 @@ func (img *Image) Grayscale() {
 │
 [Barrier Release]
 └─ All workers + main thread continue
-*/
-func (img Image) BSPConvolution(kernel [9]float64, numThreads int) {
-
-	// divide image into horizontal slices
-	bounds := img.Bounds
-	height := bounds.Max.Y - bounds.Min.Y
-	sliceHeight := height / numThreads
-	barrier := NewBarrier(numThreads + 1)
-
-	for i := 0; i < numThreads; i++ {
-		// horizontally set start and end of a slice for each goroutine
-		// give larger overlapping slices to goroutines
-		start := bounds.Min.Y + i*sliceHeight
-		end := start + sliceHeight
-
-		// clamp to image bounds for the last slice
-		if i == numThreads-1 {
-			end = bounds.Max.Y
-		}
 
-		go func(startY, endY int) {
-			for y := startY; y < endY; y++ {
-				for x := bounds.Min.X; x < bounds.Max.X; x++ {
-					r, g, b := img.convolve(x, y, kernel)
-					_, _, _, a := img.In.At(x, y).RGBA()
-					img.Out.Set(x, y, color.RGBA64{r, g, b, uint16(a)})
-				}
-			}
-			barrier.Wait()
-		}(start, end)
-	}
-	barrier.Wait()
+Every worker reads its neighbors straight from the shared input buffer, which nobody writes during the superstep,
+so slices need no overlap however far the kernel reaches beyond the slice boundaries
+*/
+func (img Image) BSPConvolution(kernel Kernel, numThreads int) {
+	img.applyRows(img.convolutionEffect(kernel), numThreads)
 }
 
 // BSPSharpen() parallelly applies a sharpening effect to a image
 func (img *Image) BSPSharpen(numThreads int) {
-	kernel := [9]float64{0, -1, 0, -1, 5, -1, 0, -1, 0}
-	img.BSPConvolution(kernel, numThreads)
+	img.BSPConvolution(sharpenKernel, numThreads)
 }
 
 // BSPEdgeDetection() parallelly applies an edge detection effect to a image
 func (img *Image) BSPEdgeDetection(numThreads int) {
-	kernel := [9]float64{-1, -1, -1, -1, 8, -1, -1, -1, -1}
-	img.BSPConvolution(kernel, numThreads)
+	img.BSPConvolution(edgeDetectionKernel, numThreads)
 }
 
 // BSPBlur() parallelly applies a blur effect to a image
 func (img *Image) BSPBlur(numThreads int) {
-	kernel := [9]float64{1.0 / 9, 1.0 / 9, 1.0 / 9, 1.0 / 9, 1.0 / 9, 1.0 / 9, 1.0 / 9, 1.0 / 9, 1.0 / 9}
-	img.BSPConvolution(kernel, numThreads)
+	img.BSPConvolution(blurKernel, numThreads)
 }
 
+// BSPGrayscale() parallelly applies a grayscale filtering effect to a image, averaging the three channels
 func (img *Image) BSPGrayscale(numThreads int) {
-
-	bounds := img.Bounds
-	height := bounds.Max.Y - bounds.Min.Y
-	sliceHeight := height / numThreads
-	barrier := NewBarrier(numThreads + 1)
-
-	for i := 0; i < numThreads; i++ {
-		start := bounds.Min.Y + i*sliceHeight
-		end := start + sliceHeight
-		if i == numThreads-1 {
-			end = bounds.Max.Y
-		}
-		go func(startY, endY int) {
-
-			for y := startY; y < endY; y++ {
-				for x := bounds.Min.X; x < bounds.Max.X; x++ {
-					r, g, b, a := img.In.At(x, y).RGBA()
-					grey := clamp(float64(r+g+b) / 3)
-					img.Out.Set(x, y, color.RGBA64{grey, grey, grey, uint16(a)})
-				}
-			}
-			barrier.Wait()
-		}(start, end)
-	}
-	barrier.Wait()
+	img.BSPGrayscaleWith(GrayAverage, numThreads)
 }
@@ -0,0 +1,204 @@
+// Package png allows for loading png images and applying image flitering effects on them
+// Histogram equalization of the whole image and contrast-limited adaptive histogram equalization (CLAHE)
+// https://en.wikipedia.org/wiki/Adaptive_histogram_equalization
+// K. Zuiderveld, "Contrast Limited Adaptive Histogram Equalization", Graphics Gems IV, 1994
+package png
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// histBins is the number of luma bins of the equalization histograms, each 256 values wide;
+// the curves interpolate within a bin, so 16-bit images keep their smooth gradients
+const histBins = 256
+
+// CLAHE equalizes the luma histogram within each tile of a Tiles x Tiles grid, and blends the curves of the
+// four nearest tiles bilinearly so that the tile edges do not show
+// Clip limits every histogram bin to Clip times the average bin count before equalizing, which keeps
+// the noise of flat areas from being amplified; 0 leaves the histograms unclipped
+type CLAHE struct {
+	Tiles int
+	Clip  float64
+}
+
+// tileCurve is the cumulative histogram of a tile, normalized to 1: entry b counts the values below bin b
+type tileCurve [histBins + 1]float64
+
+// newTileCurve clips a tile histogram, spreads the clipped counts evenly over all bins and accumulates it
+func newTileCurve(hist []int32, clip float64) *tileCurve {
+	var h [histBins]float64
+	var total float64
+	for b, n := range hist {
+		h[b] = float64(n)
+		total += h[b]
+	}
+	c := &tileCurve{}
+	if total == 0 {
+		// a tile of transparent pixels keeps its values
+		for b := range c {
+			c[b] = float64(b) / histBins
+		}
+		return c
+	}
+	if clip > 0 {
+		limit := math.Max(clip*total/histBins, 1)
+		var excess float64
+		for b := range h {
+			if h[b] > limit {
+				excess += h[b] - limit
+				h[b] = limit
+			}
+		}
+		for b := range h {
+			h[b] += excess / histBins
+		}
+	}
+	for b := range h {
+		c[b+1] = c[b] + h[b]/total
+	}
+	return c
+}
+
+// at maps a 16-bit value to its equalized value from 0 to 1, at the center of its position within the bin
+func (c *tileCurve) at(v uint32) float64 {
+	b := v >> 8
+	frac := (float64(v&0xff) + 0.5) / 256
+	return c[b] + frac*(c[b+1]-c[b])
+}
+
+// tileWeights returns the two tiles whose centers surround pos along an axis of size pixels split into tiles,
+// and the weight of the second one; beyond the outermost centers a single tile is used
+func tileWeights(pos, size, tiles int) (t0, t1 int, w float64) {
+	f := (float64(pos)+0.5)*float64(tiles)/float64(size) - 0.5
+	t0 = int(math.Floor(f))
+	w = f - float64(t0)
+	if t0 < 0 {
+		t0, w = 0, 0
+	}
+	if t0 >= tiles-1 {
+		t0, w = tiles-1, 0
+	}
+	t1 = t0 + 1
+	if t1 > tiles-1 {
+		t1 = tiles - 1
+	}
+	return t0, t1, w
+}
+
+// Equalize spreads the luma histogram of the whole image evenly over the full range
+func (img *Image) Equalize() {
+	img.BSPEqualize(1)
+}
+
+// BSPEqualize parallelly spreads the luma histogram of the whole image evenly over the full range
+func (img *Image) BSPEqualize(numThreads int) {
+	img.BSPCLAHE(CLAHE{Tiles: 1}, numThreads)
+}
+
+// CLAHE applies a contrast-limited adaptive histogram equalization
+func (img *Image) CLAHE(c CLAHE) {
+	img.BSPCLAHE(c, 1)
+}
+
+// BSPCLAHE parallelly applies a contrast-limited adaptive histogram equalization in two supersteps:
+// a reduction, where every slice counts its rows into partial histograms of all tiles and the main thread
+// merges them and builds the curves, and a parallel remap of every pixel through the curves of its tiles
+// The curves come from the luma of the straight colors and are applied to every channel, which keeps grays gray
+func (img *Image) BSPCLAHE(c CLAHE, numThreads int) {
+	img.applyRows(&claheEffect{rowImage: img.rowImage(), c: c}, numThreads)
+}
+
+// claheEffect is the effect of the equalizations, whose curves Prepare builds from the whole image
+type claheEffect struct {
+	rowImage
+	c              CLAHE
+	tilesX, tilesY int
+	curves         []*tileCurve
+}
+
+func (e *claheEffect) Info() EffectInfo { return EffectInfo{Halo: WholeImage, KeepsAlpha: true} }
+
+// Prepare builds the curves of the tiles with a reduction superstep
+func (e *claheEffect) Prepare(in *image.RGBA64, numThreads int) {
+	if numThreads < 1 {
+		numThreads = 1
+	}
+	img := e.view(in, nil)
+	bounds := img.Bounds
+	width, height := bounds.Dx(), bounds.Dy()
+	if width == 0 || height == 0 {
+		return
+	}
+	// every tile holds at least one column and one row
+	tilesX, tilesY := e.c.Tiles, e.c.Tiles
+	if tilesX > width {
+		tilesX = width
+	}
+	if tilesY > height {
+		tilesY = height
+	}
+
+	// the histograms of all tiles, one after the other
+	hist := make([]int32, tilesX*tilesY*histBins)
+	partials := make([][]int32, numThreads)
+	bspReduce(bounds, numThreads, func(slice, startY, endY int) {
+		h := make([]int32, len(hist))
+		for y := startY; y < endY; y++ {
+			row := (y - bounds.Min.Y) * tilesY / height * tilesX
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				p := img.In.RGBA64At(x, y)
+				if p.A == 0 {
+					continue // transparent pixels have no color to count
+				}
+				tile := row + (x-bounds.Min.X)*tilesX/width
+				h[tile*histBins+int(straightLuma(p)>>8)]++
+			}
+		}
+		partials[slice] = h
+	}, func(slice int) {
+		for i, n := range partials[slice] {
+			hist[i] += n
+		}
+	})
+
+	e.tilesX, e.tilesY = tilesX, tilesY
+	e.curves = make([]*tileCurve, tilesX*tilesY)
+	for t := range e.curves {
+		e.curves[t] = newTileCurve(hist[t*histBins:(t+1)*histBins], e.c.Clip)
+	}
+}
+
+// Apply remaps rows of in through the curves into out
+func (e *claheEffect) Apply(in, out *image.RGBA64, rows Rows) {
+	bounds := e.bounds
+	width, height := bounds.Dx(), bounds.Dy()
+	tilesX, curves := e.tilesX, e.curves
+	for y := rows.Min; y < rows.Max; y++ {
+		ty0, ty1, wy := tileWeights(y-bounds.Min.Y, height, e.tilesY)
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			p := in.RGBA64At(x, y)
+			if p.A == 0 {
+				out.SetRGBA64(x, y, p)
+				continue
+			}
+			tx0, tx1, wx := tileWeights(x-bounds.Min.X, width, tilesX)
+			c00, c01 := curves[ty0*tilesX+tx0], curves[ty0*tilesX+tx1]
+			c10, c11 := curves[ty1*tilesX+tx0], curves[ty1*tilesX+tx1]
+			remap := func(v uint16) uint16 {
+				s := unpremultiply(uint32(v), uint32(p.A))
+				m := (1-wy)*((1-wx)*c00.at(s)+wx*c01.at(s)) + wy*((1-wx)*c10.at(s)+wx*c11.at(s))
+				return uint16(uint32(clamp(math.Round(m*65535))) * uint32(p.A) / 0xffff)
+			}
+			out.SetRGBA64(x, y, color.RGBA64{remap(p.R), remap(p.G), remap(p.B), p.A})
+		}
+	}
+}
+
+// straightLuma returns the Rec. 709 luma of the straight color of a premultiplied pixel
+func straightLuma(p color.RGBA64) uint32 {
+	a := uint32(p.A)
+	r, g, b := unpremultiply(uint32(p.R), a), unpremultiply(uint32(p.G), a), unpremultiply(uint32(p.B), a)
+	return uint32(clamp(math.Round(lumaR*float64(r) + lumaG*float64(g) + lumaB*float64(b))))
+}
@@ -0,0 +1,764 @@
+// Package png allows for loading png images and applying image flitering effects on them
+// Per-pixel expressions: ExprEffect runs a small program such as "r = 1 - r; g = clamp(g*1.2)" on every pixel
+// The program is tokenized, parsed into a syntax tree, type checked and compiled into Go closures once per task,
+// and the closures run inside the slice loops of the supersteps
+package png
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// The variables every program starts with, in the slots of exprEnv.vars
+// r, g, b and a are the straight color of the pixel from 0 to 1 and may be assigned; the others are read-only
+var exprVars = []string{"r", "g", "b", "a", "x", "y", "width", "height"}
+
+const (
+	slotA        = 3
+	slotX        = 4
+	slotY        = 5
+	slotWidth    = 6
+	slotHeight   = 7
+	exprReadOnly = slotX // the first read-only slot
+)
+
+// exprType is the type of an expression: a number or the truth value of a comparison
+type exprType int
+
+const (
+	numType exprType = iota
+	boolType
+)
+
+func (t exprType) String() string {
+	if t == boolType {
+		return "condition"
+	}
+	return "number"
+}
+
+// exprNode is a node of the syntax tree
+type exprNode struct {
+	op   string // "num", "var", "call", "?:", or the unary or binary operator
+	pos  int    // byte offset in the source, for errors
+	num  float64
+	name string // of a variable or function
+	args []*exprNode
+	typ  exprType // set by the type checker
+	slot int      // slot of a variable, set by the type checker
+}
+
+// exprStmt is one assignment of a program
+type exprStmt struct {
+	pos   int
+	name  string
+	value *exprNode
+	slot  int
+}
+
+// Expression is a compiled per-pixel program
+type Expression struct {
+	stmts  []exprStmt
+	code   []func(env *exprEnv) float64 // the compiled values of stmts
+	slots  []int                        // the slots they assign
+	nslots int
+	halo   int // the farthest neighbor sample, or WholeImage when an offset is not constant
+	reads  bool
+}
+
+// exprEnv is the state of a program while it runs on one pixel; every slice has its own
+type exprEnv struct {
+	vars   []float64
+	in     *image.RGBA64
+	bounds image.Rectangle
+	x, y   int // the pixel, in image coordinates
+}
+
+// CompileExpression parses, type checks and compiles the program of an ExprEffect
+func CompileExpression(source string) (*Expression, error) {
+	p := &exprParser{src: source}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	e := &Expression{}
+	for p.tok.kind != tokEOF {
+		if p.tok.is(";") {
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		stmt, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		e.stmts = append(e.stmts, stmt)
+	}
+	if len(e.stmts) == 0 {
+		return nil, fmt.Errorf("expr: the expression assigns nothing")
+	}
+	if err := e.check(); err != nil {
+		return nil, err
+	}
+	for _, stmt := range e.stmts {
+		e.code = append(e.code, compileNum(stmt.value))
+		e.slots = append(e.slots, stmt.slot)
+	}
+	return e, nil
+}
+
+//
+// Tokens
+//
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNum
+	tokIdent
+	tokOp
+)
+
+type exprToken struct {
+	kind tokenKind
+	text string
+	num  float64
+	pos  int
+}
+
+func (t exprToken) is(op string) bool {
+	return t.kind == tokOp && t.text == op
+}
+
+func (t exprToken) String() string {
+	if t.kind == tokEOF {
+		return "end of expression"
+	}
+	return strconv.Quote(t.text)
+}
+
+// exprOps lists the operators, two-character ones first so that they win over their prefixes
+var exprOps = []string{"==", "!=", "<=", ">=", "&&", "||",
+	"+", "-", "*", "/", "%", "^", "(", ")", ",", ";", "=", "<", ">", "!", "?", ":"}
+
+// exprError reports an error at a byte offset of the source
+func exprError(pos int, format string, args ...interface{}) error {
+	return fmt.Errorf("expr: column %d: %s", pos+1, fmt.Sprintf(format, args...))
+}
+
+// exprParser is a recursive-descent parser with one token of lookahead
+type exprParser struct {
+	src string
+	off int
+	tok exprToken
+}
+
+// next reads the next token into p.tok
+func (p *exprParser) next() error {
+	for p.off < len(p.src) && strings.ContainsRune(" \t\r\n", rune(p.src[p.off])) {
+		p.off++
+	}
+	start := p.off
+	if p.off == len(p.src) {
+		p.tok = exprToken{kind: tokEOF, pos: start}
+		return nil
+	}
+	c := p.src[p.off]
+	switch {
+	case c >= '0' && c <= '9' || c == '.':
+		for p.off < len(p.src) && isNumberByte(p.src[p.off]) {
+			// an exponent may have a sign
+			if (p.src[p.off] == 'e' || p.src[p.off] == 'E') && p.off+1 < len(p.src) && strings.ContainsRune("+-", rune(p.src[p.off+1])) {
+				p.off++
+			}
+			p.off++
+		}
+		text := p.src[start:p.off]
+		v, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return exprError(start, "invalid number %q", text)
+		}
+		p.tok = exprToken{kind: tokNum, text: text, num: v, pos: start}
+	case isIdentByte(c):
+		for p.off < len(p.src) && isIdentByte(p.src[p.off]) {
+			p.off++
+		}
+		p.tok = exprToken{kind: tokIdent, text: p.src[start:p.off], pos: start}
+	default:
+		for _, op := range exprOps {
+			if strings.HasPrefix(p.src[p.off:], op) {
+				p.off += len(op)
+				p.tok = exprToken{kind: tokOp, text: op, pos: start}
+				return nil
+			}
+		}
+		return exprError(start, "unexpected character %q", c)
+	}
+	return nil
+}
+
+func isNumberByte(c byte) bool {
+	return c >= '0' && c <= '9' || c == '.' || c == 'e' || c == 'E'
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// expect consumes the operator op
+func (p *exprParser) expect(op string) error {
+	if !p.tok.is(op) {
+		return exprError(p.tok.pos, "expected %q, found %s", op, p.tok)
+	}
+	return p.next()
+}
+
+//
+// Syntax
+//
+// program    = [statement] { ";" [statement] }
+// statement  = identifier "=" expression
+// expression = or [ "?" expression ":" expression ]
+// or         = and { "||" and }
+// and        = comparison { "&&" comparison }
+// comparison = sum [ ("==" | "!=" | "<" | "<=" | ">" | ">=") sum ]
+// sum        = product { ("+" | "-") product }
+// product    = unary { ("*" | "/" | "%") unary }
+// unary      = ("-" | "+" | "!") unary | power
+// power      = primary [ "^" unary ]
+// primary    = number | identifier | identifier "(" [ expression { "," expression } ] ")" | "(" expression ")"
+//
+
+func (p *exprParser) statement() (exprStmt, error) {
+	if p.tok.kind != tokIdent {
+		return exprStmt{}, exprError(p.tok.pos, "expected an assignment, found %s", p.tok)
+	}
+	stmt := exprStmt{pos: p.tok.pos, name: p.tok.text}
+	if err := p.next(); err != nil {
+		return stmt, err
+	}
+	if err := p.expect("="); err != nil {
+		return stmt, err
+	}
+	value, err := p.expression()
+	if err != nil {
+		return stmt, err
+	}
+	stmt.value = value
+	if !p.tok.is(";") && p.tok.kind != tokEOF {
+		return stmt, exprError(p.tok.pos, "expected \";\", found %s", p.tok)
+	}
+	return stmt, nil
+}
+
+func (p *exprParser) expression() (*exprNode, error) {
+	cond, err := p.binary(0)
+	if err != nil || !p.tok.is("?") {
+		return cond, err
+	}
+	n := &exprNode{op: "?:", pos: p.tok.pos}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	then, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	els, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	n.args = []*exprNode{cond, then, els}
+	return n, nil
+}
+
+// exprLevels are the binary operators by increasing precedence
+var exprLevels = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+// binary parses the operators of exprLevels[level] and above; comparisons do not chain
+func (p *exprParser) binary(level int) (*exprNode, error) {
+	if level == len(exprLevels) {
+		return p.unary()
+	}
+	x, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := ""
+		for _, o := range exprLevels[level] {
+			if p.tok.is(o) {
+				op = o
+			}
+		}
+		if op == "" {
+			return x, nil
+		}
+		n := &exprNode{op: op, pos: p.tok.pos}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		y, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		n.args = []*exprNode{x, y}
+		x = n
+		if level == 2 {
+			return x, nil
+		}
+	}
+}
+
+func (p *exprParser) unary() (*exprNode, error) {
+	if p.tok.is("-") || p.tok.is("+") || p.tok.is("!") {
+		n := &exprNode{op: p.tok.text, pos: p.tok.pos}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		n.args = []*exprNode{x}
+		return n, nil
+	}
+	x, err := p.primary()
+	if err != nil || !p.tok.is("^") {
+		return x, err
+	}
+	n := &exprNode{op: "^", pos: p.tok.pos}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	// right-associative, and it binds tighter than a unary minus on its left: -2^2 is -4
+	y, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	n.args = []*exprNode{x, y}
+	return n, nil
+}
+
+func (p *exprParser) primary() (*exprNode, error) {
+	t := p.tok
+	switch {
+	case t.kind == tokNum:
+		return &exprNode{op: "num", pos: t.pos, num: t.num}, p.next()
+	case t.kind == tokIdent:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if !p.tok.is("(") {
+			return &exprNode{op: "var", pos: t.pos, name: t.text}, nil
+		}
+		n := &exprNode{op: "call", pos: t.pos, name: t.text}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		for !p.tok.is(")") {
+			if len(n.args) > 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			arg, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			n.args = append(n.args, arg)
+		}
+		return n, p.next()
+	case t.is("("):
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		x, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		return x, p.expect(")")
+	}
+	return nil, exprError(t.pos, "unexpected %s", t)
+}
+
+//
+// Types
+//
+
+// Functions of one, two and three numbers
+var (
+	exprFuncs1 = map[string]func(float64) float64{
+		"abs": math.Abs, "sqrt": math.Sqrt, "exp": math.Exp, "log": math.Log,
+		"sin": math.Sin, "cos": math.Cos, "tan": math.Tan,
+		"floor": math.Floor, "ceil": math.Ceil, "round": math.Round,
+		"clamp": func(v float64) float64 { return math.Max(0, math.Min(1, v)) },
+	}
+	exprFuncs2 = map[string]func(float64, float64) float64{
+		"min": math.Min, "max": math.Max, "pow": math.Pow, "atan2": math.Atan2,
+		"step": func(edge, v float64) float64 {
+			if v < edge {
+				return 0
+			}
+			return 1
+		},
+	}
+	exprFuncs3 = map[string]func(float64, float64, float64) float64{
+		"clamp": func(v, lo, hi float64) float64 { return math.Max(lo, math.Min(hi, v)) },
+		"mix":   func(x, y, t float64) float64 { return x + (y-x)*t },
+		"smoothstep": func(e0, e1, v float64) float64 {
+			t := math.Max(0, math.Min(1, (v-e0)/(e1-e0)))
+			return t * t * (3 - 2*t)
+		},
+	}
+)
+
+// exprSamples are the functions that sample a neighbor of the pixel at an offset, like r(-1, 0)
+var exprSamples = map[string]int{"r": 0, "g": 1, "b": 2, "a": slotA}
+
+// check resolves the variables of a program and checks the types of its expressions
+// Variables other than the built-in ones must be assigned before they are read
+func (e *Expression) check() error {
+	slots := map[string]int{}
+	for i, name := range exprVars {
+		slots[name] = i
+	}
+	for i := range e.stmts {
+		stmt := &e.stmts[i]
+		if err := e.checkNode(stmt.value, slots); err != nil {
+			return err
+		}
+		if stmt.value.typ != numType {
+			return exprError(stmt.value.pos, "%s is assigned a %s, not a number", stmt.name, stmt.value.typ)
+		}
+		slot, ok := slots[stmt.name]
+		if !ok {
+			slot = len(slots)
+			slots[stmt.name] = slot
+		}
+		if slot >= exprReadOnly && slot < len(exprVars) {
+			return exprError(stmt.pos, "%s cannot be assigned", stmt.name)
+		}
+		stmt.slot = slot
+	}
+	e.nslots = len(slots)
+	return nil
+}
+
+// checkNode sets the type of a node and the slots of its variables
+func (e *Expression) checkNode(n *exprNode, slots map[string]int) error {
+	for _, arg := range n.args {
+		if err := e.checkNode(arg, slots); err != nil {
+			return err
+		}
+	}
+	want := func(t exprType, args ...*exprNode) error {
+		for _, arg := range args {
+			if arg.typ != t {
+				return exprError(arg.pos, "%s needs a %s, not a %s", describeOp(n), t, arg.typ)
+			}
+		}
+		return nil
+	}
+	switch n.op {
+	case "num":
+		n.typ = numType
+	case "var":
+		slot, ok := slots[n.name]
+		if !ok {
+			return exprError(n.pos, "unknown variable %s", n.name)
+		}
+		n.typ, n.slot = numType, slot
+	case "call":
+		n.typ = numType
+		if _, ok := exprSamples[n.name]; ok && len(n.args) == 2 {
+			e.noteSample(n.args[0], n.args[1])
+			return want(numType, n.args...)
+		}
+		_, ok1 := exprFuncs1[n.name]
+		_, ok2 := exprFuncs2[n.name]
+		_, ok3 := exprFuncs3[n.name]
+		switch {
+		case !ok1 && !ok2 && !ok3:
+			if _, ok := exprSamples[n.name]; ok {
+				return exprError(n.pos, "%s() samples a neighbor and needs two offsets", n.name)
+			}
+			return exprError(n.pos, "unknown function %s", n.name)
+		case len(n.args) == 1 && ok1, len(n.args) == 2 && ok2, len(n.args) == 3 && ok3:
+			return want(numType, n.args...)
+		}
+		return exprError(n.pos, "%s() does not take %d arguments", n.name, len(n.args))
+	case "?:":
+		if err := want(boolType, n.args[0]); err != nil {
+			return err
+		}
+		if n.args[1].typ != n.args[2].typ {
+			return exprError(n.pos, "the branches of ?: are a %s and a %s", n.args[1].typ, n.args[2].typ)
+		}
+		n.typ = n.args[1].typ
+	case "!", "&&", "||":
+		n.typ = boolType
+		return want(boolType, n.args...)
+	case "==", "!=", "<", "<=", ">", ">=":
+		n.typ = boolType
+		return want(numType, n.args...)
+	default:
+		n.typ = numType
+		return want(numType, n.args...)
+	}
+	return nil
+}
+
+// describeOp names a node in type errors
+func describeOp(n *exprNode) string {
+	switch n.op {
+	case "call":
+		return n.name + "()"
+	case "?:":
+		return "the condition of ?:"
+	}
+	return "operator " + n.op
+}
+
+// noteSample widens the halo of the program to a neighbor sample; offsets that are not constant may reach anywhere
+func (e *Expression) noteSample(dx, dy *exprNode) {
+	e.reads = true
+	if e.halo == WholeImage {
+		return
+	}
+	for _, off := range []*exprNode{dx, dy} {
+		v, ok := constantValue(off)
+		if !ok {
+			e.halo = WholeImage
+			return
+		}
+		if d := int(math.Abs(math.Round(v))); d > e.halo {
+			e.halo = d
+		}
+	}
+}
+
+// constantValue returns the value of a number, possibly signed
+func constantValue(n *exprNode) (float64, bool) {
+	switch n.op {
+	case "num":
+		return n.num, true
+	case "-", "+":
+		if len(n.args) == 1 {
+			v, ok := constantValue(n.args[0])
+			if n.op == "-" {
+				v = -v
+			}
+			return v, ok
+		}
+	}
+	return 0, false
+}
+
+//
+// Compilation
+//
+
+// compileNum compiles a checked number expression into a closure
+func compileNum(n *exprNode) func(env *exprEnv) float64 {
+	switch n.op {
+	case "num":
+		v := n.num
+		return func(env *exprEnv) float64 { return v }
+	case "var":
+		slot := n.slot
+		return func(env *exprEnv) float64 { return env.vars[slot] }
+	case "?:":
+		cond, then, els := compileBool(n.args[0]), compileNum(n.args[1]), compileNum(n.args[2])
+		return func(env *exprEnv) float64 {
+			if cond(env) {
+				return then(env)
+			}
+			return els(env)
+		}
+	case "call":
+		return compileCall(n)
+	}
+	if len(n.args) == 1 {
+		x := compileNum(n.args[0])
+		if n.op == "+" {
+			return x
+		}
+		return func(env *exprEnv) float64 { return -x(env) }
+	}
+	x, y := compileNum(n.args[0]), compileNum(n.args[1])
+	switch n.op {
+	case "+":
+		return func(env *exprEnv) float64 { return x(env) + y(env) }
+	case "-":
+		return func(env *exprEnv) float64 { return x(env) - y(env) }
+	case "*":
+		return func(env *exprEnv) float64 { return x(env) * y(env) }
+	case "/":
+		return func(env *exprEnv) float64 { return x(env) / y(env) }
+	case "%":
+		return func(env *exprEnv) float64 { return math.Mod(x(env), y(env)) }
+	}
+	return func(env *exprEnv) float64 { return math.Pow(x(env), y(env)) }
+}
+
+// compileCall compiles a function call or a neighbor sample
+func compileCall(n *exprNode) func(env *exprEnv) float64 {
+	args := make([]func(env *exprEnv) float64, len(n.args))
+	for i, arg := range n.args {
+		args[i] = compileNum(arg)
+	}
+	if channel, ok := exprSamples[n.name]; ok && len(args) == 2 {
+		dx, dy := args[0], args[1]
+		return func(env *exprEnv) float64 {
+			return env.sample(int(math.Round(dx(env))), int(math.Round(dy(env))), channel)
+		}
+	}
+	switch len(args) {
+	case 1:
+		f, x := exprFuncs1[n.name], args[0]
+		return func(env *exprEnv) float64 { return f(x(env)) }
+	case 2:
+		f, x, y := exprFuncs2[n.name], args[0], args[1]
+		return func(env *exprEnv) float64 { return f(x(env), y(env)) }
+	}
+	f, x, y, z := exprFuncs3[n.name], args[0], args[1], args[2]
+	return func(env *exprEnv) float64 { return f(x(env), y(env), z(env)) }
+}
+
+// compileBool compiles a checked condition into a closure
+func compileBool(n *exprNode) func(env *exprEnv) bool {
+	if n.op == "?:" {
+		cond, then, els := compileBool(n.args[0]), compileBool(n.args[1]), compileBool(n.args[2])
+		return func(env *exprEnv) bool {
+			if cond(env) {
+				return then(env)
+			}
+			return els(env)
+		}
+	}
+	if n.op == "!" {
+		x := compileBool(n.args[0])
+		return func(env *exprEnv) bool { return !x(env) }
+	}
+	if n.op == "&&" || n.op == "||" {
+		x, y := compileBool(n.args[0]), compileBool(n.args[1])
+		if n.op == "&&" {
+			return func(env *exprEnv) bool { return x(env) && y(env) }
+		}
+		return func(env *exprEnv) bool { return x(env) || y(env) }
+	}
+	x, y := compileNum(n.args[0]), compileNum(n.args[1])
+	switch n.op {
+	case "==":
+		return func(env *exprEnv) bool { return x(env) == y(env) }
+	case "!=":
+		return func(env *exprEnv) bool { return x(env) != y(env) }
+	case "<":
+		return func(env *exprEnv) bool { return x(env) < y(env) }
+	case "<=":
+		return func(env *exprEnv) bool { return x(env) <= y(env) }
+	case ">":
+		return func(env *exprEnv) bool { return x(env) > y(env) }
+	}
+	return func(env *exprEnv) bool { return x(env) >= y(env) }
+}
+
+//
+// Evaluation
+//
+
+// sample returns a channel of the straight color of the neighbor at (dx, dy), from 0 to 1
+// Neighbors outside the image are clamped to its borders
+func (env *exprEnv) sample(dx, dy, channel int) float64 {
+	b := env.bounds
+	x := b.Min.X + BorderClamp.index(env.x+dx-b.Min.X, b.Dx())
+	y := b.Min.Y + BorderClamp.index(env.y+dy-b.Min.Y, b.Dy())
+	c := env.in.RGBA64At(x, y)
+	a := uint32(c.A)
+	switch channel {
+	case 0:
+		return float64(unpremultiply(uint32(c.R), a)) / 0xffff
+	case 1:
+		return float64(unpremultiply(uint32(c.G), a)) / 0xffff
+	case 2:
+		return float64(unpremultiply(uint32(c.B), a)) / 0xffff
+	}
+	return float64(a) / 0xffff
+}
+
+// unitChannel turns a value from 0 to 1 into a channel value; values outside [0, 1] are clamped and NaN is 0
+func unitChannel(v float64) uint32 {
+	if !(v > 0) {
+		return 0
+	}
+	if v >= 1 {
+		return 0xffff
+	}
+	return uint32(math.Round(v * 0xffff))
+}
+
+// Expression runs a compiled expression on every pixel
+func (img *Image) Expression(e *Expression) {
+	img.applyRows(exprEffect{e, img.Bounds}, 1)
+}
+
+// BSPExpression parallelly runs a compiled expression on every pixel, in a single superstep
+// Every slice evaluates its rows with variables of its own, so the compiled program is shared read-only
+func (img *Image) BSPExpression(e *Expression, numThreads int) {
+	img.applyRows(exprEffect{e, img.Bounds}, numThreads)
+}
+
+// exprEffect is the effect of a compiled expression on an image of the given bounds
+type exprEffect struct {
+	prog   *Expression
+	bounds image.Rectangle
+}
+
+func (e exprEffect) Info() EffectInfo {
+	return EffectInfo{Halo: e.prog.halo, Pointwise: !e.prog.reads}
+}
+
+func (e exprEffect) Bounds(in image.Rectangle) image.Rectangle { return in }
+
+// Apply runs the program on the pixels of rows of in
+func (e exprEffect) Apply(in, out *image.RGBA64, rows Rows) {
+	bounds := e.bounds
+	env := &exprEnv{vars: make([]float64, e.prog.nslots), in: in, bounds: bounds}
+	vars := env.vars
+	vars[slotWidth], vars[slotHeight] = float64(bounds.Dx()), float64(bounds.Dy())
+	for y := rows.Min; y < rows.Max; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := in.RGBA64At(x, y)
+			a := uint32(c.A)
+			vars[0] = float64(unpremultiply(uint32(c.R), a)) / 0xffff
+			vars[1] = float64(unpremultiply(uint32(c.G), a)) / 0xffff
+			vars[2] = float64(unpremultiply(uint32(c.B), a)) / 0xffff
+			vars[slotA] = float64(a) / 0xffff
+			vars[slotX], vars[slotY] = float64(x-bounds.Min.X), float64(y-bounds.Min.Y)
+			env.x, env.y = x, y
+			for i, code := range e.prog.code {
+				vars[e.prog.slots[i]] = code(env)
+			}
+			na := unitChannel(vars[slotA])
+			r := unitChannel(vars[0]) * na / 0xffff
+			g := unitChannel(vars[1]) * na / 0xffff
+			b := unitChannel(vars[2]) * na / 0xffff
+			out.SetRGBA64(x, y, color.RGBA64{uint16(r), uint16(g), uint16(b), uint16(na)})
+		}
+	}
+}
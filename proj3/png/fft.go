@@ -0,0 +1,231 @@
+// Package png allows for loading png images and applying image flitering effects on them
+// Fast Fourier transform and FFT convolution for kernels too large for the direct path
+// https://en.wikipedia.org/wiki/Cooley%E2%80%93Tukey_FFT_algorithm
+// https://en.wikipedia.org/wiki/Convolution_theorem
+package png
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/cmplx"
+)
+
+// fftPlan holds what the transforms of one size share: the size split into factors and the twiddle factors
+type fftPlan struct {
+	n       int
+	factors []int
+	twiddle []complex128 // exp(-2 pi i j / n)
+}
+
+// newFFTPlan factors n into radices, the small primes first
+func newFFTPlan(n int) *fftPlan {
+	p := &fftPlan{n: n, twiddle: make([]complex128, n)}
+	for j := range p.twiddle {
+		p.twiddle[j] = cmplx.Rect(1, -2*math.Pi*float64(j)/float64(n))
+	}
+	for _, radix := range []int{2, 3, 5, 7} {
+		for n%radix == 0 {
+			p.factors = append(p.factors, radix)
+			n /= radix
+		}
+	}
+	// larger primes are left to a plain DFT of their size; fftSize never picks them
+	for f := 11; n > 1; f += 2 {
+		for n%f == 0 {
+			p.factors = append(p.factors, f)
+			n /= f
+		}
+	}
+	return p
+}
+
+// fftSize returns the smallest size from n on whose prime factors are all at most 7, which keeps the radices small
+func fftSize(n int) int {
+	for ; ; n++ {
+		m := n
+		for _, radix := range []int{2, 3, 5, 7} {
+			for m%radix == 0 {
+				m /= radix
+			}
+		}
+		if m == 1 {
+			return n
+		}
+	}
+}
+
+// forward replaces data by its discrete Fourier transform; scratch holds as many values as data
+func (p *fftPlan) forward(data, scratch []complex128) {
+	copy(scratch, data)
+	p.transform(data, scratch, p.n, 1, p.factors)
+}
+
+// inverse replaces data by its inverse transform, without the 1/n normalization
+func (p *fftPlan) inverse(data, scratch []complex128) {
+	for i, v := range data {
+		scratch[i] = cmplx.Conj(v)
+	}
+	p.transform(data, scratch, p.n, 1, p.factors)
+	for i, v := range data {
+		data[i] = cmplx.Conj(v)
+	}
+}
+
+// transform writes to out the transform of the n values in[0], in[stride], in[2 stride], ... (decimation in time):
+// the first factor p splits them into p interleaved sequences, whose transforms are combined by butterflies
+func (p *fftPlan) transform(out, in []complex128, n, stride int, factors []int) {
+	if n == 1 {
+		out[0] = in[0]
+		return
+	}
+	radix, m := factors[0], n/factors[0]
+	for r := 0; r < radix; r++ {
+		p.transform(out[r*m:(r+1)*m], in[r*stride:], m, stride*radix, factors[1:])
+	}
+
+	// twiddles of this level are those of the plan taken every step-th
+	step := p.n / n
+	if radix == 2 {
+		for k := 0; k < m; k++ {
+			a, b := out[k], out[k+m]*p.twiddle[k*step]
+			out[k], out[k+m] = a+b, a-b
+		}
+		return
+	}
+	var buf [7]complex128
+	tmp := buf[:]
+	if radix > len(buf) {
+		tmp = make([]complex128, radix)
+	}
+	tmp = tmp[:radix]
+	rootStep := p.n / radix // exp(-2 pi i / radix) is twiddle[rootStep]
+	for k := 0; k < m; k++ {
+		for r := range tmp {
+			tmp[r] = out[r*m+k] * p.twiddle[r*k*step]
+		}
+		for q := 0; q < radix; q++ {
+			var sum complex128
+			for r, v := range tmp {
+				sum += v * p.twiddle[(r*q%radix)*rootStep]
+			}
+			out[q*m+k] = sum
+		}
+	}
+}
+
+// fft2D transforms every width x height plane in two supersteps: every slice transforms its rows,
+// and after the barrier every band transforms its columns
+func fft2D(planes [][]complex128, width, height int, inverse bool, numThreads int) {
+	rowPlan, colPlan := newFFTPlan(width), newFFTPlan(height)
+	bspSlices(image.Rect(0, 0, width, height), numThreads, func(startY, endY int) {
+		scratch := make([]complex128, width)
+		for _, plane := range planes {
+			for y := startY; y < endY; y++ {
+				row := plane[y*width : (y+1)*width]
+				if inverse {
+					rowPlan.inverse(row, scratch)
+				} else {
+					rowPlan.forward(row, scratch)
+				}
+			}
+		}
+	})
+	// the columns are split among the workers like the rows
+	bspSlices(image.Rect(0, 0, 1, width), numThreads, func(startX, endX int) {
+		column, scratch := make([]complex128, height), make([]complex128, height)
+		for _, plane := range planes {
+			for x := startX; x < endX; x++ {
+				for y := range column {
+					column[y] = plane[y*width+x]
+				}
+				if inverse {
+					colPlan.inverse(column, scratch)
+				} else {
+					colPlan.forward(column, scratch)
+				}
+				for y, v := range column {
+					plane[y*width+x] = v
+				}
+			}
+		}
+	})
+}
+
+// fftConvolution applies the kernel through the convolution theorem, in O(log n) per pixel whatever its size
+// The input is extended by the halo of the kernel through its border mode (zero padding stays zero), and the
+// transforms are large enough that the circular convolution never wraps around, so the sums are those of
+// convolve up to rounding; red and green, and blue and alpha, share a complex plane since the kernel is real,
+// and a gray input needs a single plane of red and alpha
+func (img *Image) fftConvolution(kernel Kernel, numThreads int) {
+	bounds := img.Bounds
+	width, height := bounds.Dx(), bounds.Dy()
+	hx, hy := kernel.halo()
+	w, h := fftSize(width+2*hx), fftSize(height+2*hy)
+
+	// the kernel is flipped, so that the convolution with it is the correlation convolve computes
+	spectrum := make([]complex128, w*h)
+	for dy := -hy; dy <= hy; dy++ {
+		for dx := -hx; dx <= hx; dx++ {
+			spectrum[mod(-dy, h)*w+mod(-dx, w)] = complex(kernel.Values[(dy+hy)*kernel.Width+dx+hx], 0)
+		}
+	}
+	planes := [][]complex128{spectrum, make([]complex128, w*h)}
+	if !kernel.Gray {
+		planes = append(planes, make([]complex128, w*h))
+	}
+	weight := kernel.weight()
+	bspSlices(image.Rect(0, 0, width+2*hx, height+2*hy), numThreads, func(startY, endY int) {
+		for y := startY; y < endY; y++ {
+			ny := kernel.Border.index(y-hy, height)
+			for x := 0; x < width+2*hx; x++ {
+				nx := kernel.Border.index(x-hx, width)
+				if nx < 0 || ny < 0 {
+					continue
+				}
+				c := img.In.RGBA64At(bounds.Min.X+nx, bounds.Min.Y+ny)
+				r, g, b, a := uint32(c.R), uint32(c.G), uint32(c.B), uint32(c.A)
+				if kernel.Gray {
+					planes[1][y*w+x] = complex(float64(r), float64(a))
+					continue
+				}
+				planes[1][y*w+x] = complex(float64(r), float64(g))
+				planes[2][y*w+x] = complex(float64(b), float64(a))
+			}
+		}
+	})
+	fft2D(planes, w, h, false, numThreads)
+
+	// multiply by the spectrum of the kernel, normalizing the inverse transform on the way
+	scale := complex(1/float64(w*h), 0)
+	bspSlices(image.Rect(0, 0, w, h), numThreads, func(startY, endY int) {
+		for i := startY * w; i < endY*w; i++ {
+			k := spectrum[i] * scale
+			for _, plane := range planes[1:] {
+				plane[i] *= k
+			}
+		}
+	})
+	fft2D(planes[1:], w, h, true, numThreads)
+
+	img.bspRows(numThreads, func(startY, endY int) {
+		for y := startY; y < endY; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				if kernel.Border == BorderValid && !kernel.interior(x, y, bounds) {
+					img.Out.SetRGBA64(x, y, img.In.RGBA64At(x, y))
+					continue
+				}
+				i := (y-bounds.Min.Y+hy)*w + x - bounds.Min.X + hx
+				var r, g, b, a uint16
+				if kernel.Gray {
+					ra := planes[1][i]
+					r, g, b, a = img.convolved(x, y, kernel, weight, real(ra), real(ra), real(ra), imag(ra))
+				} else {
+					rg, ba := planes[1][i], planes[2][i]
+					r, g, b, a = img.convolved(x, y, kernel, weight, real(rg), imag(rg), real(ba), imag(ba))
+				}
+				img.Out.SetRGBA64(x, y, color.RGBA64{r, g, b, a})
+			}
+		}
+	})
+}
@@ -0,0 +1,149 @@
+package png
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"math/cmplx"
+	"testing"
+)
+
+func TestFFTSize(t *testing.T) {
+	for n, want := range map[int]int{1: 1, 11: 12, 13: 14, 17: 18, 22: 24, 97: 98, 121: 125, 143: 144} {
+		if got := fftSize(n); got != want {
+			t.Errorf("fftSize(%d) = %d, want %d", n, got, want)
+		}
+	}
+}
+
+func TestFFTMatchesDFT(t *testing.T) {
+	// powers of two, the radices 3, 5 and 7 alone and mixed, and a prime left to the plain DFT
+	for _, n := range []int{1, 2, 8, 3, 9, 5, 25, 7, 49, 12, 30, 42, 105, 210, 11, 13} {
+		data := make([]complex128, n)
+		for i := range data {
+			data[i] = complex(math.Sin(float64(i*i+1)), math.Cos(float64(3*i)))
+		}
+		want := make([]complex128, n)
+		for k := range want {
+			for j, v := range data {
+				want[k] += v * cmplx.Rect(1, -2*math.Pi*float64(j*k)/float64(n))
+			}
+		}
+		p := newFFTPlan(n)
+		got := append([]complex128(nil), data...)
+		scratch := make([]complex128, n)
+		p.forward(got, scratch)
+		for k := range want {
+			if cmplx.Abs(got[k]-want[k]) > 1e-9*float64(n) {
+				t.Fatalf("size %d: bin %d is %v, want %v", n, k, got[k], want[k])
+			}
+		}
+		p.inverse(got, scratch)
+		for j := range data {
+			if cmplx.Abs(got[j]/complex(float64(n), 0)-data[j]) > 1e-9 {
+				t.Fatalf("size %d: the round trip gives %v at %d, want %v", n, got[j], j, data[j])
+			}
+		}
+	}
+}
+
+// directConvolution convolves In into Out pixel by pixel, whatever the size of the kernel
+func directConvolution(img *Image, kernel Kernel) {
+	for y := img.Bounds.Min.Y; y < img.Bounds.Max.Y; y++ {
+		for x := img.Bounds.Min.X; x < img.Bounds.Max.X; x++ {
+			r, g, b, a := img.convolve(x, y, kernel, kernel.weight())
+			img.Out.SetRGBA64(x, y, color.RGBA64{r, g, b, a})
+		}
+	}
+}
+
+// closePixels reports the first pixel at which got is more than one unit away from want
+func closePixels(t *testing.T, name string, want, got *image.RGBA64) {
+	t.Helper()
+	for y := want.Rect.Min.Y; y < want.Rect.Max.Y; y++ {
+		for x := want.Rect.Min.X; x < want.Rect.Max.X; x++ {
+			w, g := want.RGBA64At(x, y), got.RGBA64At(x, y)
+			if diff(w.R, g.R) > 1 || diff(w.G, g.G) > 1 || diff(w.B, g.B) > 1 || diff(w.A, g.A) > 1 {
+				t.Errorf("%s: pixel (%d, %d) is %v, want %v", name, x, y, g, w)
+				return
+			}
+		}
+	}
+}
+
+func TestFFTConvolutionMatchesDirect(t *testing.T) {
+	kernels := map[string]Kernel{
+		"dense":    randomKernel(17, 17, 1),
+		"wide":     randomKernel(25, 11, 2),
+		"gaussian": gaussianKernel(8, 31),
+	}
+	// sizes whose padded transforms take the radices 3, 5 and 7
+	sizes := []image.Point{{21, 15}, {35, 27}, {13, 49}}
+	for name, kernel := range kernels {
+		for _, border := range testBorders {
+			kernel.Border = border
+			for _, size := range sizes {
+				base := testImage(size.X, size.Y, int64(size.X))
+				want := cloneImage(base)
+				directConvolution(want, kernel)
+				got := cloneImage(base)
+				got.fftConvolution(kernel, 1)
+				label := fmt.Sprintf("%s %s %dx%d", name, border, size.X, size.Y)
+				closePixels(t, label, want.Out, got.Out)
+				// the transforms of every row and column do not depend on the slices
+				bsp := cloneImage(base)
+				bsp.fftConvolution(kernel, 3)
+				samePixels(t, label+", 3 threads", got.Out, bsp.Out)
+			}
+		}
+	}
+}
+
+func TestFFTConvolutionGray(t *testing.T) {
+	base := testImage(23, 17, 5)
+	for y := 0; y < 17; y++ {
+		for x := 0; x < 23; x++ {
+			c := base.In.RGBA64At(x, y)
+			base.In.SetRGBA64(x, y, color.RGBA64{c.R, c.R, c.R, c.A})
+		}
+	}
+	kernel := randomKernel(19, 19, 3)
+	kernel.Gray = true
+	want := cloneImage(base)
+	directConvolution(want, kernel)
+	got := cloneImage(base)
+	got.fftConvolution(kernel, 2)
+	closePixels(t, "gray", want.Out, got.Out)
+}
+
+func TestFFTThresholds(t *testing.T) {
+	// the sizes around fftMinArea and fftMinTaps, with the path they must take
+	cases := []struct {
+		kernel Kernel
+		fft    bool
+	}{
+		{randomKernel(15, 15, 1), false},
+		{randomKernel(17, 13, 2), false},
+		{randomKernel(17, 15, 3), true},
+		{gaussianKernel(10, 30), false},
+		{gaussianKernel(10, 31), true},
+	}
+	for _, c := range cases {
+		k := c.kernel
+		if got := k.useFFT(); got != c.fft {
+			t.Errorf("useFFT() of a %dx%d kernel is %v, want %v", k.Width, k.Height, got, c.fft)
+		}
+		base := testImage(29, 21, int64(k.Width*k.Height))
+		want := cloneImage(base)
+		directConvolution(want, k)
+		got := cloneImage(base)
+		got.Convolution(k)
+		label := fmt.Sprintf("%dx%d kernel", k.Width, k.Height)
+		if _, _, separable := k.useSeparable(); c.fft || separable {
+			closePixels(t, label, want.Out, got.Out)
+		} else {
+			samePixels(t, label, want.Out, got.Out)
+		}
+	}
+}
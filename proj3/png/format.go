@@ -0,0 +1,114 @@
+// Package png allows for loading png images and applying image flitering effects on them
+// Despite its name the package reads and writes several image formats: the input format is
+// detected from the magic bytes of the file and the output format from the extension of the path
+package png
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// Supported image formats
+const (
+	FormatPNG    = "png"
+	FormatJPEG   = "jpeg"
+	FormatGIF    = "gif"
+	FormatNetpbm = "netpbm"
+	FormatBMP    = "bmp"
+	FormatQOI    = "qoi"
+)
+
+// sniffFormat identifies the image format from the first bytes of a file
+func sniffFormat(header []byte) (string, error) {
+	switch {
+	case bytes.HasPrefix(header, []byte(pngSignature)):
+		return FormatPNG, nil
+	case bytes.HasPrefix(header, []byte("\xff\xd8\xff")):
+		return FormatJPEG, nil
+	case bytes.HasPrefix(header, []byte("GIF87a")), bytes.HasPrefix(header, []byte("GIF89a")):
+		return FormatGIF, nil
+	case bytes.HasPrefix(header, []byte(qoiMagic)):
+		return FormatQOI, nil
+	case bytes.HasPrefix(header, []byte("BM")):
+		return FormatBMP, nil
+	case len(header) >= 2 && header[0] == 'P' && header[1] >= '1' && header[1] <= '7':
+		return FormatNetpbm, nil
+	}
+	return "", fmt.Errorf("png: unknown image format")
+}
+
+// formatFromPath picks the output format from the file extension; unknown extensions keep writing PNG
+func formatFromPath(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpg", ".jpeg":
+		return FormatJPEG
+	case ".gif":
+		return FormatGIF
+	case ".ppm", ".pgm", ".pbm", ".pnm", ".pam":
+		return FormatNetpbm
+	case ".bmp":
+		return FormatBMP
+	case ".qoi":
+		return FormatQOI
+	}
+	return FormatPNG
+}
+
+// decode reads an image in any of the supported formats
+func decode(r io.Reader) (image.Image, string, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(8)
+	if err != nil && err != io.EOF {
+		return nil, "", err
+	}
+	format, err := sniffFormat(header)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var img image.Image
+	switch format {
+	case FormatPNG:
+		img, err = png.Decode(br)
+	case FormatJPEG:
+		img, err = jpeg.Decode(br)
+	case FormatGIF:
+		img, err = gif.Decode(br)
+	case FormatNetpbm:
+		img, err = decodeNetpbm(br)
+	case FormatBMP:
+		img, err = decodeBMP(br)
+	case FormatQOI:
+		img, err = decodeQOI(br)
+	}
+	return img, format, err
+}
+
+// encode writes img in the format selected by the extension of path
+func (img *Image) encode(w io.Writer, path string, saveImg *image.RGBA64) error {
+	switch formatFromPath(path) {
+	case FormatJPEG:
+		quality := img.Quality
+		if quality == 0 {
+			quality = jpeg.DefaultQuality
+		}
+		return jpeg.Encode(w, saveImg, &jpeg.Options{Quality: quality})
+	case FormatGIF:
+		return gif.Encode(w, saveImg, nil)
+	case FormatNetpbm:
+		return encodeNetpbm(w, saveImg, strings.ToLower(filepath.Ext(path)), img.Depth)
+	case FormatBMP:
+		return encodeBMP(w, saveImg)
+	case FormatQOI:
+		return encodeQOI(w, saveImg)
+	}
+	return png.Encode(w, saveImg)
+}
@@ -0,0 +1,474 @@
+// Package png allows for loading png images and applying image flitering effects on them
+// Geometric effects: resize, rotation, flips and crop
+// They are the only effects whose output has other bounds than their input: they give Out the new
+// bounds (with its origin at (0, 0)) and SwapBuffers carries them over to the next effect
+// https://en.wikipedia.org/wiki/Image_scaling
+package png
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// ResampleMethod selects how the geometric effects interpolate between source pixels
+type ResampleMethod string
+
+const (
+	Nearest  ResampleMethod = "nearest"
+	Bilinear ResampleMethod = "bilinear"
+	Bicubic  ResampleMethod = "bicubic"  // Catmull-Rom spline
+	Lanczos3 ResampleMethod = "lanczos3" // windowed sinc over three lobes, resize only
+)
+
+// ParseResampleMethod validates a resampling method; the empty string selects Bilinear
+func ParseResampleMethod(s string) (ResampleMethod, error) {
+	switch m := ResampleMethod(s); m {
+	case "":
+		return Bilinear, nil
+	case Nearest, Bilinear, Bicubic, Lanczos3:
+		return m, nil
+	}
+	return "", fmt.Errorf("png: unknown resampling method %q", s)
+}
+
+// Resize describes a resize effect: Width and Height in pixels, where a missing one keeps the aspect ratio,
+// or Scale as a factor of both dimensions
+type Resize struct {
+	Width  int
+	Height int
+	Scale  float64
+	Method ResampleMethod
+}
+
+// size returns the output dimensions of an input of the given bounds, never less than one pixel
+func (r Resize) size(bounds image.Rectangle) (int, int) {
+	w, h := float64(bounds.Dx()), float64(bounds.Dy())
+	var width, height float64
+	switch {
+	case r.Width > 0 && r.Height > 0:
+		width, height = float64(r.Width), float64(r.Height)
+	case r.Width > 0:
+		width, height = float64(r.Width), h*float64(r.Width)/w
+	case r.Height > 0:
+		width, height = w*float64(r.Height)/h, float64(r.Height)
+	default:
+		width, height = w*r.Scale, h*r.Scale
+	}
+	return int(math.Max(1, math.Round(width))), int(math.Max(1, math.Round(height)))
+}
+
+// Flip axes
+const (
+	FlipHorizontal = "horizontal" // mirror left and right
+	FlipVertical   = "vertical"   // mirror top and bottom
+)
+
+// prepareOut gives Out the bounds of the result of a geometric effect
+func (img *Image) prepareOut(bounds image.Rectangle) {
+	if img.Out.Bounds() != bounds {
+		img.Out = image.NewRGBA64(bounds)
+	}
+}
+
+// finishResample turns interpolated premultiplied sums into a valid pixel: filters with negative lobes
+// (bicubic, Lanczos) overshoot, and a premultiplied color may not exceed its alpha
+func finishResample(r, g, b, a float64) color.RGBA64 {
+	alpha := clamp(math.Round(a))
+	return color.RGBA64{
+		minUint16(clamp(math.Round(r)), alpha), minUint16(clamp(math.Round(g)), alpha),
+		minUint16(clamp(math.Round(b)), alpha), alpha}
+}
+
+//
+// Resize
+//
+
+// resampleFilter is a reconstruction kernel and the distance beyond which it is 0
+type resampleFilter struct {
+	support float64
+	kernel  func(x float64) float64
+}
+
+var resampleFilters = map[ResampleMethod]resampleFilter{
+	Bilinear: {1, func(x float64) float64 {
+		return math.Max(0, 1-math.Abs(x))
+	}},
+	Bicubic: {2, cubic},
+	Lanczos3: {3, func(x float64) float64 {
+		if x == 0 {
+			return 1
+		}
+		if math.Abs(x) >= 3 {
+			return 0
+		}
+		px := math.Pi * x
+		return 3 * math.Sin(px) * math.Sin(px/3) / (px * px)
+	}},
+}
+
+// cubic is the Catmull-Rom spline (Keys' cubic with a = -0.5)
+func cubic(x float64) float64 {
+	x = math.Abs(x)
+	switch {
+	case x < 1:
+		return 1.5*x*x*x - 2.5*x*x + 1
+	case x < 2:
+		return -0.5*x*x*x + 2.5*x*x - 4*x + 2
+	}
+	return 0
+}
+
+// tap is the weight of one source pixel in an output pixel
+type tap struct {
+	index  int
+	weight float64
+}
+
+// resampleTaps returns the source pixels and weights of every output pixel along one axis
+// When shrinking, the filter is stretched over the source so that every source pixel contributes (no aliasing)
+// Taps beyond the edges are clamped to the edge pixels
+func resampleTaps(inSize, outSize int, f resampleFilter) [][]tap {
+	scale := float64(inSize) / float64(outSize)
+	stretch := math.Max(1, scale)
+	support := f.support * stretch
+	taps := make([][]tap, outSize)
+	for i := range taps {
+		center := (float64(i)+0.5)*scale - 0.5
+		lo, hi := int(math.Ceil(center-support)), int(math.Floor(center+support))
+		sum := 0.0
+		for j := lo; j <= hi; j++ {
+			w := f.kernel((float64(j) - center) / stretch)
+			if w == 0 {
+				continue
+			}
+			index := j
+			if index < 0 {
+				index = 0
+			} else if index >= inSize {
+				index = inSize - 1
+			}
+			taps[i] = append(taps[i], tap{index, w})
+			sum += w
+		}
+		for j := range taps[i] {
+			taps[i][j].weight /= sum
+		}
+	}
+	return taps
+}
+
+// Resize scales the image
+func (img *Image) Resize(r Resize) {
+	img.BSPResize(r, 1)
+}
+
+// BSPResize parallelly scales the image
+// Nearest neighbor is a single superstep; the filters run as a horizontal pass into an intermediate buffer
+// (one superstep over its rows, see Prepare) and a vertical pass (one superstep over the output rows)
+func (img *Image) BSPResize(r Resize, numThreads int) {
+	img.applyRows(newResizeEffect(r, img.Bounds), numThreads)
+}
+
+// resizeEffect is the effect of a resize of an image of bounds in
+type resizeEffect struct {
+	in            image.Rectangle
+	r             Resize
+	width, height int
+	xTaps, yTaps  [][]tap
+	tmp           []float64 // the horizontal pass over all rows of the input, once prepared
+}
+
+func newResizeEffect(r Resize, in image.Rectangle) *resizeEffect {
+	e := &resizeEffect{in: in, r: r}
+	e.width, e.height = r.size(in)
+	if r.Method != Nearest {
+		filter := resampleFilters[r.Method]
+		e.xTaps = resampleTaps(in.Dx(), e.width, filter)
+		e.yTaps = resampleTaps(in.Dy(), e.height, filter)
+	}
+	return e
+}
+
+func (e *resizeEffect) Info() EffectInfo { return EffectInfo{Halo: WholeImage} }
+
+func (e *resizeEffect) Bounds(in image.Rectangle) image.Rectangle {
+	return image.Rect(0, 0, e.width, e.height)
+}
+
+// Prepare runs the horizontal pass of the filters over every input row
+func (e *resizeEffect) Prepare(in *image.RGBA64, numThreads int) {
+	if e.r.Method == Nearest {
+		return
+	}
+	e.tmp = make([]float64, 4*e.width*e.in.Dy())
+	bspSlices(e.in, numThreads, func(startY, endY int) {
+		e.horizontalPass(in, e.tmp, 0, startY, endY)
+	})
+}
+
+// horizontalPass resamples rows [startY, endY) of in horizontally into tmp, four premultiplied channels of width
+// pixels per row, whose first row is row first of the input
+func (e *resizeEffect) horizontalPass(in *image.RGBA64, tmp []float64, first, startY, endY int) {
+	for y := startY; y < endY; y++ {
+		row := tmp[4*e.width*(y-e.in.Min.Y-first):]
+		for x, taps := range e.xTaps {
+			var sr, sg, sb, sa float64
+			for _, t := range taps {
+				c := in.RGBA64At(e.in.Min.X+t.index, y)
+				sr += float64(c.R) * t.weight
+				sg += float64(c.G) * t.weight
+				sb += float64(c.B) * t.weight
+				sa += float64(c.A) * t.weight
+			}
+			row[4*x], row[4*x+1], row[4*x+2], row[4*x+3] = sr, sg, sb, sa
+		}
+	}
+}
+
+// Apply resamples rows of the output; without Prepare the filters first resample the input rows they read
+func (e *resizeEffect) Apply(in, out *image.RGBA64, rows Rows) {
+	width, height := e.width, e.height
+	if rows.Min >= rows.Max {
+		return
+	}
+	if e.r.Method == Nearest {
+		for y := rows.Min; y < rows.Max; y++ {
+			sy := e.in.Min.Y + (2*y+1)*e.in.Dy()/(2*height)
+			for x := 0; x < width; x++ {
+				sx := e.in.Min.X + (2*x+1)*e.in.Dx()/(2*width)
+				out.SetRGBA64(x, y, in.RGBA64At(sx, sy))
+			}
+		}
+		return
+	}
+	tmp, first := e.tmp, 0
+	if tmp == nil {
+		// the taps of a row run from its first to its last source row
+		first, last := e.yTaps[rows.Min][0].index, 0
+		for _, taps := range e.yTaps[rows.Min:rows.Max] {
+			for _, t := range taps {
+				if t.index < first {
+					first = t.index
+				}
+				if t.index > last {
+					last = t.index
+				}
+			}
+		}
+		tmp = make([]float64, 4*width*(last-first+1))
+		e.horizontalPass(in, tmp, first, e.in.Min.Y+first, e.in.Min.Y+last+1)
+	}
+	for y := rows.Min; y < rows.Max; y++ {
+		for x := 0; x < width; x++ {
+			var sr, sg, sb, sa float64
+			for _, t := range e.yTaps[y] {
+				i := 4 * ((t.index-first)*width + x)
+				sr += tmp[i] * t.weight
+				sg += tmp[i+1] * t.weight
+				sb += tmp[i+2] * t.weight
+				sa += tmp[i+3] * t.weight
+			}
+			out.SetRGBA64(x, y, finishResample(sr, sg, sb, sa))
+		}
+	}
+}
+
+//
+// Rotation
+//
+
+// Rotate turns the image counter-clockwise by angle degrees
+func (img *Image) Rotate(angle float64, method ResampleMethod) {
+	img.BSPRotate(angle, method, 1)
+}
+
+// BSPRotate parallelly turns the image counter-clockwise by angle degrees
+// Multiples of 90 degrees move pixels exactly; other angles enlarge the output to hold the whole rotated
+// image, leave the uncovered corners transparent and interpolate with method (Lanczos3 falls back to Bicubic)
+func (img *Image) BSPRotate(angle float64, method ResampleMethod, numThreads int) {
+	img.applyRows(img.rotateEffect(angle, method), numThreads)
+}
+
+// rotateEffect returns the effect of a rotation of the image
+func (img *Image) rotateEffect(angle float64, method ResampleMethod) Effect {
+	in := img.Bounds
+	w, h := in.Dx(), in.Dy()
+	turns := normalizedAngle(angle)
+	// src maps an output pixel to the input pixel it shows
+	var src func(x, y int) (int, int)
+	switch turns {
+	case 0:
+		src = func(x, y int) (int, int) { return x, y }
+	case 90:
+		src = func(x, y int) (int, int) { return w - 1 - y, x }
+	case 180:
+		src = func(x, y int) (int, int) { return w - 1 - x, h - 1 - y }
+	case 270:
+		src = func(x, y int) (int, int) { return y, h - 1 - x }
+	default:
+		return rotationEffect{img.rowImage(), turns, method}
+	}
+	return remapEffect{rotatedBounds(in, turns), src}
+}
+
+// normalizedAngle returns the angle in [0, 360) that turns like angle degrees
+func normalizedAngle(angle float64) float64 {
+	turns := math.Mod(angle, 360)
+	if turns < 0 {
+		turns += 360
+	}
+	return turns
+}
+
+// rotatedBounds returns the bounds of the output of BSPRotate for an input of bounds in
+func rotatedBounds(in image.Rectangle, angle float64) image.Rectangle {
+	switch angle = normalizedAngle(angle); angle {
+	case 0, 180:
+		return image.Rect(0, 0, in.Dx(), in.Dy())
+	case 90, 270:
+		return image.Rect(0, 0, in.Dy(), in.Dx())
+	}
+	w, h := float64(in.Dx()), float64(in.Dy())
+	sin, cos := math.Sincos(angle * math.Pi / 180)
+	width := int(math.Ceil(math.Abs(w*cos) + math.Abs(h*sin) - 1e-9))
+	height := int(math.Ceil(math.Abs(w*sin) + math.Abs(h*cos) - 1e-9))
+	return image.Rect(0, 0, width, height)
+}
+
+// remapEffect is the effect of the geometric effects that move pixels without resampling them:
+// src maps an output pixel to the input pixel it shows, both relative to the top-left corners
+type remapEffect struct {
+	out image.Rectangle
+	src func(x, y int) (int, int)
+}
+
+func (e remapEffect) Info() EffectInfo                          { return EffectInfo{Halo: WholeImage} }
+func (e remapEffect) Bounds(in image.Rectangle) image.Rectangle { return e.out }
+
+// Apply fills rows of out with the pixels of in they show
+func (e remapEffect) Apply(in, out *image.RGBA64, rows Rows) {
+	min := in.Bounds().Min
+	for y := rows.Min; y < rows.Max; y++ {
+		for x := 0; x < e.out.Dx(); x++ {
+			sx, sy := e.src(x, y)
+			out.SetRGBA64(x, y, in.RGBA64At(min.X+sx, min.Y+sy))
+		}
+	}
+}
+
+// rotationEffect is the effect of a rotation by an angle that is not a multiple of 90 degrees
+type rotationEffect struct {
+	rowImage
+	angle  float64
+	method ResampleMethod
+}
+
+func (e rotationEffect) Info() EffectInfo { return EffectInfo{Halo: WholeImage} }
+
+func (e rotationEffect) Bounds(in image.Rectangle) image.Rectangle { return rotatedBounds(in, e.angle) }
+
+// Apply interpolates rows of the rotated image
+func (e rotationEffect) Apply(in, out *image.RGBA64, rows Rows) {
+	img := e.view(in, out)
+	w, h := float64(e.bounds.Dx()), float64(e.bounds.Dy())
+	sin, cos := math.Sincos(e.angle * math.Pi / 180)
+	bounds := rotatedBounds(e.bounds, e.angle)
+	width, height := bounds.Dx(), bounds.Dy()
+	for y := rows.Min; y < rows.Max; y++ {
+		for x := 0; x < width; x++ {
+			// rotate the pixel center about the output center back into the input (y points down)
+			u, v := float64(x)+0.5-float64(width)/2, float64(y)+0.5-float64(height)/2
+			sx := cos*u - sin*v + w/2 - 0.5
+			sy := sin*u + cos*v + h/2 - 0.5
+			out.SetRGBA64(x, y, img.sample(sx, sy, e.method))
+		}
+	}
+}
+
+// sample interpolates In at (fx, fy), measured in pixels from the center of its top-left pixel
+// Everything outside the image is transparent
+func (img *Image) sample(fx, fy float64, method ResampleMethod) color.RGBA64 {
+	in := img.Bounds
+	at := func(x, y int) color.RGBA64 {
+		if x < 0 || x >= in.Dx() || y < 0 || y >= in.Dy() {
+			return color.RGBA64{}
+		}
+		return img.In.RGBA64At(in.Min.X+x, in.Min.Y+y)
+	}
+	if method == Nearest {
+		return at(int(math.Floor(fx+0.5)), int(math.Floor(fy+0.5)))
+	}
+	filter := resampleFilters[Bilinear]
+	if method != Bilinear {
+		filter = resampleFilters[Bicubic]
+	}
+	support := int(filter.support)
+	x0, y0 := int(math.Floor(fx)), int(math.Floor(fy))
+	var sr, sg, sb, sa float64
+	for y := y0 - support + 1; y <= y0+support; y++ {
+		wy := filter.kernel(fy - float64(y))
+		for x := x0 - support + 1; x <= x0+support; x++ {
+			wgt := wy * filter.kernel(fx-float64(x))
+			c := at(x, y)
+			sr += float64(c.R) * wgt
+			sg += float64(c.G) * wgt
+			sb += float64(c.B) * wgt
+			sa += float64(c.A) * wgt
+		}
+	}
+	return finishResample(sr, sg, sb, sa)
+}
+
+//
+// Flips and crop
+//
+
+// Flip mirrors the image along FlipHorizontal or FlipVertical
+func (img *Image) Flip(axis string) {
+	img.BSPFlip(axis, 1)
+}
+
+// BSPFlip parallelly mirrors the image
+func (img *Image) BSPFlip(axis string, numThreads int) {
+	img.applyRows(flipEffect(axis, img.Bounds), numThreads)
+}
+
+// flipEffect returns the effect of a flip of an image of bounds in
+func flipEffect(axis string, in image.Rectangle) remapEffect {
+	w, h := in.Dx(), in.Dy()
+	src := func(x, y int) (int, int) { return w - 1 - x, y }
+	if axis == FlipVertical {
+		src = func(x, y int) (int, int) { return x, h - 1 - y }
+	}
+	return remapEffect{image.Rect(0, 0, w, h), src}
+}
+
+// Crop keeps the part of the image inside r, given relative to the top-left corner of the image
+func (img *Image) Crop(r image.Rectangle) error {
+	return img.BSPCrop(r, 1)
+}
+
+// BSPCrop parallelly keeps the part of the image inside r
+// r is clipped to the image, and it is an error when nothing is left
+func (img *Image) BSPCrop(r image.Rectangle, numThreads int) error {
+	crop, err := cropEffect(r, img.Bounds)
+	if err != nil {
+		return err
+	}
+	img.applyRows(crop, numThreads)
+	return nil
+}
+
+// cropEffect returns the effect of a crop of an image of bounds in
+func cropEffect(r, in image.Rectangle) (remapEffect, error) {
+	r = r.Intersect(image.Rect(0, 0, in.Dx(), in.Dy()))
+	if r.Empty() {
+		return remapEffect{}, errors.New("png: the crop rectangle lies outside the image")
+	}
+	return remapEffect{image.Rect(0, 0, r.Dx(), r.Dy()), func(x, y int) (int, int) {
+		return r.Min.X + x, r.Min.Y + y
+	}}, nil
+}
@@ -0,0 +1,158 @@
+// Package png allows for loading png images and applying image flitering effects on them
+// Grayscale conversion methods: https://en.wikipedia.org/wiki/Grayscale#Converting_color_to_grayscale
+package png
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// GrayMethod selects how Grayscale turns a color into a gray level
+// The weighted methods (average, rec601, rec709 and the single channels) weigh the values as they are stored:
+// gamma-encoded values, which gives the luma of the standards, or linear-light values when a task runs in linear
+// light, which gives a luminance instead; luminosity and lightness are computed in linear light either way
+type GrayMethod string
+
+const (
+	GrayAverage    GrayMethod = "average"    // unweighted (r+g+b)/3, the original "G" effect
+	GrayRec601     GrayMethod = "rec601"     // Rec. 601 weights of the stored values
+	GrayRec709     GrayMethod = "rec709"     // Rec. 709 weights of the stored values
+	GrayLuminosity GrayMethod = "luminosity" // Rec. 709 relative luminance computed in linear light
+	GrayLightness  GrayMethod = "lightness"  // CIE L* of the relative luminance
+	GrayDesaturate GrayMethod = "desaturate" // (max+min)/2, the HSL lightness
+	GrayRed        GrayMethod = "red"        // single channel extraction
+	GrayGreen      GrayMethod = "green"
+	GrayBlue       GrayMethod = "blue"
+)
+
+// ParseGrayMethod validates the "method" parameter of the "G" effect; the empty string selects GrayAverage
+func ParseGrayMethod(s string) (GrayMethod, error) {
+	switch m := GrayMethod(s); m {
+	case "":
+		return GrayAverage, nil
+	case GrayAverage, GrayRec601, GrayRec709, GrayLuminosity, GrayLightness, GrayDesaturate, GrayRed, GrayGreen, GrayBlue:
+		return m, nil
+	}
+	return "", fmt.Errorf("png: unknown grayscale method %q", s)
+}
+
+// weighted reports whether the gray level is a weighted sum of the channels with weights summing to 1,
+// which commutes with every convolution up to clamping and rounding
+func (m GrayMethod) weighted() bool {
+	switch m {
+	case "", GrayAverage, GrayRec601, GrayRec709, GrayRed, GrayGreen, GrayBlue:
+		return true
+	}
+	return false
+}
+
+// grayLevel returns the premultiplied gray level of a premultiplied pixel
+// curve is the transfer function of the pixels when they are already in linear light, nil otherwise
+func grayLevel(method GrayMethod, r, g, b, a uint32, curve *transferCurve) uint16 {
+	switch method {
+	case GrayRec601:
+		return clamp(0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b))
+	case GrayRec709:
+		return clamp(0.2126*float64(r) + 0.7152*float64(g) + 0.0722*float64(b))
+	case GrayDesaturate:
+		return uint16((max3(r, g, b) + min3(r, g, b)) / 2)
+	case GrayRed:
+		return uint16(r)
+	case GrayGreen:
+		return uint16(g)
+	case GrayBlue:
+		return uint16(b)
+	case GrayLuminosity, GrayLightness:
+		return luminanceGray(method, r, g, b, a, curve)
+	}
+	return clamp(float64(r+g+b) / 3)
+}
+
+// luminanceGray computes the methods that need the linear-light luminance of the straight color
+func luminanceGray(method GrayMethod, r, g, b, a uint32, curve *transferCurve) uint16 {
+	if a == 0 {
+		return 0
+	}
+	r, g, b = unpremultiply(r, a), unpremultiply(g, a), unpremultiply(b, a)
+	linear := curve != nil
+	if !linear {
+		curve = srgbCurve()
+		r, g, b = uint32(curve.toLinear[r]), uint32(curve.toLinear[g]), uint32(curve.toLinear[b])
+	}
+	y := clamp(0.2126*float64(r) + 0.7152*float64(g) + 0.0722*float64(b))
+
+	var gray uint16
+	if method == GrayLuminosity {
+		gray = y
+		if !linear {
+			gray = curve.fromLinear[y]
+		}
+	} else {
+		// CIE L* in [0, 100], an (encoded) perceptual scale by construction
+		t := float64(y) / 65535
+		var l float64
+		if t > 216.0/24389 {
+			l = 116*math.Cbrt(t) - 16
+		} else {
+			l = 24389.0 / 27 * t
+		}
+		gray = clamp(l / 100 * 65535)
+		if linear {
+			gray = curve.toLinear[gray]
+		}
+	}
+	return uint16(uint32(gray) * a / 0xffff)
+}
+
+func max3(a, b, c uint32) uint32 {
+	if b > a {
+		a = b
+	}
+	if c > a {
+		a = c
+	}
+	return a
+}
+
+func min3(a, b, c uint32) uint32 {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// grayEffect is the effect of a grayscale method (see registry.go)
+type grayEffect struct {
+	method GrayMethod
+	linear *transferCurve // transfer function of the pixels when they are in linear light
+}
+
+func (e grayEffect) Info() EffectInfo                          { return EffectInfo{Pointwise: true, KeepsAlpha: true} }
+func (e grayEffect) Bounds(in image.Rectangle) image.Rectangle { return in }
+
+// Apply converts rows of in into out
+func (e grayEffect) Apply(in, out *image.RGBA64, rows Rows) {
+	bounds := in.Bounds()
+	for y := rows.Min; y < rows.Max; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := in.RGBA64At(x, y)
+			grey := grayLevel(e.method, uint32(c.R), uint32(c.G), uint32(c.B), uint32(c.A), e.linear)
+			out.SetRGBA64(x, y, color.RGBA64{grey, grey, grey, c.A})
+		}
+	}
+}
+
+// GrayscaleWith applies a grayscale filtering effect to a image using the given method
+func (img *Image) GrayscaleWith(method GrayMethod) {
+	img.applyRows(grayEffect{method, img.linear}, 1)
+}
+
+// BSPGrayscaleWith parallelly applies a grayscale filtering effect to a image using the given method
+func (img *Image) BSPGrayscaleWith(method GrayMethod, numThreads int) {
+	img.applyRows(grayEffect{method, img.linear}, numThreads)
+}
@@ -0,0 +1,149 @@
+// Package png allows for loading png images and applying image flitering effects on them
+// Guided filter with the luma of the image as its guide, built from box means only
+// K. He, J. Sun, X. Tang, "Guided Image Filtering", 2010
+package png
+
+import (
+	"image"
+)
+
+// Guided fits every channel as a linear function of the luma within each window of Radius pixels and averages
+// the fits: edges of the luma survive while flat areas are smoothed
+// Eps regularizes the fits, in squared fractions of full intensity: areas whose luma varies less than about
+// sqrt(Eps) are smoothed, and larger values smooth more
+// The colors are filtered premultiplied and every pixel keeps its alpha
+type Guided struct {
+	Radius int
+	Eps    float64
+}
+
+// boxMeans replaces every plane by its mean over windows of 2r+1 pixels, a horizontal and a vertical pass
+// Windows are cut by the image borders, so the border means are over fewer pixels
+// The horizontal pass slides a running sum along whole rows and the vertical pass adds the rows of every window,
+// so no mean depends on which rows the planes hold
+func boxMeans(planes [][]float64, width, height, r int) {
+	sums := make([]float64, width*height)
+	for _, plane := range planes {
+		for y := 0; y < height; y++ {
+			src, dst := plane[y*width:(y+1)*width], sums[y*width:(y+1)*width]
+			var sum float64
+			for x := 0; x < r && x < width; x++ {
+				sum += src[x]
+			}
+			for x := range dst {
+				if x+r < width {
+					sum += src[x+r]
+				}
+				if x-r-1 >= 0 {
+					sum -= src[x-r-1]
+				}
+				dst[x] = sum
+			}
+		}
+		for y := 0; y < height; y++ {
+			y0, y1 := y-r, y+r
+			if y0 < 0 {
+				y0 = 0
+			}
+			if y1 > height-1 {
+				y1 = height - 1
+			}
+			dst := plane[y*width : (y+1)*width]
+			for x := range dst {
+				dst[x] = 0
+			}
+			for ny := y0; ny <= y1; ny++ {
+				for x, v := range sums[ny*width : (ny+1)*width] {
+					dst[x] += v
+				}
+			}
+			for x := range dst {
+				x0, x1 := x-r, x+r
+				if x0 < 0 {
+					x0 = 0
+				}
+				if x1 > width-1 {
+					x1 = width - 1
+				}
+				dst[x] /= float64((x1 - x0 + 1) * (y1 - y0 + 1))
+			}
+		}
+	}
+}
+
+// Guided applies a guided filter to the image
+func (img *Image) Guided(f Guided) {
+	img.BSPGuided(f, 1)
+}
+
+// BSPGuided parallelly applies a guided filter to the image
+func (img *Image) BSPGuided(f Guided, numThreads int) {
+	img.applyRows(guidedEffect{img.rowImage(), f}, numThreads)
+}
+
+// guidedEffect is the effect of the guided filter
+type guidedEffect struct {
+	rowImage
+	f Guided
+}
+
+// Info reports a halo of twice the radius, since the means of the coefficients are means of means
+func (e guidedEffect) Info() EffectInfo { return EffectInfo{Halo: 2 * e.f.Radius, KeepsAlpha: true} }
+
+// Apply filters rows of in into out in four passes plus those of the box means, over the rows within the halo of
+// them (see bandView): the planes of the guide and its products, their means, the coefficients of the fits, their
+// means and the output
+func (e guidedEffect) Apply(in, out *image.RGBA64, rows Rows) {
+	img := e.bandView(in, out, rows, 2*e.f.Radius)
+	bounds := img.Bounds
+	width, height := bounds.Dx(), bounds.Dy()
+	n := width * height
+	newPlanes := func(count int) [][]float64 {
+		planes := make([][]float64, count)
+		for i := range planes {
+			planes[i] = make([]float64, n)
+		}
+		return planes
+	}
+	eps := e.f.Eps * 65535 * 65535
+
+	// guide I, I*I, and p, I*p for the three colors
+	guide := make([]float64, n)
+	stats := newPlanes(8)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			i := (y-bounds.Min.Y)*width + x - bounds.Min.X
+			p := in.RGBA64At(x, y)
+			l := float64(straightLuma(p))
+			guide[i], stats[0][i], stats[1][i] = l, l, l*l
+			for c, v := range [3]uint16{p.R, p.G, p.B} {
+				stats[2+2*c][i], stats[3+2*c][i] = float64(v), l*float64(v)
+			}
+		}
+	}
+	boxMeans(stats, width, height, e.f.Radius)
+
+	// the fit p = a I + b of every window
+	coeffs := newPlanes(6)
+	for i := 0; i < n; i++ {
+		meanI := stats[0][i]
+		variance := stats[1][i] - meanI*meanI
+		for c := 0; c < 3; c++ {
+			meanP := stats[2+2*c][i]
+			a := (stats[3+2*c][i] - meanI*meanP) / (variance + eps)
+			coeffs[2*c][i], coeffs[2*c+1][i] = a, meanP-a*meanI
+		}
+	}
+	boxMeans(coeffs, width, height, e.f.Radius)
+
+	for y := rows.Min; y < rows.Max; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			i := (y-bounds.Min.Y)*width + x - bounds.Min.X
+			var q [3]float64
+			for c := range q {
+				q[c] = coeffs[2*c][i]*guide[i] + coeffs[2*c+1][i]
+			}
+			img.finishSmooth(x, y, q[0], q[1], q[2])
+		}
+	}
+}
@@ -0,0 +1,211 @@
+// Package png allows for loading png images and applying image flitering effects on them
+// Integral images (summed-area tables), which give the sum over any rectangle from four entries
+// https://en.wikipedia.org/wiki/Summed-area_table
+package png
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/bits"
+)
+
+// IntegralImage is the summed-area table of the channels of an image: entry (x, y) of a channel holds the sum of
+// the pixels left of x and above y, so a table has one more row and column than the image
+// The sums are exact, since even the squares of a 32768x32768 image fit in 64 bits
+type IntegralImage struct {
+	Width, Height int
+	Sums          [4][]uint64 // red, green, blue and alpha
+	Squares       [4][]uint64 // sums of the squared values, nil unless requested
+}
+
+// BSPIntegralImage parallelly builds the integral image of In, with straight colors if straight is set and
+// the sums of squares if squares is set
+// The prefix sums take two supersteps: every slice of rows sums its rows from left to right, and after the barrier
+// every band of columns sums its columns from top to bottom
+func (img *Image) BSPIntegralImage(straight, squares bool, numThreads int) *IntegralImage {
+	bounds := img.Bounds
+	width, height := bounds.Dx(), bounds.Dy()
+	t := &IntegralImage{Width: width, Height: height}
+	stride := width + 1
+	for c := range t.Sums {
+		t.Sums[c] = make([]uint64, stride*(height+1))
+		if squares {
+			t.Squares[c] = make([]uint64, stride*(height+1))
+		}
+	}
+
+	img.bspRows(numThreads, func(startY, endY int) {
+		for y := startY; y < endY; y++ {
+			row := (y - bounds.Min.Y + 1) * stride
+			var sums, sq [4]uint64
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				p := img.In.RGBA64At(x, y)
+				if straight {
+					a := uint32(p.A)
+					p.R = uint16(unpremultiply(uint32(p.R), a))
+					p.G = uint16(unpremultiply(uint32(p.G), a))
+					p.B = uint16(unpremultiply(uint32(p.B), a))
+				}
+				i := row + x - bounds.Min.X + 1
+				for c, v := range [4]uint16{p.R, p.G, p.B, p.A} {
+					sums[c] += uint64(v)
+					t.Sums[c][i] = sums[c]
+					if squares {
+						sq[c] += uint64(v) * uint64(v)
+						t.Squares[c][i] = sq[c]
+					}
+				}
+			}
+		}
+	})
+
+	// the columns are split among the workers like the rows
+	bspSlices(image.Rect(0, 0, 1, width), numThreads, func(startX, endX int) {
+		for y := 2; y <= height; y++ {
+			for x := startX + 1; x <= endX; x++ {
+				i := y*stride + x
+				for c := range t.Sums {
+					t.Sums[c][i] += t.Sums[c][i-stride]
+					if squares {
+						t.Squares[c][i] += t.Squares[c][i-stride]
+					}
+				}
+			}
+		}
+	})
+	return t
+}
+
+// Window returns the window of radius r around (x, y), cut by the borders of the image
+// Coordinates are relative to the top-left corner of the image
+func (t *IntegralImage) Window(x, y, r int) image.Rectangle {
+	return image.Rect(x-r, y-r, x+r+1, y+r+1).Intersect(image.Rect(0, 0, t.Width, t.Height))
+}
+
+// sum returns the sum of a table over r
+func (t *IntegralImage) sum(table []uint64, r image.Rectangle) uint64 {
+	stride := t.Width + 1
+	return table[r.Max.Y*stride+r.Max.X] - table[r.Min.Y*stride+r.Max.X] - table[r.Max.Y*stride+r.Min.X] + table[r.Min.Y*stride+r.Min.X]
+}
+
+// Sum returns the sum of channel c over r, which must lie within the image
+func (t *IntegralImage) Sum(c int, r image.Rectangle) uint64 {
+	return t.sum(t.Sums[c], r)
+}
+
+// Mean returns the mean of channel c over r, which must lie within the image and not be empty
+func (t *IntegralImage) Mean(c int, r image.Rectangle) float64 {
+	return float64(t.Sum(c, r)) / float64(r.Dx()*r.Dy())
+}
+
+// Variance returns the variance of channel c over r, the mean squared deviation from the mean of r; the table must
+// have the squares
+// The sum of the squared deviations is (n sum(x^2) - sum(x)^2) / n, whose numerator is computed exactly in 128 bits:
+// in floating point, E[x^2] - E[x]^2 loses every digit to cancellation when the deviations are small
+func (t *IntegralImage) Variance(c int, r image.Rectangle) float64 {
+	n := uint64(r.Dx() * r.Dy())
+	hiSq, loSq := bits.Mul64(n, t.sum(t.Squares[c], r))
+	sum := t.Sum(c, r)
+	hiSum, loSum := bits.Mul64(sum, sum)
+	lo, borrow := bits.Sub64(loSq, loSum, 0)
+	hi, _ := bits.Sub64(hiSq, hiSum, borrow) // never negative, by the Cauchy-Schwarz inequality
+	return (float64(hi)*(1<<64) + float64(lo)) / (float64(n) * float64(n))
+}
+
+// BoxFilter replaces every pixel by the mean of the window of the given radius, in O(1) per pixel for any radius
+// Windows are cut by the borders of the image, and the alpha mode applies like for the convolutions
+func (img *Image) BoxFilter(radius int) {
+	img.BSPBoxFilter(radius, 1)
+}
+
+// BSPBoxFilter parallelly applies a box filter: the two supersteps of the integral image and one for the means
+func (img *Image) BSPBoxFilter(radius int, numThreads int) {
+	img.applyRows(&boxEffect{rowImage: img.rowImage(), radius: radius, stat: boxMean}, numThreads)
+}
+
+// LocalStdDev replaces the straight colors of every pixel by their standard deviation within the window of
+// the given radius, which keeps them in intensity units; every pixel keeps its alpha
+func (img *Image) LocalStdDev(radius int) {
+	img.BSPLocalStdDev(radius, 1)
+}
+
+// BSPLocalStdDev parallelly computes the local standard deviations
+func (img *Image) BSPLocalStdDev(radius int, numThreads int) {
+	img.applyRows(&boxEffect{rowImage: img.rowImage(), radius: radius, stat: boxStdDev}, numThreads)
+}
+
+// LocalVariance replaces the straight colors of every pixel by their variance within the window of the given
+// radius, as a fraction of the squared full intensity, so that a window half black and half white gives 1/4;
+// every pixel keeps its alpha
+func (img *Image) LocalVariance(radius int) {
+	img.BSPLocalVariance(radius, 1)
+}
+
+// BSPLocalVariance parallelly computes the local variances
+func (img *Image) BSPLocalVariance(radius int, numThreads int) {
+	img.applyRows(&boxEffect{rowImage: img.rowImage(), radius: radius, stat: boxVariance}, numThreads)
+}
+
+// Window statistics of boxEffect
+const (
+	boxMean = iota
+	boxStdDev
+	boxVariance
+)
+
+// boxEffect is the effect of the box filter and of the local standard deviations and variances
+// Prepare builds the integral image of the whole input in its two parallel supersteps; without it, as in the
+// stream mode, Apply builds one over the rows within radius of its own (see bandView), whose exact sums give
+// the windows the same values
+type boxEffect struct {
+	rowImage
+	radius int
+	stat   int
+	table  *IntegralImage
+}
+
+func (e *boxEffect) Info() EffectInfo {
+	return EffectInfo{Halo: e.radius, KeepsAlpha: e.stat != boxMean || e.alpha == AlphaIgnore || e.alpha == ""}
+}
+
+// integralImage builds the table Apply reads for the pixels of img
+func (e *boxEffect) integralImage(img *Image, numThreads int) *IntegralImage {
+	return img.BSPIntegralImage(e.stat != boxMean, e.stat != boxMean, numThreads)
+}
+
+// Prepare builds the integral image of in
+func (e *boxEffect) Prepare(in *image.RGBA64, numThreads int) {
+	e.table = e.integralImage(e.view(in, nil), numThreads)
+}
+
+// Apply writes the window statistics of rows to out
+func (e *boxEffect) Apply(in, out *image.RGBA64, rows Rows) {
+	img, t := e.view(in, out), e.table
+	if t == nil {
+		img = e.bandView(in, out, rows, e.radius)
+		t = e.integralImage(img, 1)
+	}
+	band := img.Bounds
+	for y := rows.Min; y < rows.Max; y++ {
+		for x := band.Min.X; x < band.Max.X; x++ {
+			w := t.Window(x-band.Min.X, y-band.Min.Y, e.radius)
+			if e.stat == boxMean {
+				r, g, b, a := img.convolved(x, y, Kernel{}, 1, t.Mean(0, w), t.Mean(1, w), t.Mean(2, w), t.Mean(3, w))
+				out.SetRGBA64(x, y, color.RGBA64{r, g, b, a})
+				continue
+			}
+			a := uint32(in.RGBA64At(x, y).A)
+			var v [3]uint16
+			for c := range v {
+				if e.stat == boxStdDev {
+					v[c] = clamp(math.Round(math.Sqrt(t.Variance(c, w))))
+				} else {
+					v[c] = clamp(math.Round(t.Variance(c, w) / 0xffff))
+				}
+				v[c] = uint16(uint32(v[c]) * a / 0xffff)
+			}
+			out.SetRGBA64(x, y, color.RGBA64{v[0], v[1], v[2], uint16(a)})
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package png
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+)
+
+func TestBSPIntegralImageMatchesSequential(t *testing.T) {
+	img := testImage(29, 17, 4)
+	want := img.BSPIntegralImage(true, true, 1)
+	for _, threads := range []int{2, 5, 17, 40} {
+		if got := img.BSPIntegralImage(true, true, threads); !reflect.DeepEqual(got, want) {
+			t.Errorf("the table of %d threads differs from the sequential one", threads)
+		}
+	}
+}
+
+func TestBoxEffectsPreparedMatchBands(t *testing.T) {
+	// the prepared table of the whole image and the band tables of the stream mode give the same windows
+	for _, stat := range []int{boxMean, boxStdDev, boxVariance} {
+		for _, radius := range []int{1, 4, 30} {
+			base := testImage(23, 41, int64(radius))
+			base.AlphaMode = AlphaStraight
+			want := cloneImage(base)
+			want.applyRows(&boxEffect{rowImage: want.rowImage(), radius: radius, stat: stat}, 1)
+			for _, threads := range []int{3, 8} {
+				got := cloneImage(base)
+				got.applyRows(&boxEffect{rowImage: got.rowImage(), radius: radius, stat: stat}, threads)
+				label := fmt.Sprintf("stat %d, radius %d, %d threads", stat, radius, threads)
+				samePixels(t, label, want.Out, got.Out)
+
+				bands := cloneImage(base)
+				e := &boxEffect{rowImage: bands.rowImage(), radius: radius, stat: stat}
+				bspSlices(bands.Bounds, threads, func(startY, endY int) {
+					e.Apply(bands.In, bands.Out, Rows{startY, endY})
+				})
+				samePixels(t, label+", bands", want.Out, bands.Out)
+			}
+		}
+	}
+}
+
+func TestLocalVariance(t *testing.T) {
+	// a window of one black and one white column
+	bounds := image.Rect(0, 0, 2, 1)
+	img := &Image{In: image.NewRGBA64(bounds), Out: image.NewRGBA64(bounds), Bounds: bounds}
+	img.In.SetRGBA64(0, 0, color.RGBA64{0, 0, 0, 0xffff})
+	img.In.SetRGBA64(1, 0, color.RGBA64{0xffff, 0xffff, 0xffff, 0xffff})
+	img.LocalVariance(1)
+	if c := img.Out.RGBA64At(0, 0); c != (color.RGBA64{0x4000, 0x4000, 0x4000, 0xffff}) {
+		t.Errorf("the variance is %v, want a quarter of full intensity", c)
+	}
+	img.LocalStdDev(1)
+	if c := img.Out.RGBA64At(1, 0); c.R != 0x8000 {
+		t.Errorf("the standard deviation is %v, want half of full intensity", c)
+	}
+}
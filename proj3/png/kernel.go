@@ -0,0 +1,199 @@
+// Package png allows for loading png images and applying image flitering effects on them
+// Convolution kernels of any odd size
+package png
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+)
+
+// Kernel is an odd-sized rectangular convolution kernel, stored row by row
+// The convolution result is multiplied by Scale (0 means 1) and Bias, a fraction of the full intensity, is added
+// Border selects the pixels the kernel sees beyond the edges of the image (see border.go); empty means BorderZero
+// Gray promises a gray input (R == G == B, see optimize.go), so that only red is convolved and copied to green and blue
+type Kernel struct {
+	Width  int
+	Height int
+	Values []float64
+	Scale  float64
+	Bias   float64
+	Border BorderMode
+	Gray   bool
+}
+
+// NewKernel builds a kernel from its rows, which must all have the same odd length
+func NewKernel(rows [][]float64) (Kernel, error) {
+	if len(rows) == 0 || len(rows)%2 == 0 {
+		return Kernel{}, errors.New("png: kernel must have an odd number of rows")
+	}
+	width := len(rows[0])
+	if width%2 == 0 {
+		return Kernel{}, errors.New("png: kernel rows must have an odd number of values")
+	}
+	k := Kernel{Width: width, Height: len(rows), Values: make([]float64, 0, width*len(rows)), Scale: 1}
+	for _, row := range rows {
+		if len(row) != width {
+			return Kernel{}, fmt.Errorf("png: kernel rows must all have %d values", width)
+		}
+		k.Values = append(k.Values, row...)
+	}
+	return k, nil
+}
+
+// kernel3 wraps one of the flat 3x3 kernels of the original effects
+func kernel3(values [9]float64) Kernel {
+	return Kernel{Width: 3, Height: 3, Values: values[:], Scale: 1}
+}
+
+// boxKernel returns the (2r+1)x(2r+1) averaging kernel
+func boxKernel(radius int) Kernel {
+	size := 2*radius + 1
+	k := Kernel{Width: size, Height: size, Values: make([]float64, size*size), Scale: 1}
+	for i := range k.Values {
+		k.Values[i] = 1.0 / float64(size*size)
+	}
+	return k
+}
+
+// Sum returns the sum of the kernel values
+func (k Kernel) Sum() float64 {
+	sum := 0.0
+	for _, v := range k.Values {
+		sum += v
+	}
+	return sum
+}
+
+// Divide returns a copy of the kernel with every value divided by divisor
+func (k Kernel) Divide(divisor float64) Kernel {
+	values := make([]float64, len(k.Values))
+	for i, v := range k.Values {
+		values[i] = v / divisor
+	}
+	k.Values = values
+	return k
+}
+
+// Normalize returns a copy of the kernel whose values sum to 1, or the kernel itself if they sum to 0
+func (k Kernel) Normalize() Kernel {
+	if sum := k.Sum(); sum != 0 {
+		return k.Divide(sum)
+	}
+	return k
+}
+
+// interior reports whether the whole neighborhood of (x, y) lies inside bounds
+func (k Kernel) interior(x, y int, bounds image.Rectangle) bool {
+	hx, hy := k.halo()
+	return x-hx >= bounds.Min.X && x+hx < bounds.Max.X && y-hy >= bounds.Min.Y && y+hy < bounds.Max.Y
+}
+
+// halo returns how far the kernel reaches beyond the center pixel horizontally and vertically
+func (k Kernel) halo() (int, int) {
+	return k.Width / 2, k.Height / 2
+}
+
+// separable factors the kernel into a column and a row vector whose outer product is the kernel
+// A rank-1 kernel can be applied as a horizontal and a vertical pass, costing Width+Height
+// instead of Width*Height multiplications per pixel
+func (k Kernel) separable() (col, row []float64, ok bool) {
+	if len(k.Values) != k.Width*k.Height {
+		return nil, nil, false
+	}
+	// the largest value is the most accurate pivot
+	pivot := 0
+	for i, v := range k.Values {
+		if math.Abs(v) > math.Abs(k.Values[pivot]) {
+			pivot = i
+		}
+	}
+	p := k.Values[pivot]
+	if p == 0 {
+		return nil, nil, false
+	}
+	py, px := pivot/k.Width, pivot%k.Width
+	row = append([]float64(nil), k.Values[py*k.Width:(py+1)*k.Width]...)
+	col = make([]float64, k.Height)
+	for y := range col {
+		col[y] = k.Values[y*k.Width+px] / p
+	}
+	// every value must match the outer product up to rounding
+	tolerance := 1e-9 * math.Abs(p)
+	for y := 0; y < k.Height; y++ {
+		for x := 0; x < k.Width; x++ {
+			if math.Abs(col[y]*row[x]-k.Values[y*k.Width+x]) > tolerance {
+				return nil, nil, false
+			}
+		}
+	}
+	return col, row, true
+}
+
+// useSeparable reports whether the convolution takes the two-pass path
+// 3x3 kernels keep the direct path, which is about as fast and keeps the original effects bit for bit
+func (k Kernel) useSeparable() ([]float64, []float64, bool) {
+	if k.Width <= 3 && k.Height <= 3 {
+		return nil, nil, false
+	}
+	return k.separable()
+}
+
+// Kernels from these sizes on convolve through the FFT (see fft.go), whose cost barely depends on the kernel:
+// dense kernels larger than 15x15, and separable ones whose two passes add up to more taps than fftMinTaps
+const (
+	fftMinArea = 15 * 15
+	fftMinTaps = 2 * 61
+)
+
+// useFFT reports whether the kernel is large enough for the FFT convolution
+func (k Kernel) useFFT() bool {
+	if _, _, ok := k.useSeparable(); ok {
+		return k.Width+k.Height > fftMinTaps
+	}
+	return k.Width*k.Height > fftMinArea
+}
+
+// gaussianKernel returns the normalized (2r+1)x(2r+1) Gaussian kernel of standard deviation sigma,
+// where a radius of 0 picks ceil(3 sigma), which covers 99.7% of the weight
+func gaussianKernel(sigma float64, radius int) Kernel {
+	if radius == 0 {
+		radius = int(math.Ceil(3 * sigma))
+	}
+	size := 2*radius + 1
+	weights := make([]float64, size)
+	sum := 0.0
+	for i := range weights {
+		d := float64(i - radius)
+		weights[i] = math.Exp(-d * d / (2 * sigma * sigma))
+		sum += weights[i]
+	}
+	for i := range weights {
+		weights[i] /= sum
+	}
+	k := Kernel{Width: size, Height: size, Values: make([]float64, size*size), Scale: 1}
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			k.Values[y*size+x] = weights[y] * weights[x]
+		}
+	}
+	return k
+}
+
+// finish applies scale and bias to the sum of one color channel
+func (k Kernel) finish(sum float64) float64 {
+	if k.Scale != 0 && k.Scale != 1 {
+		sum *= k.Scale
+	}
+	return sum + k.Bias*65535
+}
+
+// weight returns the sum of the kernel values, the factor by which the kernel scales a constant image
+func (k Kernel) weight() float64 {
+	var sum float64
+	for _, v := range k.Values {
+		sum += v
+	}
+	return sum
+}
@@ -0,0 +1,136 @@
+package png
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+// testImage returns an image of random premultiplied pixels, the same for the same seed
+func testImage(width, height int, seed int64) *Image {
+	rng := rand.New(rand.NewSource(seed))
+	bounds := image.Rect(0, 0, width, height)
+	img := &Image{In: image.NewRGBA64(bounds), Out: image.NewRGBA64(bounds), Bounds: bounds}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			a := rng.Intn(0x10000)
+			img.In.SetRGBA64(x, y, color.RGBA64{uint16(rng.Intn(a + 1)), uint16(rng.Intn(a + 1)), uint16(rng.Intn(a + 1)), uint16(a)})
+		}
+	}
+	return img
+}
+
+// cloneImage returns a copy of img with buffers of its own
+func cloneImage(img *Image) *Image {
+	c := *img
+	c.In = image.NewRGBA64(img.In.Rect)
+	copy(c.In.Pix, img.In.Pix)
+	c.Out = image.NewRGBA64(img.Out.Rect)
+	copy(c.Out.Pix, img.Out.Pix)
+	return &c
+}
+
+// samePixels reports the first pixel at which got differs from want
+func samePixels(t *testing.T, name string, want, got *image.RGBA64) bool {
+	t.Helper()
+	if want.Rect != got.Rect {
+		t.Errorf("%s: the bounds are %v, want %v", name, got.Rect, want.Rect)
+		return false
+	}
+	for y := want.Rect.Min.Y; y < want.Rect.Max.Y; y++ {
+		for x := want.Rect.Min.X; x < want.Rect.Max.X; x++ {
+			if w, g := want.RGBA64At(x, y), got.RGBA64At(x, y); w != g {
+				t.Errorf("%s: pixel (%d, %d) is %v, want %v", name, x, y, g, w)
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// randomKernel returns a width x height kernel of random weights, which is not separable
+func randomKernel(width, height int, seed int64) Kernel {
+	rng := rand.New(rand.NewSource(seed))
+	k := Kernel{Width: width, Height: height, Values: make([]float64, width*height), Scale: 1}
+	for i := range k.Values {
+		k.Values[i] = rng.Float64()*2 - 0.5
+	}
+	return k.Normalize()
+}
+
+var testBorders = []BorderMode{BorderZero, BorderClamp, BorderReflect, BorderReflect101, BorderWrap, BorderValid}
+
+func TestBSPConvolutionMatchesSequential(t *testing.T) {
+	for size := 3; size <= 15; size += 2 {
+		kernels := map[string]Kernel{
+			"dense":    randomKernel(size, size, int64(size)),
+			"gaussian": gaussianKernel(float64(size)/6, size/2),
+			"tall":     randomKernel(3, size, int64(size)+100),
+		}
+		for name, kernel := range kernels {
+			for _, border := range testBorders {
+				kernel.Border = border
+				for _, height := range []int{1, 5, 13, 31} {
+					base := testImage(23, height, int64(size*height))
+					want := cloneImage(base)
+					want.Convolution(kernel)
+					// more threads than rows leaves some slices empty
+					for _, threads := range []int{2, 3, 8, height + 5} {
+						got := cloneImage(base)
+						got.BSPConvolution(kernel, threads)
+						samePixels(t, fmt.Sprintf("%dx%d %s %s, height %d, %d threads", kernel.Width, kernel.Height, name, border, height, threads), want.Out, got.Out)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestConvolutionAlphaModes(t *testing.T) {
+	for _, alpha := range []AlphaMode{AlphaIgnore, AlphaPremultiplied, AlphaStraight} {
+		base := testImage(17, 11, 7)
+		base.AlphaMode = alpha
+		kernel := gaussianKernel(1.5, 4)
+		want := cloneImage(base)
+		want.Convolution(kernel)
+		got := cloneImage(base)
+		got.BSPConvolution(kernel, 4)
+		samePixels(t, string(alpha), want.Out, got.Out)
+	}
+}
+
+func TestSeparableMatchesDirect(t *testing.T) {
+	// the separable path sums in another order, so it may differ from the direct one by a unit of rounding
+	for _, border := range testBorders {
+		base := testImage(19, 15, 3)
+		kernel := gaussianKernel(1.2, 3)
+		kernel.Border = border
+		if _, _, ok := kernel.useSeparable(); !ok {
+			t.Fatal("the gaussian kernel is not separable")
+		}
+		sep := cloneImage(base)
+		sep.Convolution(kernel)
+		direct := cloneImage(base)
+		e := direct.convolutionEffect(kernel)
+		e.col, e.row = nil, nil
+		direct.applyRows(e, 1)
+		for y := 0; y < 15; y++ {
+			for x := 0; x < 19; x++ {
+				a, b := sep.Out.RGBA64At(x, y), direct.Out.RGBA64At(x, y)
+				if diff(a.R, b.R) > 1 || diff(a.G, b.G) > 1 || diff(a.B, b.B) > 1 || diff(a.A, b.A) > 1 {
+					t.Fatalf("%s: pixel (%d, %d) is %v, the direct convolution gives %v", border, x, y, a, b)
+				}
+			}
+		}
+	}
+}
+
+// diff returns the distance between two samples
+func diff(a, b uint16) int {
+	if a > b {
+		return int(a - b)
+	}
+	return int(b - a)
+}
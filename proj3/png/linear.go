@@ -0,0 +1,154 @@
+// Package png allows for loading png images and applying image flitering effects on them
+// Linear-light processing: the effects average gamma-encoded values unless the pixels are first
+// converted to linear light, which makes blurred edges too dark
+// https://en.wikipedia.org/wiki/SRGB#Transfer_function_(%22gamma%22)
+package png
+
+import (
+	"encoding/binary"
+	"image"
+	"image/color"
+	"math"
+	"sync"
+)
+
+// transferCurve converts 16-bit samples between the encoded and the linear domain through lookup tables
+type transferCurve struct {
+	toLinear   [65536]uint16
+	fromLinear [65536]uint16
+}
+
+func newTransferCurve(decode, encode func(float64) float64) *transferCurve {
+	c := &transferCurve{}
+	for i := range c.toLinear {
+		v := float64(i) / 65535
+		c.toLinear[i] = uint16(math.Round(decode(v) * 65535))
+		c.fromLinear[i] = uint16(math.Round(encode(v) * 65535))
+	}
+	return c
+}
+
+var (
+	srgbOnce  sync.Once
+	srgbLUT   *transferCurve
+	gammaMu   sync.Mutex
+	gammaLUTs = map[uint32]*transferCurve{}
+)
+
+// srgbCurve returns the tables of the piecewise sRGB transfer function
+func srgbCurve() *transferCurve {
+	srgbOnce.Do(func() {
+		srgbLUT = newTransferCurve(
+			func(v float64) float64 {
+				if v <= 0.04045 {
+					return v / 12.92
+				}
+				return math.Pow((v+0.055)/1.055, 2.4)
+			},
+			func(v float64) float64 {
+				if v <= 0.0031308 {
+					return v * 12.92
+				}
+				return 1.055*math.Pow(v, 1/2.4) - 0.055
+			})
+	})
+	return srgbLUT
+}
+
+// gammaCurve returns the tables of a pure power law, where gAMA stores the file gamma times 100000
+// (encoded = linear^(gAMA/100000)), caching one pair of tables per distinct gAMA value
+func gammaCurve(gAMA uint32) *transferCurve {
+	gammaMu.Lock()
+	defer gammaMu.Unlock()
+	if c, ok := gammaLUTs[gAMA]; ok {
+		return c
+	}
+	g := float64(gAMA) / 100000
+	c := newTransferCurve(
+		func(v float64) float64 { return math.Pow(v, 1/g) },
+		func(v float64) float64 { return math.Pow(v, g) })
+	gammaLUTs[gAMA] = c
+	return c
+}
+
+// transferCurveFor picks the transfer function declared by the ancillary chunks of an input:
+// an sRGB chunk wins over gAMA (as the PNG specification requires), and sRGB is assumed when neither is present
+func transferCurveFor(chunks []Chunk) *transferCurve {
+	var gAMA uint32
+	for _, c := range chunks {
+		switch c.Type {
+		case "sRGB":
+			return srgbCurve()
+		case "gAMA":
+			if len(c.Data) == 4 {
+				gAMA = binary.BigEndian.Uint32(c.Data)
+			}
+		}
+	}
+	if gAMA != 0 {
+		return gammaCurve(gAMA)
+	}
+	return srgbCurve()
+}
+
+// convertPixel applies a lookup table to the un-premultiplied color of one premultiplied pixel
+func convertPixel(lut *[65536]uint16, c color.RGBA64) color.RGBA64 {
+	if c.A == 0xffff {
+		return color.RGBA64{lut[c.R], lut[c.G], lut[c.B], c.A}
+	}
+	if c.A == 0 {
+		return c
+	}
+	a := uint32(c.A)
+	r := uint32(lut[unpremultiply(uint32(c.R), a)]) * a / 0xffff
+	g := uint32(lut[unpremultiply(uint32(c.G), a)]) * a / 0xffff
+	b := uint32(lut[unpremultiply(uint32(c.B), a)]) * a / 0xffff
+	return color.RGBA64{uint16(r), uint16(g), uint16(b), c.A}
+}
+
+// convertRows applies a lookup table in place to rows [startY, endY) of buf
+func convertRows(buf *image.RGBA64, lut *[65536]uint16, startY, endY int) {
+	bounds := buf.Bounds()
+	for y := startY; y < endY; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			buf.SetRGBA64(x, y, convertPixel(lut, buf.RGBA64At(x, y)))
+		}
+	}
+}
+
+// ToLinear converts Image.In to linear light, using the transfer function of the input's gAMA/sRGB chunks
+func (img *Image) ToLinear() {
+	img.BSPToLinear(1)
+}
+
+// FromLinear converts the result of the effects back to the transfer function of the input before Save
+func (img *Image) FromLinear() {
+	img.BSPFromLinear(1)
+}
+
+// BSPToLinear parallelly converts Image.In to linear light
+func (img *Image) BSPToLinear(numThreads int) {
+	curve := transferCurveFor(img.Ancillary)
+	img.bspRows(numThreads, func(startY, endY int) {
+		convertRows(img.In, &curve.toLinear, startY, endY)
+	})
+	img.linear = curve
+}
+
+// BSPFromLinear parallelly converts the result of the effects back to the transfer function of the input
+func (img *Image) BSPFromLinear(numThreads int) {
+	curve := img.linear
+	if curve == nil {
+		return
+	}
+	// the result is in Out once an effect ran, Save writes In otherwise
+	buf := img.In
+	if img.EffectsApplied {
+		buf = img.Out
+	}
+	// a geometric effect may have left Out with other bounds than In
+	bspSlices(buf.Bounds(), numThreads, func(startY, endY int) {
+		convertRows(buf, &curve.fromLinear, startY, endY)
+	})
+	img.linear = nil
+}
@@ -0,0 +1,304 @@
+// Package png allows for loading png images and applying image flitering effects on them
+// 3D color lookup tables in the .cube format of Adobe and DaVinci Resolve, for color grading
+package png
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// LUTInterpolation selects how a 3D LUT blends the entries around a color
+type LUTInterpolation string
+
+const (
+	LUTTrilinear   LUTInterpolation = "trilinear"   // the 8 entries of the enclosing cell (default)
+	LUTTetrahedral LUTInterpolation = "tetrahedral" // the 4 entries of the enclosing tetrahedron, which keeps grays neutral
+)
+
+// ParseLUTInterpolation validates the "method" of a LUTEffect; the empty string selects LUTTrilinear
+func ParseLUTInterpolation(s string) (LUTInterpolation, error) {
+	switch LUTInterpolation(s) {
+	case "":
+		return LUTTrilinear, nil
+	case LUTTrilinear, LUTTetrahedral:
+		return LUTInterpolation(s), nil
+	}
+	return "", fmt.Errorf("png: unknown LUT interpolation %q", s)
+}
+
+// maxLUTSize bounds the entries per axis of a 3D LUT (256^3 entries take 400 MB)
+const maxLUTSize = 256
+
+// LUT3D is a 3D color lookup table of Size entries per axis
+// Entry (r, g, b) is at Table[3*(r + g*Size + b*Size*Size)], red varying fastest like in .cube files; input colors
+// are mapped from [DomainMin, DomainMax] to the entries, and the entries are output colors from 0 to 1
+type LUT3D struct {
+	Title     string
+	Size      int
+	DomainMin [3]float64
+	DomainMax [3]float64
+	Table     []float64
+}
+
+// ParseCube reads a 3D LUT in the .cube format
+func ParseCube(r io.Reader) (*LUT3D, error) {
+	lut := &LUT3D{DomainMax: [3]float64{1, 1, 1}}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		fail := func(format string, args ...interface{}) error {
+			return fmt.Errorf("png: .cube line %d: %s", line, fmt.Sprintf(format, args...))
+		}
+		switch key := fields[0]; key {
+		case "TITLE":
+			lut.Title = strings.Trim(strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "TITLE")), `"`)
+		case "LUT_3D_SIZE":
+			if lut.Size != 0 {
+				return nil, fail("LUT_3D_SIZE given twice")
+			}
+			if len(fields) != 2 {
+				return nil, fail("LUT_3D_SIZE takes one number")
+			}
+			size, err := strconv.Atoi(fields[1])
+			if err != nil || size < 2 || size > maxLUTSize {
+				return nil, fail("LUT_3D_SIZE must be between 2 and %d", maxLUTSize)
+			}
+			lut.Size = size
+			lut.Table = make([]float64, 0, 3*size*size*size)
+		case "LUT_1D_SIZE":
+			return nil, fail("1D LUTs are not supported")
+		case "DOMAIN_MIN", "DOMAIN_MAX", "LUT_3D_INPUT_RANGE":
+			values, err := parseCubeFloats(fields[1:])
+			if err != nil {
+				return nil, fail("%v", err)
+			}
+			switch {
+			case key == "LUT_3D_INPUT_RANGE" && len(values) == 2:
+				// the Resolve form: one range for all three channels
+				lut.DomainMin = [3]float64{values[0], values[0], values[0]}
+				lut.DomainMax = [3]float64{values[1], values[1], values[1]}
+			case key != "LUT_3D_INPUT_RANGE" && len(values) == 3:
+				if key == "DOMAIN_MIN" {
+					copy(lut.DomainMin[:], values)
+				} else {
+					copy(lut.DomainMax[:], values)
+				}
+			case key == "LUT_3D_INPUT_RANGE":
+				return nil, fail("LUT_3D_INPUT_RANGE takes 2 numbers")
+			default:
+				return nil, fail("%s takes 3 numbers", key)
+			}
+		default:
+			if !strings.ContainsRune("+-.0123456789", rune(key[0])) {
+				return nil, fail("unknown keyword %s", key)
+			}
+			if lut.Size == 0 {
+				return nil, fail("table entries before LUT_3D_SIZE")
+			}
+			values, err := parseCubeFloats(fields)
+			if err != nil {
+				return nil, fail("%v", err)
+			}
+			if len(values) != 3 {
+				return nil, fail("an entry has 3 numbers, not %d", len(values))
+			}
+			if len(lut.Table) == cap(lut.Table) {
+				return nil, fail("more than %d entries", lut.Size*lut.Size*lut.Size)
+			}
+			lut.Table = append(lut.Table, values...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if lut.Size == 0 {
+		return nil, fmt.Errorf("png: the .cube file has no LUT_3D_SIZE")
+	}
+	if len(lut.Table) != cap(lut.Table) {
+		return nil, fmt.Errorf("png: the .cube file has %d of its %d entries", len(lut.Table)/3, lut.Size*lut.Size*lut.Size)
+	}
+	for c := 0; c < 3; c++ {
+		if !(lut.DomainMin[c] < lut.DomainMax[c]) {
+			return nil, fmt.Errorf("png: the .cube domain is empty")
+		}
+	}
+	return lut, nil
+}
+
+// parseCubeFloats parses the numbers of a .cube line
+func parseCubeFloats(fields []string) ([]float64, error) {
+	values := make([]float64, len(fields))
+	for i, f := range fields {
+		v, err := strconv.ParseFloat(f, 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("invalid number %q", f)
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+// Every .cube file is parsed once per run: the tasks of a run often share their LUTs
+var (
+	cubeMu  sync.Mutex
+	cubeLUT = map[string]*LUT3D{}
+)
+
+// LoadCube reads a .cube file, caching the LUT by path
+func LoadCube(path string) (*LUT3D, error) {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	cubeMu.Lock()
+	defer cubeMu.Unlock()
+	if lut, ok := cubeLUT[path]; ok {
+		return lut, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	lut, err := ParseCube(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	cubeLUT[path] = lut
+	return lut, nil
+}
+
+// lookup maps a straight color from 0 to 1 through the LUT
+func (lut *LUT3D) lookup(c [3]float64, method LUTInterpolation) [3]float64 {
+	n := lut.Size
+	// the cell of the color and its position in the cell, per channel
+	var base [3]int
+	var frac [3]float64
+	for i := range c {
+		t := (c[i] - lut.DomainMin[i]) / (lut.DomainMax[i] - lut.DomainMin[i]) * float64(n-1)
+		t = math.Max(0, math.Min(float64(n-1), t))
+		base[i] = int(t)
+		if base[i] == n-1 {
+			base[i] = n - 2
+		}
+		frac[i] = t - float64(base[i])
+	}
+	stride := [3]int{3, 3 * n, 3 * n * n}
+	origin := base[0]*stride[0] + base[1]*stride[1] + base[2]*stride[2]
+	at := func(dr, dg, db int) []float64 {
+		i := origin + dr*stride[0] + dg*stride[1] + db*stride[2]
+		return lut.Table[i : i+3]
+	}
+
+	var out [3]float64
+	if method == LUTTetrahedral {
+		// the cube splits into 6 tetrahedra along its gray diagonal; walk from the black corner to the white one
+		// along the axes in decreasing order of the position in the cell
+		order := [3]int{0, 1, 2}
+		if frac[order[0]] < frac[order[1]] {
+			order[0], order[1] = order[1], order[0]
+		}
+		if frac[order[1]] < frac[order[2]] {
+			order[1], order[2] = order[2], order[1]
+		}
+		if frac[order[0]] < frac[order[1]] {
+			order[0], order[1] = order[1], order[0]
+		}
+		var corner [3]int
+		black := at(0, 0, 0)
+		weights := [4]float64{1 - frac[order[0]], frac[order[0]] - frac[order[1]], frac[order[1]] - frac[order[2]], frac[order[2]]}
+		for c := range out {
+			out[c] = weights[0] * black[c]
+		}
+		for k, axis := range order {
+			corner[axis] = 1
+			v := at(corner[0], corner[1], corner[2])
+			for c := range out {
+				out[c] += weights[k+1] * v[c]
+			}
+		}
+		return out
+	}
+	for db := 0; db < 2; db++ {
+		wb := 1 - frac[2]
+		if db == 1 {
+			wb = frac[2]
+		}
+		for dg := 0; dg < 2; dg++ {
+			wg := 1 - frac[1]
+			if dg == 1 {
+				wg = frac[1]
+			}
+			for dr := 0; dr < 2; dr++ {
+				wr := 1 - frac[0]
+				if dr == 1 {
+					wr = frac[0]
+				}
+				v := at(dr, dg, db)
+				w := wr * wg * wb
+				out[0] += w * v[0]
+				out[1] += w * v[1]
+				out[2] += w * v[2]
+			}
+		}
+	}
+	return out
+}
+
+// ApplyLUT grades the image with a 3D LUT
+func (img *Image) ApplyLUT(lut *LUT3D, method LUTInterpolation) {
+	img.applyRows(lutEffect{lut, method}, 1)
+}
+
+// BSPApplyLUT parallelly grades the image with a 3D LUT, in a single superstep
+// The LUT maps the straight colors as they are in the buffers, so with "linear" it is applied in linear light,
+// and every pixel keeps its alpha
+func (img *Image) BSPApplyLUT(lut *LUT3D, method LUTInterpolation, numThreads int) {
+	img.applyRows(lutEffect{lut, method}, numThreads)
+}
+
+// lutEffect is the effect of a 3D LUT
+type lutEffect struct {
+	lut    *LUT3D
+	method LUTInterpolation
+}
+
+func (e lutEffect) Info() EffectInfo                          { return EffectInfo{Pointwise: true, KeepsAlpha: true} }
+func (e lutEffect) Bounds(in image.Rectangle) image.Rectangle { return in }
+
+// Apply grades rows of in into out
+func (e lutEffect) Apply(in, out *image.RGBA64, rows Rows) {
+	bounds := in.Bounds()
+	for y := rows.Min; y < rows.Max; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := in.RGBA64At(x, y)
+			if c.A == 0 {
+				out.SetRGBA64(x, y, c)
+				continue
+			}
+			a := uint32(c.A)
+			graded := e.lut.lookup([3]float64{
+				float64(unpremultiply(uint32(c.R), a)) / 0xffff,
+				float64(unpremultiply(uint32(c.G), a)) / 0xffff,
+				float64(unpremultiply(uint32(c.B), a)) / 0xffff,
+			}, e.method)
+			r := unitChannel(graded[0]) * a / 0xffff
+			g := unitChannel(graded[1]) * a / 0xffff
+			b := unitChannel(graded[2]) * a / 0xffff
+			out.SetRGBA64(x, y, color.RGBA64{uint16(r), uint16(g), uint16(b), c.A})
+		}
+	}
+}
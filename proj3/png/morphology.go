@@ -0,0 +1,371 @@
+// Package png allows for loading png images and applying image flitering effects on them
+// Morphological operators: erosion, dilation and the operators built from them
+// https://en.wikipedia.org/wiki/Mathematical_morphology
+// M. van Herk, "A fast algorithm for local minimum and maximum filters on rectangular and octagonal kernels", 1992
+// J. Gil, M. Werman, "Computing 2-D min, median, and max filters", 1993
+package png
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// StructuringElement is the shape of the neighborhood of the morphological operators
+type StructuringElement string
+
+const (
+	ElementSquare StructuringElement = "square" // (2 Radius+1)^2 pixels
+	ElementCross  StructuringElement = "cross"  // the center row and column of the square
+	ElementDisk   StructuringElement = "disk"   // the pixels within Radius of the center
+)
+
+// ParseStructuringElement validates a structuring element; the empty string selects ElementSquare
+func ParseStructuringElement(s string) (StructuringElement, error) {
+	switch e := StructuringElement(s); e {
+	case "":
+		return ElementSquare, nil
+	case ElementSquare, ElementCross, ElementDisk:
+		return e, nil
+	}
+	return "", fmt.Errorf("png: unknown structuring element %q", s)
+}
+
+// MorphOp is a morphological operator
+type MorphOp string
+
+const (
+	Erode     MorphOp = "erode"     // minimum over the element
+	Dilate    MorphOp = "dilate"    // maximum over the element
+	Open      MorphOp = "open"      // erosion then dilation: removes bright specks smaller than the element
+	Close     MorphOp = "close"     // dilation then erosion: fills dark holes smaller than the element
+	TopHat    MorphOp = "tophat"    // the image minus its opening: the bright details
+	BlackHat  MorphOp = "blackhat"  // the closing minus the image: the dark details
+	MorphEdge MorphOp = "morphedge" // the dilation minus the erosion: the outlines
+)
+
+// ParseMorphOp validates the name of a morphological operator
+func ParseMorphOp(s string) (MorphOp, error) {
+	switch op := MorphOp(s); op {
+	case Erode, Dilate, Open, Close, TopHat, BlackHat, MorphEdge:
+		return op, nil
+	}
+	return "", fmt.Errorf("png: unknown morphological operator %q", s)
+}
+
+// Morphology applies Op with a structuring element of the given shape and radius to every channel
+// Border picks the pixels outside the image, like for the convolutions (see border.go)
+type Morphology struct {
+	Op      MorphOp
+	Element StructuringElement
+	Radius  int
+	Border  BorderMode
+}
+
+// vhgwRadius is the smallest radius for which the van Herk/Gil-Werman algorithm beats scanning the window
+const vhgwRadius = 3
+
+// extreme returns the minimum of a and b, or their maximum when dilating
+func extreme(a, b uint16, dilate bool) uint16 {
+	if (a < b) != dilate {
+		return a
+	}
+	return b
+}
+
+// lineExtreme writes to out[i] the extreme of the 2r+1 values in[i : i+2r+1], so len(in) is len(out)+2r
+// From vhgwRadius on it uses the van Herk/Gil-Werman algorithm: in is cut into blocks of one window,
+// and every window, which spans at most two blocks, is the suffix extreme of its first block combined with
+// the prefix extreme of the second one, that is 3 comparisons per value whatever the window size
+// scratch holds at least 2 len(in) values
+func lineExtreme(out, in []uint16, r int, dilate bool, scratch []uint16) {
+	k := 2*r + 1
+	if r < vhgwRadius {
+		for i := range out {
+			v := in[i]
+			for _, u := range in[i+1 : i+k] {
+				v = extreme(v, u, dilate)
+			}
+			out[i] = v
+		}
+		return
+	}
+	n := len(in)
+	prefix, suffix := scratch[:n], scratch[n:2*n]
+	for start := 0; start < n; start += k {
+		end := start + k
+		if end > n {
+			end = n
+		}
+		prefix[start] = in[start]
+		for i := start + 1; i < end; i++ {
+			prefix[i] = extreme(prefix[i-1], in[i], dilate)
+		}
+		suffix[end-1] = in[end-1]
+		for i := end - 2; i >= start; i-- {
+			suffix[i] = extreme(suffix[i+1], in[i], dilate)
+		}
+	}
+	for i := range out {
+		out[i] = extreme(suffix[i], prefix[i+k-1], dilate)
+	}
+}
+
+// halfWidths returns the half width of the row of the element at each offset from -Radius to Radius
+func (m Morphology) halfWidths() []int {
+	r := m.Radius
+	w := make([]int, 2*r+1)
+	for dy := -r; dy <= r; dy++ {
+		switch m.Element {
+		case ElementCross:
+			if dy == 0 {
+				w[dy+r] = r
+			}
+		case ElementDisk:
+			w[dy+r] = int(math.Floor(math.Sqrt(float64(r*r - dy*dy))))
+		default:
+			w[dy+r] = r
+		}
+	}
+	return w
+}
+
+// morphPlanes are the channels the operators work on, each a row-major plane of the image
+type morphPlanes [][]uint16
+
+// morphology runs the operators of m on the planes of one image
+type morphology struct {
+	Morphology
+	width, height int
+	numThreads    int
+}
+
+// padRow fills line with row y of a plane (line[0] is column -pad), standing in pixels outside the image
+// through the border mode; a y of -1 is a row of zero padding
+func (m *morphology) padRow(line, plane []uint16, y, pad int) {
+	for i := range line {
+		x := m.Border.index(i-pad, m.width)
+		if x < 0 || y < 0 {
+			line[i] = 0
+			continue
+		}
+		line[i] = plane[y*m.width+x]
+	}
+}
+
+// extreme returns the erosion (or the dilation) of the planes
+// A square is separable: a horizontal pass over the rows and a vertical pass over the columns, one superstep each
+// The other elements take the extreme of one horizontal run per row of the element, in a single superstep
+func (m *morphology) extreme(src morphPlanes, dilate bool) morphPlanes {
+	width, height, r := m.width, m.height, m.Radius
+	dst := make(morphPlanes, len(src))
+	for c := range dst {
+		dst[c] = make([]uint16, width*height)
+	}
+	rows := image.Rect(0, 0, width, height)
+
+	if m.Element == ElementSquare || m.Element == "" {
+		tmp := make(morphPlanes, len(src))
+		for c := range tmp {
+			tmp[c] = make([]uint16, width*height)
+		}
+		bspSlices(rows, m.numThreads, func(startY, endY int) {
+			line, scratch := make([]uint16, width+2*r), make([]uint16, 2*(width+2*r))
+			for c := range src {
+				for y := startY; y < endY; y++ {
+					m.padRow(line, src[c], y, r)
+					lineExtreme(tmp[c][y*width:(y+1)*width], line, r, dilate, scratch)
+				}
+			}
+		})
+		bspSlices(rows, m.numThreads, func(startY, endY int) {
+			n := endY - startY
+			column, out, scratch := make([]uint16, n+2*r), make([]uint16, n), make([]uint16, 2*(n+2*r))
+			for c := range src {
+				for x := 0; x < width; x++ {
+					for i := range column {
+						y := m.Border.index(startY-r+i, height)
+						if y < 0 {
+							column[i] = 0
+							continue
+						}
+						column[i] = tmp[c][y*width+x]
+					}
+					lineExtreme(out, column, r, dilate, scratch)
+					for i, v := range out {
+						dst[c][(startY+i)*width+x] = v
+					}
+				}
+			}
+		})
+	} else {
+		halfWidths := m.halfWidths()
+		bspSlices(rows, m.numThreads, func(startY, endY int) {
+			line, run, scratch := make([]uint16, width+2*r), make([]uint16, width), make([]uint16, 2*(width+2*r))
+			for c := range src {
+				for y := startY; y < endY; y++ {
+					out := dst[c][y*width : (y+1)*width]
+					for dy := -r; dy <= r; dy++ {
+						w := halfWidths[dy+r]
+						m.padRow(line[:width+2*w], src[c], m.Border.index(y+dy, height), w)
+						lineExtreme(run, line[:width+2*w], w, dilate, scratch)
+						if dy == -r {
+							copy(out, run)
+							continue
+						}
+						for x, v := range run {
+							out[x] = extreme(out[x], v, dilate)
+						}
+					}
+				}
+			}
+		})
+	}
+
+	if m.Border == BorderValid {
+		// pixels whose element leaves the image keep their value
+		for c := range dst {
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					if x < r || x >= width-r || y < r || y >= height-r {
+						dst[c][y*width+x] = src[c][y*width+x]
+					}
+				}
+			}
+		}
+	}
+	return dst
+}
+
+// Morphology applies a morphological operator to the image
+func (img *Image) Morphology(m Morphology) {
+	img.BSPMorphology(m, 1)
+}
+
+// BSPMorphology parallelly applies a morphological operator to the image
+// Like the rank filters, the alpha mode selects the channels: AlphaIgnore keeps the alpha of every pixel,
+// AlphaStraight works on the straight colors and AlphaPremultiplied on the premultiplied ones
+// Op must be one of the operators above, which ParseMorphOp checks
+func (img *Image) BSPMorphology(m Morphology, numThreads int) {
+	img.applyRows(&morphEffect{rowImage: img.rowImage(), m: m}, numThreads)
+}
+
+// morphEffect is the effect of a morphological operator
+// Every slice runs the erosions and dilations on the rows within the halo of its own (see bandView), in a single
+// superstep; with the wrap border Prepare runs them on the whole image, each in one or two supersteps
+type morphEffect struct {
+	rowImage
+	m        Morphology
+	result   morphPlanes // the output planes, minus subtract for the top-hat, black-hat and edge operators
+	subtract morphPlanes
+	top      int // the first row of the planes
+}
+
+func (e *morphEffect) Info() EffectInfo {
+	halo := e.m.Radius
+	switch e.m.Op {
+	case Open, Close, TopHat, BlackHat:
+		halo *= 2 // two operators in a row
+	}
+	return EffectInfo{Halo: borderHalo(halo, e.m.Border), KeepsAlpha: e.alpha == AlphaIgnore || e.alpha == ""}
+}
+
+// channels returns the number of planes the operators work on: the alpha only takes part in the straight and
+// premultiplied modes
+func (e *morphEffect) channels() int {
+	if e.alpha == AlphaIgnore || e.alpha == "" {
+		return 3
+	}
+	return 4
+}
+
+// Prepare runs the operators on the whole image when the wrap border makes every row read the far edge
+func (e *morphEffect) Prepare(in *image.RGBA64, numThreads int) {
+	if e.m.Border == BorderWrap {
+		e.result, e.subtract = e.planes(e.view(in, nil), numThreads)
+		e.top = e.bounds.Min.Y
+	}
+}
+
+// planes splits In into channel planes, one superstep, and runs the operators on them
+func (e *morphEffect) planes(img *Image, numThreads int) (result, subtract morphPlanes) {
+	bounds := img.Bounds
+	width, height := bounds.Dx(), bounds.Dy()
+	src := make(morphPlanes, e.channels())
+	for c := range src {
+		src[c] = make([]uint16, width*height)
+	}
+	img.bspRows(numThreads, func(startY, endY int) {
+		for y := startY; y < endY; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				p := img.In.RGBA64At(x, y)
+				if e.alpha == AlphaStraight {
+					a := uint32(p.A)
+					p.R = uint16(unpremultiply(uint32(p.R), a))
+					p.G = uint16(unpremultiply(uint32(p.G), a))
+					p.B = uint16(unpremultiply(uint32(p.B), a))
+				}
+				i := (y-bounds.Min.Y)*width + x - bounds.Min.X
+				v := [4]uint16{p.R, p.G, p.B, p.A}
+				for c := range src {
+					src[c][i] = v[c]
+				}
+			}
+		}
+	})
+
+	op := &morphology{Morphology: e.m, width: width, height: height, numThreads: numThreads}
+	switch e.m.Op {
+	case Erode:
+		result = op.extreme(src, false)
+	case Dilate:
+		result = op.extreme(src, true)
+	case Open:
+		result = op.extreme(op.extreme(src, false), true)
+	case Close:
+		result = op.extreme(op.extreme(src, true), false)
+	case TopHat:
+		result, subtract = src, op.extreme(op.extreme(src, false), true)
+	case BlackHat:
+		result, subtract = op.extreme(op.extreme(src, true), false), src
+	case MorphEdge:
+		result, subtract = op.extreme(src, true), op.extreme(src, false)
+	}
+	return result, subtract
+}
+
+// Apply writes rows of the result to out
+func (e *morphEffect) Apply(in, out *image.RGBA64, rows Rows) {
+	result, subtract, top := e.result, e.subtract, e.top
+	if result == nil {
+		band := e.bandView(in, nil, rows, e.Info().Halo)
+		result, subtract = e.planes(band, 1)
+		top = band.Bounds.Min.Y
+	}
+	bounds := e.bounds
+	width, channels := bounds.Dx(), e.channels()
+	for y := rows.Min; y < rows.Max; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			i := (y-top)*width + x - bounds.Min.X
+			var v [4]uint16
+			for c := 0; c < channels; c++ {
+				v[c] = result[c][i]
+				if subtract != nil {
+					v[c] -= minUint16(v[c], subtract[c][i])
+				}
+			}
+			alpha := in.RGBA64At(x, y).A
+			if channels == 3 {
+				out.SetRGBA64(x, y, color.RGBA64{v[0], v[1], v[2], alpha})
+				continue
+			}
+			if subtract != nil {
+				// a difference of the alpha would make most of the image transparent
+				v[3] = alpha
+			}
+			r, g, b, a := finishAlpha(e.alpha, float64(v[0]), float64(v[1]), float64(v[2]), float64(v[3]))
+			out.SetRGBA64(x, y, color.RGBA64{r, g, b, a})
+		}
+	}
+}
@@ -0,0 +1,349 @@
+// Package png allows for loading png images and applying image flitering effects on them
+// Netpbm codec: PBM (P1/P4), PGM (P2/P5), PPM (P3/P6) and PAM (P7), with 8 and 16 bit samples
+// Format reference: https://netpbm.sourceforge.net/doc/
+package png
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// netpbmReader tokenizes the whitespace separated headers and ASCII rasters of Netpbm files
+type netpbmReader struct {
+	r *bufio.Reader
+}
+
+// token returns the next whitespace delimited word, skipping '#' comments
+func (nr *netpbmReader) token() (string, error) {
+	var sb strings.Builder
+	for {
+		c, err := nr.r.ReadByte()
+		if err != nil {
+			if err == io.EOF && sb.Len() > 0 {
+				return sb.String(), nil
+			}
+			return "", err
+		}
+		switch {
+		case c == '#':
+			if _, err := nr.r.ReadString('\n'); err != nil && err != io.EOF {
+				return "", err
+			}
+			if sb.Len() > 0 {
+				return sb.String(), nil
+			}
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f':
+			if sb.Len() > 0 {
+				return sb.String(), nil
+			}
+		default:
+			sb.WriteByte(c)
+		}
+	}
+}
+
+func (nr *netpbmReader) int() (int, error) {
+	tok, err := nr.token()
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.Atoi(tok)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("netpbm: invalid number %q", tok)
+	}
+	return v, nil
+}
+
+// bit reads one digit of a P1 raster, where digits may or may not be separated by whitespace
+func (nr *netpbmReader) bit() (int, error) {
+	for {
+		c, err := nr.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch c {
+		case '0', '1':
+			return int(c - '0'), nil
+		case '#':
+			if _, err := nr.r.ReadString('\n'); err != nil {
+				return 0, err
+			}
+		case ' ', '\t', '\n', '\r', '\v', '\f':
+		default:
+			return 0, fmt.Errorf("netpbm: invalid bit %q", c)
+		}
+	}
+}
+
+// decodeNetpbm reads any Netpbm image into a straight-alpha NRGBA64 image
+func decodeNetpbm(r io.Reader) (image.Image, error) {
+	nr := &netpbmReader{r: bufio.NewReader(r)}
+	magic, err := nr.token()
+	if err != nil {
+		return nil, err
+	}
+	if magic == "P7" {
+		return nr.decodePAM()
+	}
+
+	var width, height int
+	if width, err = nr.int(); err != nil {
+		return nil, err
+	}
+	if height, err = nr.int(); err != nil {
+		return nil, err
+	}
+	maxval := 1
+	if magic != "P1" && magic != "P4" {
+		if maxval, err = nr.int(); err != nil {
+			return nil, err
+		}
+	}
+	if width == 0 || height == 0 || maxval == 0 || maxval > 65535 {
+		return nil, errors.New("netpbm: invalid header")
+	}
+	img := image.NewNRGBA64(image.Rect(0, 0, width, height))
+
+	switch magic {
+	case "P1":
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				b, err := nr.bit()
+				if err != nil {
+					return nil, err
+				}
+				img.SetNRGBA64(x, y, bitColor(b))
+			}
+		}
+	case "P2", "P3":
+		channels := 1
+		if magic == "P3" {
+			channels = 3
+		}
+		var s [3]uint16
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				for c := 0; c < channels; c++ {
+					v, err := nr.int()
+					if err != nil {
+						return nil, err
+					}
+					s[c] = scaleSample(v, maxval)
+				}
+				if channels == 1 {
+					s[1], s[2] = s[0], s[0]
+				}
+				img.SetNRGBA64(x, y, color.NRGBA64{s[0], s[1], s[2], 0xffff})
+			}
+		}
+	case "P4":
+		// the single whitespace after the header has already been consumed by token()
+		row := make([]byte, (width+7)/8)
+		for y := 0; y < height; y++ {
+			if _, err := io.ReadFull(nr.r, row); err != nil {
+				return nil, err
+			}
+			for x := 0; x < width; x++ {
+				img.SetNRGBA64(x, y, bitColor(int(row[x/8]>>(7-uint(x%8)))&1))
+			}
+		}
+	case "P5", "P6":
+		channels := 1
+		if magic == "P6" {
+			channels = 3
+		}
+		if err := nr.readRaster(img, channels, maxval, false); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("netpbm: unsupported magic number %q", magic)
+	}
+	return img, nil
+}
+
+// decodePAM reads the header lines of a P7 file followed by its binary raster
+func (nr *netpbmReader) decodePAM() (image.Image, error) {
+	var width, height, depth, maxval int
+	tupleType := ""
+	for {
+		key, err := nr.token()
+		if err != nil {
+			return nil, err
+		}
+		if key == "ENDHDR" {
+			break
+		}
+		if key == "TUPLTYPE" {
+			if tupleType, err = nr.token(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		v, err := nr.int()
+		if err != nil {
+			return nil, err
+		}
+		switch key {
+		case "WIDTH":
+			width = v
+		case "HEIGHT":
+			height = v
+		case "DEPTH":
+			depth = v
+		case "MAXVAL":
+			maxval = v
+		default:
+			return nil, fmt.Errorf("netpbm: unknown PAM header %q", key)
+		}
+	}
+	if width == 0 || height == 0 || maxval == 0 || maxval > 65535 || depth < 1 || depth > 4 {
+		return nil, errors.New("netpbm: invalid PAM header")
+	}
+	hasAlpha := strings.HasSuffix(tupleType, "_ALPHA") || depth == 2 || depth == 4
+
+	img := image.NewNRGBA64(image.Rect(0, 0, width, height))
+	if err := nr.readRaster(img, depth, maxval, hasAlpha); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// readRaster reads binary samples of 1 byte (maxval < 256) or 2 big-endian bytes per channel;
+// channels 1 and 2 are gray, 3 and 4 are RGB, and the last channel is alpha when hasAlpha is set
+func (nr *netpbmReader) readRaster(img *image.NRGBA64, channels, maxval int, hasAlpha bool) error {
+	bounds := img.Bounds()
+	sampleBytes := 1
+	if maxval > 255 {
+		sampleBytes = 2
+	}
+	row := make([]byte, bounds.Dx()*channels*sampleBytes)
+	s := make([]uint16, channels)
+	colorChannels := channels
+	if hasAlpha {
+		colorChannels--
+	}
+	for y := 0; y < bounds.Dy(); y++ {
+		if _, err := io.ReadFull(nr.r, row); err != nil {
+			return err
+		}
+		for x := 0; x < bounds.Dx(); x++ {
+			for c := 0; c < channels; c++ {
+				i := (x*channels + c) * sampleBytes
+				v := int(row[i])
+				if sampleBytes == 2 {
+					v = v<<8 | int(row[i+1])
+				}
+				s[c] = scaleSample(v, maxval)
+			}
+			px := color.NRGBA64{s[0], s[0], s[0], 0xffff}
+			if colorChannels >= 3 {
+				px.G, px.B = s[1], s[2]
+			}
+			if hasAlpha {
+				px.A = s[channels-1]
+			}
+			img.SetNRGBA64(x, y, px)
+		}
+	}
+	return nil
+}
+
+// scaleSample maps a sample in [0, maxval] to [0, 65535]
+func scaleSample(v, maxval int) uint16 {
+	if v > maxval {
+		v = maxval
+	}
+	return uint16((v*65535 + maxval/2) / maxval)
+}
+
+// bitColor maps a PBM bit to a color; in PBM 1 is black
+func bitColor(b int) color.NRGBA64 {
+	if b == 1 {
+		return color.NRGBA64{0, 0, 0, 0xffff}
+	}
+	return color.NRGBA64{0xffff, 0xffff, 0xffff, 0xffff}
+}
+
+// encodeNetpbm writes a binary Netpbm file whose variant is selected by the extension:
+// .pbm (P4), .pgm (P5), .ppm/.pnm (P6) or .pam (P7); depth is 8 (default) or 16 bits per sample
+func encodeNetpbm(w io.Writer, img *image.RGBA64, ext string, depth int) error {
+	if depth == 0 {
+		depth = 8
+	}
+	if depth != 8 && depth != 16 {
+		return fmt.Errorf("netpbm: unsupported depth %d", depth)
+	}
+	maxval := 1<<uint(depth) - 1
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	bw := bufio.NewWriter(w)
+
+	var channels int
+	switch ext {
+	case ".pbm":
+		fmt.Fprintf(bw, "P4\n%d %d\n", width, height)
+		row := make([]byte, (width+7)/8)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for i := range row {
+				row[i] = 0
+			}
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				g := color.Gray16Model.Convert(img.RGBA64At(x, y)).(color.Gray16)
+				if g.Y < 0x8000 {
+					i := x - bounds.Min.X
+					row[i/8] |= 1 << (7 - uint(i%8))
+				}
+			}
+			if _, err := bw.Write(row); err != nil {
+				return err
+			}
+		}
+		return bw.Flush()
+	case ".pgm":
+		channels = 1
+		fmt.Fprintf(bw, "P5\n%d %d\n%d\n", width, height, maxval)
+	case ".pam":
+		channels = 4
+		fmt.Fprintf(bw, "P7\nWIDTH %d\nHEIGHT %d\nDEPTH 4\nMAXVAL %d\nTUPLTYPE RGB_ALPHA\nENDHDR\n", width, height, maxval)
+	default:
+		channels = 3
+		fmt.Fprintf(bw, "P6\n%d %d\n%d\n", width, height, maxval)
+	}
+
+	sampleBytes := depth / 8
+	row := make([]byte, width*channels*sampleBytes)
+	s := make([]uint16, 4)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			switch channels {
+			case 1:
+				s[0] = color.Gray16Model.Convert(img.RGBA64At(x, y)).(color.Gray16).Y
+			case 3:
+				c := img.RGBA64At(x, y)
+				s[0], s[1], s[2] = c.R, c.G, c.B
+			case 4:
+				// PAM alpha is straight, not premultiplied
+				c := color.NRGBA64Model.Convert(img.RGBA64At(x, y)).(color.NRGBA64)
+				s[0], s[1], s[2], s[3] = c.R, c.G, c.B, c.A
+			}
+			for c := 0; c < channels; c++ {
+				i := ((x-bounds.Min.X)*channels + c) * sampleBytes
+				if sampleBytes == 2 {
+					row[i], row[i+1] = uint8(s[c]>>8), uint8(s[c])
+				} else {
+					row[i] = uint8(s[c] >> 8)
+				}
+			}
+		}
+		if _, err := bw.Write(row); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
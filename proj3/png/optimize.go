@@ -0,0 +1,206 @@
+// Package png allows for loading png images and applying image flitering effects on them
+// Effect-list optimizer: rewrites the effects of a task into the passes that run over the image
+package png
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Optimization selects how far Optimize may rewrite an effect list
+type Optimization string
+
+const (
+	// OptimizeExact runs every effect as written, in a pass of its own (default)
+	OptimizeExact Optimization = "exact"
+	// OptimizeSafe fuses consecutive adjustments into one pass and moves weighted grayscales ahead of the blurs
+	// before them; the results differ from the exact ones by rounding only
+	OptimizeSafe Optimization = "safe"
+	// OptimizeUnclamped also fuses consecutive convolutions into one larger kernel and moves weighted grayscales
+	// ahead of any convolution: intermediate results are neither clamped nor rounded, so the output differs wherever
+	// an intermediate value left the range of a channel
+	// Fused kernels are not exact at the borders either, but for the wrap border: the border mode pads the input of the
+	// fused kernel, while the second convolution would have seen the first one's output padded (see fuseKernels)
+	OptimizeUnclamped Optimization = "unclamped"
+)
+
+// ParseOptimization validates the "optimize" value of an ImageTask; the empty string selects OptimizeExact, so that
+// effect lists are only rewritten when a task or the editor asks for it
+func ParseOptimization(s string) (Optimization, error) {
+	switch Optimization(s) {
+	case "":
+		return OptimizeExact, nil
+	case OptimizeExact, OptimizeSafe, OptimizeUnclamped:
+		return Optimization(s), nil
+	}
+	return "", fmt.Errorf("png: unknown optimization %q", s)
+}
+
+// Pass is one pass over the image: a single effect, or the effects fused into it
+// A run of adjustments is applied as one lookup (see adjust.go), and a run of convolutions as one kernel
+type Pass struct {
+	Effects   []EffectSpec
+	GrayInput bool    // the input of the pass is gray, so a convolution only convolves one color channel
+	kernel    *Kernel // the kernel of fused convolutions
+}
+
+// Kernel returns the kernel of a convolution pass
+func (p Pass) Kernel() Kernel {
+	var k Kernel
+	if p.kernel != nil {
+		k = *p.kernel
+	} else {
+		k = p.Effects[0].ConvolutionKernel()
+	}
+	k.Gray = p.GrayInput
+	return k
+}
+
+// Optimize rewrites validated effects into the passes that apply them, for images whose convolutions run in the
+// given alpha mode, and reports every rewrite in a line of its own
+func Optimize(effects []EffectSpec, opt Optimization, alpha AlphaMode) ([]Pass, []string) {
+	if opt == OptimizeExact {
+		passes := make([]Pass, len(effects))
+		for i := range effects {
+			passes[i] = Pass{Effects: effects[i : i+1]}
+		}
+		return passes, nil
+	}
+	var report []string
+	effects = append([]EffectSpec(nil), effects...)
+
+	// a weighted gray level of a convolution is the convolution of the gray level, which convolves one channel only
+	for i := 1; i < len(effects); i++ {
+		gray := effects[i]
+		if gray.Name != "G" || !gray.GrayMethod().weighted() {
+			continue
+		}
+		start := i
+		for start > 0 && commutesWithGray(effects[start-1], opt) {
+			start--
+		}
+		if start < i {
+			report = append(report, fmt.Sprintf("moved G ahead of %s", effectNames(effects[start:i])))
+			copy(effects[start+1:i+1], effects[start:i])
+			effects[start] = gray
+		}
+	}
+
+	var passes []Pass
+	for i := 0; i < len(effects); i++ {
+		e := effects[i]
+		switch {
+		case e.Adjustment():
+			end := AdjustmentRun(effects, i)
+			if end-i > 1 {
+				report = append(report, fmt.Sprintf("fused %s into one lookup pass", effectNames(effects[i:end])))
+			}
+			passes = append(passes, Pass{Effects: effects[i:end]})
+			i = end - 1
+		case e.convolution() && opt == OptimizeUnclamped && alpha != AlphaStraight:
+			// straight colors are divided by alpha before every convolution, which no single kernel can do
+			kernel := e.ConvolutionKernel()
+			end := i + 1
+			for ; end < len(effects) && effects[end].convolution() && kernel.Border != BorderValid; end++ {
+				next := effects[end].ConvolutionKernel()
+				if next.Border != kernel.Border {
+					break
+				}
+				kernel = fuseKernels(kernel, next)
+			}
+			pass := Pass{Effects: effects[i:end]}
+			if end-i > 1 {
+				report = append(report, fmt.Sprintf("fused %s into a %dx%d kernel", effectNames(pass.Effects), kernel.Width, kernel.Height))
+				pass.kernel = &kernel
+			}
+			passes = append(passes, pass)
+			i = end - 1
+		default:
+			passes = append(passes, Pass{Effects: effects[i : i+1]})
+		}
+	}
+
+	// grayscale output stays gray through convolutions
+	gray := false
+	for i := range passes {
+		switch e := passes[i].Effects[0]; {
+		case e.Name == "G":
+			gray = true
+		case e.convolution():
+			if gray {
+				passes[i].GrayInput = true
+				report = append(report, fmt.Sprintf("%s convolves one channel of the gray image", effectNames(passes[i].Effects)))
+			}
+		default:
+			gray = false
+		}
+	}
+	return passes, report
+}
+
+// commutesWithGray reports whether a weighted grayscale may move ahead of the effect
+// Blurs (nonnegative kernels summing to at most 1, without bias) never need clamping, so the grayscale changes
+// their result by rounding only; other convolutions only move when their intermediate values need not be clamped
+func commutesWithGray(e EffectSpec, opt Optimization) bool {
+	if !e.convolution() {
+		return false
+	}
+	if opt == OptimizeUnclamped {
+		return true
+	}
+	k := e.ConvolutionKernel()
+	scale := kernelScale(k)
+	if scale < 0 || k.Bias != 0 {
+		return false
+	}
+	for _, v := range k.Values {
+		if v < 0 {
+			return false
+		}
+	}
+	return k.Sum()*scale <= 1+1e-9
+}
+
+// kernelScale returns the factor the convolution sums are multiplied by
+func kernelScale(k Kernel) float64 {
+	if k.Scale == 0 {
+		return 1
+	}
+	return k.Scale
+}
+
+// fuseKernels returns the kernel of a convolution with a followed by one with b, without clamping in between:
+// b(a(x)) sums a(d) b(e) x(p+d+e) over all offsets d and e, so the fused kernel is the full convolution of the two
+// and the bias of a goes through b
+// That holds inside the image only: within the halo of b of the borders, b would read a's output padded by the
+// border mode, and the fused kernel reads a's output of the padded input instead, which is the same for wrap only
+func fuseKernels(a, b Kernel) Kernel {
+	sa, sb := kernelScale(a), kernelScale(b)
+	k := Kernel{Width: a.Width + b.Width - 1, Height: a.Height + b.Height - 1, Scale: 1, Border: a.Border}
+	k.Values = make([]float64, k.Width*k.Height)
+	for ay := 0; ay < a.Height; ay++ {
+		for ax := 0; ax < a.Width; ax++ {
+			va := a.Values[ay*a.Width+ax] * sa
+			if va == 0 {
+				continue
+			}
+			for by := 0; by < b.Height; by++ {
+				row := k.Values[(ay+by)*k.Width+ax:]
+				for bx, vb := range b.Values[by*b.Width : (by+1)*b.Width] {
+					row[bx] += va * vb * sb
+				}
+			}
+		}
+	}
+	k.Bias = b.Bias + a.Bias*b.Sum()*sb
+	return k
+}
+
+// effectNames lists the names of effects for the optimizer report
+func effectNames(effects []EffectSpec) string {
+	names := make([]string, len(effects))
+	for i, e := range effects {
+		names[i] = e.Name
+	}
+	return strings.Join(names, ", ")
+}
@@ -3,11 +3,14 @@
 package png
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"image"
 	"image/color"
-	"image/png"
+	"io"
 	"math"
 	"os"
+	"path/filepath"
 )
 
 // The Image represents a structure for working with PNG images.
@@ -15,18 +18,17 @@ import (
 type Image struct {
 	In             *image.RGBA64   //The original pixels before applying the effect (input buffer)
 	Out            *image.RGBA64   //The updated pixels after applying teh effect (output buffer)
-	Bounds         image.Rectangle //The size of the image
+	Bounds         image.Rectangle //The size of the input buffer; Out differs only while a geometric effect runs (see geometry.go)
 	EffectsApplied bool
-	Chunks         []ImageChunk
-}
-
-type ImageChunk struct {
-	In      *image.RGBA64
-	Out     *image.RGBA64
-	Bounds  image.Rectangle
-	Overlap int
-	YStart  int
-	YEnd    int
+	Format         string         // The format the image was decoded from (see format.go)
+	Quality        int            // JPEG quality in [1, 100] used by Save; 0 means the encoder default
+	Depth          int            // Bits per sample (8 or 16) used by Save for Netpbm output; 0 means 8
+	Ancillary      []Chunk        // Ancillary chunks of a PNG input, written back by Save (see chunks.go)
+	InputSHA256    string         // Hex SHA-256 of the input file
+	Provenance     *Provenance    // When set, Save records it in an iTXt chunk of a PNG output
+	AlphaMode      AlphaMode      // How convolution effects treat the alpha channel (see alpha.go)
+	Dir            string         // The directory the image was loaded from, where effects find their auxiliary files
+	linear         *transferCurve // Set while the pixels are in linear light (see linear.go)
 }
 
 type SubImager interface {
@@ -39,7 +41,7 @@ type SubImager interface {
 //
 
 // Load returns a Image that was loaded based on the filePath parameter
-// You are allowed to modify and update this as you wish
+// The format (PNG, JPEG, GIF, Netpbm or BMP) is detected from the magic bytes of the file
 func Load(filePath string) (*Image, error) {
 
 	inReader, err := os.Open(filePath)
@@ -49,11 +51,27 @@ func Load(filePath string) (*Image, error) {
 	}
 	defer inReader.Close()
 
-	inOrig, err := png.Decode(inReader)
+	// hash the file while it is being decoded, then hash whatever the decoder did not need
+	hash := sha256.New()
+	tee := io.TeeReader(inReader, hash)
+	inOrig, format, err := decode(tee)
 
 	if err != nil {
 		return nil, err
 	}
+	if _, err := io.Copy(io.Discard, tee); err != nil {
+		return nil, err
+	}
+
+	var ancillary []Chunk
+	if format == FormatPNG {
+		if _, err := inReader.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if ancillary, err = readAncillaryChunks(inReader); err != nil {
+			return nil, err
+		}
+	}
 
 	bounds := inOrig.Bounds()
 
@@ -71,11 +89,15 @@ func Load(filePath string) (*Image, error) {
 	task.Out = outImg
 	task.Bounds = bounds
 	task.EffectsApplied = false
+	task.Format = format
+	task.Ancillary = ancillary
+	task.InputSHA256 = hex.EncodeToString(hash.Sum(nil))
+	task.Dir = filepath.Dir(filePath)
 	return task, nil
 }
 
 // Save saves the image to the given file
-// You are allowed to modify and update this as you wish
+// The output format is picked from the file extension, falling back to PNG for unknown extensions
 func (img *Image) Save(filePath string) error {
 
 	// use pointer to avoid copying the entire image data when assigning to saveImg
@@ -94,7 +116,17 @@ func (img *Image) Save(filePath string) error {
 		saveImg = img.In
 	}
 
-	err = png.Encode(outWriter, saveImg)
+	// PNG outputs get the ancillary chunks of the input and the provenance inserted after IHDR
+	var w io.Writer = outWriter
+	if formatFromPath(filePath) == FormatPNG {
+		chunks, err := img.outputChunks()
+		if err != nil {
+			return err
+		}
+		w = &chunkInserter{w: outWriter, chunks: chunks}
+	}
+
+	err = img.encode(w, filePath, saveImg)
 	if err != nil {
 		return err
 	}
@@ -108,6 +140,12 @@ func clamp(comp float64) uint16 {
 }
 
 // avoid data copying
+// After a geometric effect the output has other bounds than the input: the new input then defines Bounds,
+// and the old input buffer is replaced by one of the new size so that the next effect can write to it
 func (img *Image) SwapBuffers() {
 	img.In, img.Out = img.Out, img.In
+	img.Bounds = img.In.Bounds()
+	if img.Out.Bounds() != img.Bounds {
+		img.Out = image.NewRGBA64(img.Bounds)
+	}
 }
@@ -0,0 +1,175 @@
+// Package png allows for loading png images and applying image flitering effects on them
+// QOI ("Quite OK Image") codec, a fast lossless 8-bit format for intermediate files
+// Format reference: https://qoiformat.org/qoi-specification.pdf
+package png
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+)
+
+const (
+	qoiMagic      = "qoif"
+	qoiHeaderSize = 14
+
+	qoiOpIndex = 0x00 // 00xxxxxx
+	qoiOpDiff  = 0x40 // 01xxxxxx
+	qoiOpLuma  = 0x80 // 10xxxxxx
+	qoiOpRun   = 0xc0 // 11xxxxxx
+	qoiOpRGB   = 0xfe
+	qoiOpRGBA  = 0xff
+	qoiMask2   = 0xc0
+
+	// refuse headers that would need more than 400 million pixels, like the reference decoder
+	qoiMaxPixels = 400000000
+)
+
+var qoiPadding = [8]byte{0, 0, 0, 0, 0, 0, 0, 1}
+
+func qoiHash(c color.NRGBA) int {
+	return (int(c.R)*3 + int(c.G)*5 + int(c.B)*7 + int(c.A)*11) % 64
+}
+
+// decodeQOI reads a QOI file into a straight-alpha NRGBA image
+func decodeQOI(r io.Reader) (image.Image, error) {
+	br := bufio.NewReader(r)
+	var header [qoiHeaderSize]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return nil, err
+	}
+	if string(header[:4]) != qoiMagic {
+		return nil, errors.New("qoi: not a QOI file")
+	}
+	width := int(binary.BigEndian.Uint32(header[4:8]))
+	height := int(binary.BigEndian.Uint32(header[8:12]))
+	channels := header[12]
+	if width == 0 || height == 0 || width > qoiMaxPixels/height || (channels != 3 && channels != 4) {
+		return nil, errors.New("qoi: invalid header")
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	var index [64]color.NRGBA
+	px := color.NRGBA{0, 0, 0, 255}
+	run := 0
+	for i := 0; i < len(img.Pix); i += 4 {
+		if run > 0 {
+			run--
+		} else {
+			b1, err := br.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case b1 == qoiOpRGB:
+				var v [3]byte
+				if _, err := io.ReadFull(br, v[:]); err != nil {
+					return nil, err
+				}
+				px.R, px.G, px.B = v[0], v[1], v[2]
+			case b1 == qoiOpRGBA:
+				var v [4]byte
+				if _, err := io.ReadFull(br, v[:]); err != nil {
+					return nil, err
+				}
+				px = color.NRGBA{v[0], v[1], v[2], v[3]}
+			case b1&qoiMask2 == qoiOpIndex:
+				px = index[b1]
+			case b1&qoiMask2 == qoiOpDiff:
+				px.R += (b1>>4)&0x03 - 2
+				px.G += (b1>>2)&0x03 - 2
+				px.B += b1&0x03 - 2
+			case b1&qoiMask2 == qoiOpLuma:
+				b2, err := br.ReadByte()
+				if err != nil {
+					return nil, err
+				}
+				vg := b1&0x3f - 32
+				px.R += vg - 8 + (b2>>4)&0x0f
+				px.G += vg
+				px.B += vg - 8 + b2&0x0f
+			case b1&qoiMask2 == qoiOpRun:
+				run = int(b1 & 0x3f)
+			}
+			index[qoiHash(px)] = px
+		}
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = px.R, px.G, px.B, px.A
+	}
+	return img, nil
+}
+
+// encodeQOI writes img as an 8-bit QOI file, with 3 channels when the image is opaque and 4 otherwise
+// QOI has no 16-bit mode, so every straight sample keeps its high byte, like color.NRGBAModel converts it
+func encodeQOI(w io.Writer, img *image.RGBA64) error {
+	bounds := img.Bounds()
+	channels := byte(4)
+	if img.Opaque() {
+		channels = 3
+	}
+
+	bw := bufio.NewWriterSize(w, 1<<16)
+	var header [qoiHeaderSize]byte
+	copy(header[:4], qoiMagic)
+	binary.BigEndian.PutUint32(header[4:8], uint32(bounds.Dx()))
+	binary.BigEndian.PutUint32(header[8:12], uint32(bounds.Dy()))
+	header[12] = channels
+	header[13] = 0 // sRGB with linear alpha
+	if _, err := bw.Write(header[:]); err != nil {
+		return err
+	}
+
+	var index [64]color.NRGBA
+	prev := color.NRGBA{0, 0, 0, 255}
+	run := 0
+	last := bounds.Dx()*bounds.Dy() - 1
+	i := 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x, i = x+1, i+1 {
+			px := color.NRGBAModel.Convert(img.RGBA64At(x, y)).(color.NRGBA)
+
+			if px == prev {
+				run++
+				if run == 62 || i == last {
+					bw.WriteByte(qoiOpRun | byte(run-1))
+					run = 0
+				}
+				continue
+			}
+			if run > 0 {
+				bw.WriteByte(qoiOpRun | byte(run-1))
+				run = 0
+			}
+
+			h := qoiHash(px)
+			switch {
+			case index[h] == px:
+				bw.WriteByte(qoiOpIndex | byte(h))
+			case px.A == prev.A:
+				index[h] = px
+				vr := int8(px.R - prev.R)
+				vg := int8(px.G - prev.G)
+				vb := int8(px.B - prev.B)
+				vgr, vgb := vr-vg, vb-vg
+				if vr > -3 && vr < 2 && vg > -3 && vg < 2 && vb > -3 && vb < 2 {
+					bw.WriteByte(qoiOpDiff | byte(vr+2)<<4 | byte(vg+2)<<2 | byte(vb+2))
+				} else if vgr > -9 && vgr < 8 && vg > -33 && vg < 32 && vgb > -9 && vgb < 8 {
+					bw.WriteByte(qoiOpLuma | byte(vg+32))
+					bw.WriteByte(byte(vgr+8)<<4 | byte(vgb+8))
+				} else {
+					bw.Write([]byte{qoiOpRGB, px.R, px.G, px.B})
+				}
+			default:
+				index[h] = px
+				bw.Write([]byte{qoiOpRGBA, px.R, px.G, px.B, px.A})
+			}
+			prev = px
+		}
+	}
+	if _, err := bw.Write(qoiPadding[:]); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
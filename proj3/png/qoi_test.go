@@ -0,0 +1,161 @@
+package png
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"path/filepath"
+	"testing"
+)
+
+// qoiOps counts the ops of an encoded QOI stream by their tag
+func qoiOps(t *testing.T, data []byte) map[byte]int {
+	t.Helper()
+	ops := map[byte]int{}
+	data = data[qoiHeaderSize : len(data)-len(qoiPadding)]
+	for i := 0; i < len(data); {
+		b := data[i]
+		switch {
+		case b == qoiOpRGB:
+			ops[qoiOpRGB]++
+			i += 4
+		case b == qoiOpRGBA:
+			ops[qoiOpRGBA]++
+			i += 5
+		case b&qoiMask2 == qoiOpLuma:
+			ops[qoiOpLuma]++
+			i += 2
+		default:
+			ops[b&qoiMask2]++
+			i++
+		}
+	}
+	return ops
+}
+
+// qoiImage returns an image whose rows take every op: a run longer than 62 pixels, two alternating colors that
+// hit the index, small steps for the diff op, medium steps for the luma op and large ones for the RGB op, which
+// take the RGBA op instead on the last row when alpha is set
+func qoiImage(width int, alpha bool) *image.RGBA64 {
+	img := image.NewRGBA64(image.Rect(0, 0, width, 5))
+	for x := 0; x < width; x++ {
+		c := [5]color.NRGBA{
+			{0, 0, 0, 255},
+			{200, 10, 10, 255},
+			{byte(x), byte(100 - x), byte(x), 255},
+			{byte(18 * x), byte(20 * x), byte(22 * x), 255},
+			{byte(97 * x), byte(45 * x), byte(13 * x), 255},
+		}
+		if x%2 == 1 {
+			c[1] = color.NRGBA{10, 200, 10, 255}
+		}
+		for y, p := range c {
+			if alpha && y > 1 {
+				p.A = 128
+			}
+			if alpha && y == 4 {
+				p.A = byte(255 - 3*x)
+			}
+			img.Set(x, y, p)
+		}
+	}
+	return img
+}
+
+func TestQOIOps(t *testing.T) {
+	for _, alpha := range []bool{false, true} {
+		var buf bytes.Buffer
+		if err := encodeQOI(&buf, qoiImage(80, alpha)); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+		channels := byte(3)
+		if alpha {
+			channels = 4
+		}
+		if data[12] != channels {
+			t.Errorf("alpha %v: the header has %d channels, want %d", alpha, data[12], channels)
+		}
+		ops := qoiOps(t, data)
+		tags := map[byte]string{qoiOpRun: "run", qoiOpIndex: "index", qoiOpDiff: "diff", qoiOpLuma: "luma", qoiOpRGB: "RGB"}
+		if alpha {
+			tags[qoiOpRGBA] = "RGBA"
+		}
+		for tag, name := range tags {
+			if ops[tag] == 0 {
+				t.Errorf("alpha %v: no %s op in the stream", alpha, name)
+			}
+		}
+		// the first row alone is a run of 80 pixels, which takes two ops
+		if ops[qoiOpRun] < 2 {
+			t.Errorf("alpha %v: %d run ops, want the first row split in two", alpha, ops[qoiOpRun])
+		}
+	}
+}
+
+func TestQOIRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	for _, alpha := range []bool{false, true} {
+		pixels := qoiImage(80, alpha)
+		// the pixels are stored premultiplied, which loses some of the 8 bits of a straight color at low alpha
+		want := image.NewRGBA64(pixels.Rect)
+		for y := 0; y < pixels.Rect.Dy(); y++ {
+			for x := 0; x < pixels.Rect.Dx(); x++ {
+				want.Set(x, y, color.NRGBAModel.Convert(pixels.At(x, y)))
+			}
+		}
+		// Save writes In before any effect, and Out after
+		for _, applied := range []bool{false, true} {
+			img := &Image{In: pixels, Out: pixels, Bounds: pixels.Rect, EffectsApplied: applied}
+			if applied {
+				img.In = image.NewRGBA64(pixels.Rect)
+			} else {
+				img.Out = image.NewRGBA64(pixels.Rect)
+			}
+			path := filepath.Join(dir, "round.qoi")
+			if err := img.Save(path); err != nil {
+				t.Fatal(err)
+			}
+			loaded, err := Load(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if loaded.Format != FormatQOI {
+				t.Errorf("the image is loaded as %s", loaded.Format)
+			}
+			samePixels(t, "round trip", want, loaded.In)
+		}
+	}
+}
+
+func TestQOITruncates16Bit(t *testing.T) {
+	pixels := image.NewRGBA64(image.Rect(0, 0, 3, 1))
+	pixels.SetRGBA64(0, 0, color.RGBA64{0x12ff, 0x3480, 0x5601, 0xffff})
+	pixels.SetRGBA64(1, 0, color.RGBA64{0xfe00, 0x00ff, 0x0100, 0xffff})
+	pixels.SetRGBA64(2, 0, color.RGBA64{0x8000, 0x4000, 0x2000, 0x8000})
+	var buf bytes.Buffer
+	if err := encodeQOI(&buf, pixels); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeQOI(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the high byte of every straight sample
+	want := []color.NRGBA{{0x12, 0x34, 0x56, 0xff}, {0xfe, 0x00, 0x01, 0xff}, {0xff, 0x7f, 0x3f, 0x80}}
+	for x, w := range want {
+		if got := decoded.At(x, 0); got != w {
+			t.Errorf("pixel %d is %v, want %v", x, got, w)
+		}
+	}
+}
+
+func TestQOIInvalidHeader(t *testing.T) {
+	header := []byte("qoif\x00\x00\x00\x02\x00\x00\x00\x02\x05\x00")
+	if _, err := decodeQOI(bytes.NewReader(header)); err == nil {
+		t.Error("a header of 5 channels is accepted")
+	}
+	if _, err := decodeQOI(bytes.NewReader([]byte("qoix\x00\x00\x00\x02\x00\x00\x00\x02\x03\x00"))); err == nil {
+		t.Error("a wrong magic is accepted")
+	}
+}
@@ -0,0 +1,181 @@
+// Package png allows for loading png images and applying image flitering effects on them
+// Rank-order filters (median, min, max, percentile) computed with Huang's sliding histogram
+// https://en.wikipedia.org/wiki/Median_filter
+// T. Huang, G. Yang, G. Tang, "A fast two-dimensional median filtering algorithm", 1979
+package png
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// RankFilter replaces every channel of a pixel by the value at Percentile within its (2 Radius+1)^2 window:
+// 0 is the min, 50 the median and 100 the max filter
+// Border picks the neighbors outside the image, like for the convolutions (see border.go)
+type RankFilter struct {
+	Radius     int
+	Percentile float64
+	Border     BorderMode
+}
+
+// rank returns the 0-based position of the selected value among the sorted window values
+func (f RankFilter) rank() int {
+	n := (2*f.Radius + 1) * (2*f.Radius + 1)
+	return int(math.Round(f.Percentile / 100 * float64(n-1)))
+}
+
+// rankHistogram counts the values of one channel in the window on two levels, so that
+// finding a rank scans at most 256 coarse bins (the high byte) and 256 fine bins instead of 65536
+type rankHistogram struct {
+	coarse [256]int32
+	fine   [65536]int32
+}
+
+func (h *rankHistogram) add(v uint16, delta int32) {
+	h.coarse[v>>8] += delta
+	h.fine[v] += delta
+}
+
+// nth returns the value with k smaller or equal values before it
+func (h *rankHistogram) nth(k int32) uint16 {
+	hi := 0
+	for ; hi < 255 && k >= h.coarse[hi]; hi++ {
+		k -= h.coarse[hi]
+	}
+	v := hi << 8
+	for ; v < hi<<8|0xff && k >= h.fine[v]; v++ {
+		k -= h.fine[v]
+	}
+	return uint16(v)
+}
+
+// rankWindow is the sliding window of one worker: one histogram per channel that is ranked
+type rankWindow struct {
+	img      *Image
+	filter   RankFilter
+	straight bool
+	channels int // 3 when the alpha of the center pixel is kept (AlphaIgnore), 4 otherwise
+	hist     [4]*rankHistogram
+}
+
+func (img *Image) newRankWindow(f RankFilter) *rankWindow {
+	w := &rankWindow{img: img, filter: f, straight: img.AlphaMode == AlphaStraight, channels: 4}
+	if img.AlphaMode == AlphaIgnore || img.AlphaMode == "" {
+		w.channels = 3
+	}
+	for c := 0; c < w.channels; c++ {
+		w.hist[c] = &rankHistogram{}
+	}
+	return w
+}
+
+// update adds (delta 1) or removes (delta -1) the pixel standing at (x, y), which may lie outside the image
+func (w *rankWindow) update(x, y int, delta int32) {
+	bounds := w.img.Bounds
+	nx := w.filter.Border.index(x-bounds.Min.X, bounds.Dx())
+	ny := w.filter.Border.index(y-bounds.Min.Y, bounds.Dy())
+	var c color.RGBA64 // zero padding
+	if nx >= 0 && ny >= 0 {
+		c = w.img.In.RGBA64At(bounds.Min.X+nx, bounds.Min.Y+ny)
+		if w.straight {
+			a := uint32(c.A)
+			c.R = uint16(unpremultiply(uint32(c.R), a))
+			c.G = uint16(unpremultiply(uint32(c.G), a))
+			c.B = uint16(unpremultiply(uint32(c.B), a))
+		}
+	}
+	w.hist[0].add(c.R, delta)
+	w.hist[1].add(c.G, delta)
+	w.hist[2].add(c.B, delta)
+	if w.channels == 4 {
+		w.hist[3].add(c.A, delta)
+	}
+}
+
+// pixel writes the ranked values of the window centered on (x, y) to Out
+func (w *rankWindow) pixel(x, y int) {
+	img, r := w.img, w.filter.Radius
+	bounds := img.Bounds
+	if w.filter.Border == BorderValid &&
+		(x-r < bounds.Min.X || x+r >= bounds.Max.X || y-r < bounds.Min.Y || y+r >= bounds.Max.Y) {
+		img.Out.SetRGBA64(x, y, img.In.RGBA64At(x, y))
+		return
+	}
+	k := int32(w.filter.rank())
+	red, green, blue := w.hist[0].nth(k), w.hist[1].nth(k), w.hist[2].nth(k)
+	if w.channels == 3 {
+		img.Out.SetRGBA64(x, y, color.RGBA64{red, green, blue, img.In.RGBA64At(x, y).A})
+		return
+	}
+	red, green, blue, alpha := finishAlpha(img.AlphaMode, float64(red), float64(green), float64(blue), float64(w.hist[3].nth(k)))
+	img.Out.SetRGBA64(x, y, color.RGBA64{red, green, blue, alpha})
+}
+
+// rankRows filters rows [startY, endY) of In into Out
+// The window snakes through the rows (left to right, one row down, right to left, ...) so that every
+// step only exchanges one column or row of 2r+1 pixels and the histograms never have to be rebuilt
+func (img *Image) rankRows(f RankFilter, startY, endY int) {
+	if startY >= endY {
+		return
+	}
+	bounds := img.Bounds
+	r := f.Radius
+	w := img.newRankWindow(f)
+	for dy := -r; dy <= r; dy++ {
+		for dx := -r; dx <= r; dx++ {
+			w.update(bounds.Min.X+dx, startY+dy, 1)
+		}
+	}
+
+	x, step := bounds.Min.X, 1
+	for y := startY; y < endY; y++ {
+		for {
+			w.pixel(x, y)
+			next := x + step
+			if next < bounds.Min.X || next >= bounds.Max.X {
+				break
+			}
+			// slide sideways: the trailing column leaves, the leading one enters
+			for dy := -r; dy <= r; dy++ {
+				w.update(x-step*r, y+dy, -1)
+				w.update(next+step*r, y+dy, 1)
+			}
+			x = next
+		}
+		if y+1 < endY {
+			// slide down: the top row leaves, the new bottom row enters
+			for dx := -r; dx <= r; dx++ {
+				w.update(x+dx, y-r, -1)
+				w.update(x+dx, y+1+r, 1)
+			}
+		}
+		step = -step
+	}
+}
+
+// RankFilter applies a median, min, max or percentile filter to the image
+func (img *Image) RankFilter(f RankFilter) {
+	img.BSPRankFilter(f, 1)
+}
+
+// BSPRankFilter parallelly applies a median, min, max or percentile filter to the image
+// Every slice builds its own window once and then slides it through its rows
+func (img *Image) BSPRankFilter(f RankFilter, numThreads int) {
+	img.applyRows(rankEffect{img.rowImage(), f}, numThreads)
+}
+
+// rankEffect is the effect of a rank filter
+type rankEffect struct {
+	rowImage
+	filter RankFilter
+}
+
+func (e rankEffect) Info() EffectInfo {
+	return EffectInfo{Halo: borderHalo(e.filter.Radius, e.filter.Border), KeepsAlpha: e.alpha == AlphaIgnore || e.alpha == ""}
+}
+
+// Apply filters rows of in into out
+func (e rankEffect) Apply(in, out *image.RGBA64, rows Rows) {
+	e.view(in, out).rankRows(e.filter, rows.Min, rows.Max)
+}
@@ -0,0 +1,269 @@
+// Package png allows for loading png images and applying image flitering effects on them
+// Effect registry: every effect of effects.txt is built by the factory registered under its name, and the
+// schedulers drive all of them through the Effect interface
+package png
+
+import (
+	"fmt"
+	"image"
+)
+
+// Rows is the range [Min, Max) of output rows an effect computes
+type Rows struct {
+	Min, Max int
+}
+
+// WholeImage is the halo of effects whose output pixels may depend on any input pixel
+const WholeImage = -1
+
+// EffectInfo describes which input pixels an effect reads
+type EffectInfo struct {
+	Halo       int  // the distance up to which neighbors of a pixel affect its output, or WholeImage
+	Pointwise  bool // every output pixel depends on the input pixel at the same place only
+	KeepsAlpha bool // every output pixel has the alpha of the input pixel at the same place
+}
+
+// Effect is an effect ready to run on an image, which computes any range of output rows from the input rows within
+// its halo
+// ApplyEffect runs it as one superstep over the slices of the output, so Apply must only write the given rows;
+// in holds at least the rows within Halo of them, and all of them for a WholeImage halo
+type Effect interface {
+	Info() EffectInfo
+	// Bounds returns the bounds of the output of the effect for an input of the given bounds
+	Bounds(in image.Rectangle) image.Rectangle
+	Apply(in, out *image.RGBA64, rows Rows)
+}
+
+// PreparedEffect is an effect whose rows build on state computed from the whole input first, like the
+// histograms of the equalizations or the restored image of the deconvolutions; ApplyEffect runs Prepare, which
+// may take supersteps of its own, before the superstep of Apply
+// An effect with a finite halo computes the same rows without Prepare, which only saves work (the FFT convolution
+// rounds differently, see fft.go); the streaming pipeline relies on it
+type PreparedEffect interface {
+	Effect
+	Prepare(in *image.RGBA64, numThreads int)
+}
+
+// EffectFactory builds the effect of a pass for img, whose directory and transfer function it may read
+type EffectFactory func(pass Pass, img *Image) (Effect, error)
+
+// registeredEffect is the entry of an effect name in the registry
+type registeredEffect struct {
+	validate func(EffectSpec) error
+	factory  EffectFactory
+}
+
+// registry holds the effects by name; it is only written by init functions, so the schedulers read it without locking
+var registry = map[string]registeredEffect{}
+
+// RegisterEffect makes an effect available to effects.txt under name, with the parameters it declares; their types
+// and ranges are checked when the effects are read, and then validate, which may be nil, checks the rest
+// It must be called from an init function, and it panics when the name is already taken
+func RegisterEffect(name string, params []Param, validate func(EffectSpec) error, factory EffectFactory) {
+	if _, ok := effectParams[name]; ok {
+		panic(fmt.Sprintf("png: the effect %q is already registered", name))
+	}
+	effectParams[name] = params
+	registry[name] = registeredEffect{validate, factory}
+}
+
+// registerBuiltin registers the factory of built-in effects, whose parameters are listed in effectParams
+func registerBuiltin(factory EffectFactory, names ...string) {
+	for _, name := range names {
+		registry[name] = registeredEffect{factory: factory}
+	}
+}
+
+// NewEffect builds the effect of a pass for img
+// Effects that resize or rotate need the size of the input to know their output, so it is only here, before
+// anything is allocated, that an output of more than maxPixels pixels is rejected; effects that keep the size run on
+// any input, like the larger-than-RAM images of the stream mode
+func NewEffect(pass Pass, img *Image) (Effect, error) {
+	name := pass.Effects[0].Name
+	r, ok := registry[name]
+	if !ok {
+		return nil, fmt.Errorf("png: unknown effect %q", name)
+	}
+	e, err := r.factory(pass, img)
+	if err != nil {
+		return nil, err
+	}
+	if out := e.Bounds(img.Bounds); out != img.Bounds && out.Dx()*out.Dy() > maxPixels {
+		return nil, fmt.Errorf("png: the %s effect would make a %dx%d image, more than %d pixels", name, out.Dx(), out.Dy(), maxPixels)
+	}
+	return e, nil
+}
+
+// ApplyEffect parallelly applies an effect, from In into Out
+func (img *Image) ApplyEffect(e Effect, numThreads int) {
+	img.applyRows(e, numThreads)
+}
+
+// applyRows prepares an effect and runs it in one superstep over the output rows
+func (img *Image) applyRows(e Effect, numThreads int) {
+	if p, ok := e.(PreparedEffect); ok {
+		p.Prepare(img.In, numThreads)
+	}
+	out := e.Bounds(img.Bounds)
+	img.prepareOut(out)
+	bspSlices(out, numThreads, func(startY, endY int) {
+		e.Apply(img.In, img.Out, Rows{startY, endY})
+	})
+}
+
+// rowImage is embedded by the effects built on the methods of Image, which read the bounds and alpha mode of
+// the image: it keeps those of the image the effect was made for, since in may only hold some of its rows
+type rowImage struct {
+	bounds image.Rectangle
+	alpha  AlphaMode
+}
+
+func (img *Image) rowImage() rowImage {
+	return rowImage{img.Bounds, img.AlphaMode}
+}
+
+func (v rowImage) Bounds(in image.Rectangle) image.Rectangle { return in }
+
+// view returns an Image that reads in and writes out within the bounds of the whole image
+func (v rowImage) view(in, out *image.RGBA64) *Image {
+	return &Image{In: in, Out: out, Bounds: v.bounds, AlphaMode: v.alpha}
+}
+
+// bandView returns an Image whose bounds are the rows within halo of rows, the whole image for a WholeImage halo
+// The multi-pass effects run their passes on it as if it were the whole image: its edges either are those of the
+// image or lie more than halo rows away from rows, so rows come out as they would from the whole image
+func (v rowImage) bandView(in, out *image.RGBA64, rows Rows, halo int) *Image {
+	img := v.view(in, out)
+	if halo != WholeImage {
+		img.Bounds = image.Rect(v.bounds.Min.X, rows.Min-halo, v.bounds.Max.X, rows.Max+halo).Intersect(v.bounds)
+	}
+	return img
+}
+
+// copyRows copies rows of src, which has the bounds of dst, to dst
+func copyRows(dst, src *image.RGBA64, rows Rows) {
+	for y := rows.Min; y < rows.Max; y++ {
+		start := dst.PixOffset(dst.Rect.Min.X, y)
+		copy(dst.Pix[start:start+8*dst.Rect.Dx()], src.Pix[src.PixOffset(src.Rect.Min.X, y):])
+	}
+}
+
+// borderHalo is the halo of an effect reaching halo pixels through a border mode: wrap reaches the far edge
+func borderHalo(halo int, border BorderMode) int {
+	if border == BorderWrap {
+		return WholeImage
+	}
+	return halo
+}
+
+func init() {
+	registerBuiltin(func(pass Pass, img *Image) (Effect, error) {
+		return img.convolutionEffect(pass.Kernel()), nil
+	}, "S", "E", "B", KernelEffect, GaussianEffect)
+
+	registerBuiltin(func(pass Pass, img *Image) (Effect, error) {
+		return grayEffect{pass.Effects[0].GrayMethod(), img.linear}, nil
+	}, "G")
+
+	registerBuiltin(func(pass Pass, img *Image) (Effect, error) {
+		return newAdjustment(pass.Effects, img.linear, img.Ancillary), nil
+	}, BrightnessEffect, ContrastEffect, GammaEffect, ExposureEffect, SaturationEffect,
+		HueEffect, InvertEffect, SepiaEffect, PosterizeEffect, ThresholdEffect)
+
+	registerBuiltin(func(pass Pass, img *Image) (Effect, error) {
+		return rankEffect{img.rowImage(), pass.Effects[0].RankFilter()}, nil
+	}, MedianEffect, MinEffect, MaxEffect, PercentileEffect)
+
+	registerBuiltin(func(pass Pass, img *Image) (Effect, error) {
+		return &gradientEffect{rowImage: img.rowImage(), g: pass.Effects[0].Gradient()}, nil
+	}, SobelEffect, ScharrEffect, PrewittEffect)
+
+	registerBuiltin(func(pass Pass, img *Image) (Effect, error) {
+		return &cannyEffect{rowImage: img.rowImage(), c: pass.Effects[0].Canny()}, nil
+	}, CannyEffect)
+
+	registerBuiltin(func(pass Pass, img *Image) (Effect, error) {
+		return &morphEffect{rowImage: img.rowImage(), m: pass.Effects[0].Morphology()}, nil
+	}, ErodeEffect, DilateEffect, OpenEffect, CloseEffect, TopHatEffect, BlackHatEffect, MorphEdgeEffect)
+
+	registerBuiltin(func(pass Pass, img *Image) (Effect, error) {
+		stat := map[string]int{BoxEffect: boxMean, StdDevEffect: boxStdDev, VarianceEffect: boxVariance}[pass.Effects[0].Name]
+		return &boxEffect{rowImage: img.rowImage(), radius: pass.Effects[0].BoxRadius(), stat: stat}, nil
+	}, BoxEffect, StdDevEffect, VarianceEffect)
+
+	registerBuiltin(func(pass Pass, img *Image) (Effect, error) {
+		f := pass.Effects[0].Bilateral()
+		if f.Grid {
+			return &bilateralGridEffect{rowImage: img.rowImage(), f: f}, nil
+		}
+		return img.bilateralEffect(f), nil
+	}, BilateralEffect)
+
+	registerBuiltin(func(pass Pass, img *Image) (Effect, error) {
+		return guidedEffect{img.rowImage(), pass.Effects[0].Guided()}, nil
+	}, GuidedEffect)
+
+	registerBuiltin(func(pass Pass, img *Image) (Effect, error) {
+		e := pass.Effects[0]
+		psf, err := e.PointSpread(img.Dir)
+		if err != nil {
+			return nil, err
+		}
+		return &deblurEffect{rowImage: img.rowImage(), psf: psf, noise: e.WienerNoise()}, nil
+	}, WienerEffect)
+
+	registerBuiltin(func(pass Pass, img *Image) (Effect, error) {
+		e := pass.Effects[0]
+		psf, err := e.PointSpread(img.Dir)
+		if err != nil {
+			return nil, err
+		}
+		return &deblurEffect{rowImage: img.rowImage(), psf: psf, iterations: e.DeblurIterations()}, nil
+	}, RichardsonLucyEffect)
+
+	registerBuiltin(func(pass Pass, img *Image) (Effect, error) {
+		return &claheEffect{rowImage: img.rowImage(), c: CLAHE{Tiles: 1}}, nil
+	}, EqualizeEffect)
+
+	registerBuiltin(func(pass Pass, img *Image) (Effect, error) {
+		return &claheEffect{rowImage: img.rowImage(), c: pass.Effects[0].CLAHE()}, nil
+	}, CLAHEEffect)
+
+	registerBuiltin(func(pass Pass, img *Image) (Effect, error) {
+		prog, err := pass.Effects[0].Expression()
+		if err != nil {
+			return nil, err
+		}
+		return exprEffect{prog, img.Bounds}, nil
+	}, ExprEffect)
+
+	registerBuiltin(func(pass Pass, img *Image) (Effect, error) {
+		e := pass.Effects[0]
+		lut, err := e.ColorLUT(img.Dir)
+		if err != nil {
+			return nil, err
+		}
+		return lutEffect{lut, e.LUTInterpolation()}, nil
+	}, LUTEffect)
+
+	registerBuiltin(func(pass Pass, img *Image) (Effect, error) {
+		return newResizeEffect(pass.Effects[0].Resize(), img.Bounds), nil
+	}, ResizeEffect)
+
+	registerBuiltin(func(pass Pass, img *Image) (Effect, error) {
+		e := pass.Effects[0]
+		return img.rotateEffect(e.RotateAngle(), e.ResampleMethod()), nil
+	}, RotateEffect)
+
+	registerBuiltin(func(pass Pass, img *Image) (Effect, error) {
+		return flipEffect(pass.Effects[0].FlipAxis(), img.Bounds), nil
+	}, FlipEffect)
+
+	registerBuiltin(func(pass Pass, img *Image) (Effect, error) {
+		crop, err := cropEffect(pass.Effects[0].CropRect(), img.Bounds)
+		if err != nil {
+			return nil, err
+		}
+		return crop, nil
+	}, CropEffect)
+}
@@ -0,0 +1,100 @@
+// Package png allows for loading png images and applying image flitering effects on them
+// Two-pass convolution for separable (rank-1) kernels such as box and Gaussian blurs
+package png
+
+import (
+	"image"
+	"image/color"
+)
+
+// separableRows applies kernel = col * row to rows of in as a horizontal pass into an intermediate buffer followed
+// by a vertical pass from that buffer into out
+// Every border mode maps the two axes independently, so the passes see exactly the neighbors of the direct convolution
+// The horizontal pass covers the rows within the halo of rows, so that every slice of the BSP version runs both passes
+// in a single superstep, at the cost of convolving the rows next to its slice as well; with the wrap border it is
+// prepared once for the whole image instead
+func (e *convolutionEffect) separableRows(in, out *image.RGBA64, rows Rows) {
+	img := e.view(in, out)
+	tmp, top := e.tmp, e.bounds.Min.Y
+	if tmp == nil {
+		band := e.bandView(in, out, rows, len(e.col)/2).Bounds
+		tmp, top = make([]float64, 4*band.Dx()*band.Dy()), band.Min.Y
+		img.horizontalPass(e.row, e.kernel.Border, e.kernel.Gray, tmp, top, band.Min.Y, band.Max.Y)
+	}
+	img.verticalPass(e.kernel, e.weight, e.col, tmp, top, rows.Min, rows.Max)
+}
+
+// horizontalPass convolves rows [startY, endY) of In with row and stores the sums in tmp, whose first row is top
+// A gray input only has its red and alpha channels convolved, and its green and blue sums are left at 0
+func (img *Image) horizontalPass(row []float64, border BorderMode, gray bool, tmp []float64, top, startY, endY int) {
+	bounds := img.Bounds
+	width := bounds.Dx()
+	hx := len(row) / 2
+	for y := startY; y < endY; y++ {
+		out := tmp[4*width*(y-top):]
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			var sumR, sumG, sumB, sumA float64
+			inside := x-hx >= bounds.Min.X && x+hx < bounds.Max.X
+			for dx := -hx; dx <= hx; dx++ {
+				nx := x + dx
+				if !inside {
+					if nx = border.index(nx-bounds.Min.X, width); nx < 0 {
+						continue // zero padding
+					}
+					nx += bounds.Min.X
+				}
+				c := img.In.RGBA64At(nx, y)
+				r, g, b, a := uint32(c.R), uint32(c.G), uint32(c.B), uint32(c.A)
+				k := row[dx+hx]
+				sumR += float64(r) * k
+				sumA += float64(a) * k
+				if !gray {
+					sumG += float64(g) * k
+					sumB += float64(b) * k
+				}
+			}
+			i := 4 * (x - bounds.Min.X)
+			out[i], out[i+1], out[i+2], out[i+3] = sumR, sumG, sumB, sumA
+		}
+	}
+}
+
+// verticalPass convolves the columns of tmp, whose first row is top, with col and writes rows [startY, endY) of Out
+// through convolved, for a kernel whose values add up to weight
+func (img *Image) verticalPass(kernel Kernel, weight float64, col []float64, tmp []float64, top, startY, endY int) {
+	bounds := img.Bounds
+	width := bounds.Dx()
+	height := bounds.Dy()
+	hy := len(col) / 2
+	for y := startY; y < endY; y++ {
+		inside := y-hy >= bounds.Min.Y && y+hy < bounds.Max.Y
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if kernel.Border == BorderValid && !kernel.interior(x, y, bounds) {
+				img.Out.SetRGBA64(x, y, img.In.RGBA64At(x, y))
+				continue
+			}
+			var sumR, sumG, sumB, sumA float64
+			for dy := -hy; dy <= hy; dy++ {
+				ny := y + dy - bounds.Min.Y
+				if !inside {
+					if ny = kernel.Border.index(ny, height); ny < 0 {
+						continue // zero padding
+					}
+				}
+				i := 4 * ((ny+bounds.Min.Y-top)*width + x - bounds.Min.X)
+				k := col[dy+hy]
+				sumR += tmp[i] * k
+				sumA += tmp[i+3] * k
+				if !kernel.Gray {
+					sumG += tmp[i+1] * k
+					sumB += tmp[i+2] * k
+				}
+			}
+			if kernel.Gray {
+				sumG, sumB = sumR, sumR
+			}
+			r, g, b, a := img.convolved(x, y, kernel, weight, sumR, sumG, sumB, sumA)
+			img.Out.Set(x, y, color.RGBA64{r, g, b, a})
+		}
+	}
+}
@@ -0,0 +1,839 @@
+// Package png allows for loading png images and applying image flitering effects on them
+// Effect entries of effects.txt: the legacy single letters ("S") and objects with parameters
+package png
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"math"
+	"path/filepath"
+	"sort"
+)
+
+// EffectSpec is one entry of the "effects" list of an ImageTask
+// It decodes from a legacy letter such as "G", from an object such as {"name":"blur","radius":1}
+// or from a custom kernel such as {"kernel":[[1,2,1],[2,4,2],[1,2,1]],"divisor":16,"bias":0}
+// Custom kernels may have any odd number of rows and columns up to maxKernelSize
+// Long names are normalized to the legacy letters, and a kernel without a name to KernelEffect
+// Params holds the parameters given in effects.txt, which are the ones the effect declares (see effectParams and
+// RegisterEffect); a parameter that is not given takes the default of the effect, so a given 0 is a value like any other
+type EffectSpec struct {
+	Name   string
+	Params map[string]interface{} // float64 for NumberParam, int for IntParam, string and [][]float64 for KernelParam
+}
+
+// ParamKind is the JSON type of an effect parameter
+type ParamKind int
+
+const (
+	NumberParam ParamKind = iota // a number
+	IntParam                     // a whole number
+	StringParam                  // a string, checked by the effect
+	KernelParam                  // rows of numbers
+)
+
+// kindNames describes the values of every kind in error messages
+var kindNames = map[ParamKind]string{
+	NumberParam: "a number",
+	IntParam:    "a whole number",
+	StringParam: "a string",
+	KernelParam: "rows of numbers",
+}
+
+// Param declares a parameter of an effect
+// Numbers must lie between Min and Max, which may be infinite; Open excludes Min itself
+type Param struct {
+	Name     string
+	Kind     ParamKind
+	Min, Max float64
+	Open     bool
+	Required bool
+}
+
+// check reports a number outside the range of the parameter
+func (p Param) check(v float64) error {
+	inRange := v >= p.Min && v <= p.Max && !(p.Open && v == p.Min)
+	if inRange {
+		return nil
+	}
+	switch {
+	case math.IsInf(p.Min, -1) && math.IsInf(p.Max, 1):
+		return fmt.Errorf("%s must be finite", p.Name)
+	case math.IsInf(p.Max, 1) && p.Open:
+		return fmt.Errorf("%s must be greater than %g", p.Name, p.Min)
+	case math.IsInf(p.Max, 1):
+		return fmt.Errorf("%s must be at least %g", p.Name, p.Min)
+	case p.Open:
+		return fmt.Errorf("%s must be greater than %g and at most %g", p.Name, p.Min, p.Max)
+	}
+	return fmt.Errorf("%s must be between %g and %g", p.Name, p.Min, p.Max)
+}
+
+// Constructors of the parameter declarations
+func number(name string, min, max float64) Param {
+	return Param{Name: name, Kind: NumberParam, Min: min, Max: max}
+}
+
+func finite(name string) Param {
+	return number(name, math.Inf(-1), math.Inf(1))
+}
+
+// positive declares a number greater than 0 and at most max
+func positive(name string, max float64) Param {
+	return Param{Name: name, Kind: NumberParam, Max: max, Open: true}
+}
+
+func integer(name string, min, max int) Param {
+	return Param{Name: name, Kind: IntParam, Min: float64(min), Max: float64(max)}
+}
+
+// atLeast declares a whole number of min or more
+func atLeast(name string, min int) Param {
+	return Param{Name: name, Kind: IntParam, Min: float64(min), Max: math.Inf(1)}
+}
+
+func text(name string) Param {
+	return Param{Name: name, Kind: StringParam}
+}
+
+func required(p Param) Param {
+	p.Required = true
+	return p
+}
+
+// KernelEffect is the name of a convolution with a kernel given in effects.txt
+const KernelEffect = "kernel"
+
+// GaussianEffect is the name of a Gaussian blur, which runs as two one-dimensional passes (see separable.go)
+const GaussianEffect = "gaussian"
+
+// Rank-order filters (see rank.go)
+const (
+	MedianEffect     = "median"
+	MinEffect        = "min"
+	MaxEffect        = "max"
+	PercentileEffect = "percentile"
+)
+
+// Edge effects (see edges.go); the gradient effects are named after their operator
+const (
+	SobelEffect   = string(Sobel)
+	ScharrEffect  = string(Scharr)
+	PrewittEffect = string(Prewitt)
+	CannyEffect   = "canny"
+)
+
+// Defaults of CannyEffect
+const (
+	cannySigma = 1.4
+	cannyLow   = 0.05
+	cannyHigh  = 0.15
+)
+
+// Geometric effects (see geometry.go)
+const (
+	ResizeEffect = "resize"
+	RotateEffect = "rotate"
+	FlipEffect   = "flip"
+	CropEffect   = "crop"
+)
+
+// Tonal and color adjustments (see adjust.go); consecutive ones run as a single pass
+const (
+	BrightnessEffect = "brightness" // amount added to every channel, from -1 to 1
+	ContrastEffect   = "contrast"   // channels move away from mid gray by a factor of 1+amount
+	GammaEffect      = "gamma"      // channels raised to 1/amount (default 1)
+	ExposureEffect   = "exposure"   // amount stops of light, applied in linear light
+	SaturationEffect = "saturation" // colors move away from their luma by a factor of 1+amount
+	HueEffect        = "hue"        // hue rotated by amount degrees, keeping the luma
+	InvertEffect     = "invert"     // negative image
+	SepiaEffect      = "sepia"      // amount of sepia toning, from 0 to 1 (default 1)
+	PosterizeEffect  = "posterize"  // levels per channel (default 4)
+	ThresholdEffect  = "threshold"  // channels at or above amount (default 0.5) become full, the others 0
+)
+
+// Histogram equalizations (see equalize.go)
+const (
+	EqualizeEffect = "equalize"
+	CLAHEEffect    = "clahe"
+)
+
+// Edge-preserving smoothing (see bilateral.go and guided.go)
+const (
+	BilateralEffect = "bilateral"
+	GuidedEffect    = "guided"
+)
+
+// Defaults of BilateralEffect and GuidedEffect
+const (
+	bilateralSigma = 3
+	bilateralRange = 0.1
+	guidedRadius   = 4
+	guidedEps      = 0.01
+)
+
+// Deconvolution of a known blur (see deblur.go)
+const (
+	WienerEffect         = "wiener"
+	RichardsonLucyEffect = "richardsonlucy"
+)
+
+// ExprEffect is the name of a per-pixel expression (see expr.go)
+const ExprEffect = "expr"
+
+// LUTEffect is the name of a color grading with a 3D LUT read from a .cube file (see lut.go)
+const LUTEffect = "lut"
+
+// Defaults of the deblur effects; the disk PSF has a radius of radius pixels, 3 by default
+const (
+	psfRadius      = 3
+	wienerNoise    = 0.01
+	deblurIters    = 10
+	maxDeblurIters = 500
+)
+
+// Box means over windows of any size (see integral.go)
+const (
+	BoxEffect      = "box"
+	StdDevEffect   = "stddev"
+	VarianceEffect = "variance"
+)
+
+// Morphological effects (see morphology.go), named after their operator
+const (
+	ErodeEffect     = string(Erode)
+	DilateEffect    = string(Dilate)
+	OpenEffect      = string(Open)
+	CloseEffect     = string(Close)
+	TopHatEffect    = string(TopHat)
+	BlackHatEffect  = string(BlackHat)
+	MorphEdgeEffect = string(MorphEdge)
+)
+
+// maxMorphRadius bounds the structuring elements to 201x201; squares cost the same whatever their size
+const maxMorphRadius = 100
+
+// Defaults of CLAHEEffect
+const (
+	claheTiles = 8
+	claheClip  = 2
+)
+
+// maxDimension bounds the width and height of a resized image
+const maxDimension = 1 << 15
+
+// maxPixels bounds the output of the effects that change the size of the image, like an 8192x8192 image whose
+// two RGBA64 buffers take 1 GB
+const maxPixels = 1 << 26
+
+// maxRankRadius bounds the window of the rank filters to 101x101
+const maxRankRadius = 50
+
+// maxSigma bounds the Gaussian blur; its default radius of ceil(3 sigma) makes a 181x181 kernel
+const maxSigma = 30
+
+// maxKernelSize is the largest width and height of a kernel given in effects.txt; kernels larger than 15x15
+// convolve through the FFT (see fft.go)
+const maxKernelSize = 101
+
+// effectAliases maps the long effect names to the legacy letters
+var effectAliases = map[string]string{
+	"sharpen":   "S",
+	"edge":      "E",
+	"edges":     "E",
+	"blur":      "B",
+	"grayscale": "G",
+	"gray":      "G",
+}
+
+// effectParams lists the parameters each effect accepts
+var effectParams = map[string][]Param{
+	"S":                  {number("amount", 0, math.Inf(1)), text("border")},
+	"E":                  {text("border")},
+	"B":                  {integer("radius", 1, maxKernelSize/2), text("border")},
+	"G":                  {text("method")},
+	GaussianEffect:       {required(positive("sigma", maxSigma)), integer("radius", 1, 3*maxSigma), text("border")},
+	MedianEffect:         {integer("radius", 1, maxRankRadius), text("border")},
+	MinEffect:            {integer("radius", 1, maxRankRadius), text("border")},
+	MaxEffect:            {integer("radius", 1, maxRankRadius), text("border")},
+	PercentileEffect:     {integer("radius", 1, maxRankRadius), required(number("percentile", 0, 100)), text("border")},
+	SobelEffect:          {text("output"), text("border")},
+	ScharrEffect:         {text("output"), text("border")},
+	PrewittEffect:        {text("output"), text("border")},
+	CannyEffect:          {number("sigma", 0, maxSigma), number("low", 0, 1), number("high", 0, 1), text("operator")},
+	ResizeEffect:         {integer("width", 1, maxDimension), integer("height", 1, maxDimension), positive("scale", 64), text("method")},
+	RotateEffect:         {finite("angle"), text("method")},
+	FlipEffect:           {text("axis")},
+	CropEffect:           {atLeast("x", 0), atLeast("y", 0), required(atLeast("width", 1)), required(atLeast("height", 1))},
+	BrightnessEffect:     {number("amount", -1, 1)},
+	ContrastEffect:       {number("amount", -1, 100)},
+	GammaEffect:          {positive("amount", 100)},
+	ExposureEffect:       {number("amount", -16, 16)},
+	SaturationEffect:     {number("amount", -1, 100)},
+	HueEffect:            {finite("amount")},
+	InvertEffect:         {},
+	SepiaEffect:          {number("amount", 0, 1)},
+	PosterizeEffect:      {integer("levels", 2, 65536)},
+	ThresholdEffect:      {number("amount", 0, 1)},
+	EqualizeEffect:       {},
+	CLAHEEffect:          {integer("tiles", 1, 64), number("clip", 1, 1000)},
+	ErodeEffect:          morphParams,
+	DilateEffect:         morphParams,
+	OpenEffect:           morphParams,
+	CloseEffect:          morphParams,
+	TopHatEffect:         morphParams,
+	BlackHatEffect:       morphParams,
+	MorphEdgeEffect:      morphParams,
+	BilateralEffect:      {positive("sigma", maxSigma), positive("range", 1), integer("radius", 1, 3*maxSigma), text("method")},
+	GuidedEffect:         {integer("radius", 1, maxRankRadius), positive("eps", 1)},
+	BoxEffect:            {integer("radius", 1, maxDimension)},
+	StdDevEffect:         {integer("radius", 1, maxDimension)},
+	VarianceEffect:       {integer("radius", 1, maxDimension)},
+	WienerEffect:         append(psfParams, positive("noise", 1)),
+	RichardsonLucyEffect: append(psfParams, integer("iterations", 1, maxDeblurIters)),
+	ExprEffect:           {required(text("expr"))},
+	LUTEffect:            {required(text("lut")), text("method")},
+	KernelEffect:         {required(Param{Name: "kernel", Kind: KernelParam}), finite("divisor"), finite("scale"), number("bias", -1, 1), text("border")},
+}
+
+// Parameters shared by several effects
+var (
+	morphParams = []Param{text("element"), integer("radius", 1, maxMorphRadius), text("border")}
+	psfParams   = []Param{text("psf"), integer("radius", 1, maxKernelSize/2), number("length", 0, maxKernelSize-3), finite("angle")}
+)
+
+// param returns the declaration of a parameter of an effect
+func param(effect, name string) (Param, bool) {
+	for _, p := range effectParams[effect] {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Param{}, false
+}
+
+// UnmarshalJSON accepts both forms of an effect and validates its parameters
+func (e *EffectSpec) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var name string
+		if err := json.Unmarshal(data, &name); err != nil {
+			return err
+		}
+		*e = EffectSpec{Name: name}
+		if alias, ok := effectAliases[e.Name]; ok {
+			e.Name = alias
+		}
+	} else {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return fmt.Errorf("png: invalid effect %s: %v", data, err)
+		}
+		*e = EffectSpec{}
+		if raw, ok := fields["name"]; ok {
+			if err := json.Unmarshal(raw, &e.Name); err != nil {
+				return fmt.Errorf("png: invalid effect %s: the name must be a string", data)
+			}
+			delete(fields, "name")
+		}
+		if alias, ok := effectAliases[e.Name]; ok {
+			e.Name = alias
+		}
+		if _, ok := fields["kernel"]; e.Name == "" && ok {
+			e.Name = KernelEffect
+		}
+		if err := e.decodeParams(fields); err != nil {
+			return fmt.Errorf("png: invalid effect %s: %v", data, err)
+		}
+	}
+	if err := e.Validate(); err != nil {
+		return fmt.Errorf("png: invalid effect %s: %v", data, err)
+	}
+	return nil
+}
+
+// decodeParams decodes the fields of an effect object into Params, with the types the effect declares
+func (e *EffectSpec) decodeParams(fields map[string]json.RawMessage) error {
+	if _, ok := effectParams[e.Name]; !ok {
+		return fmt.Errorf("unknown effect %q", e.Name)
+	}
+	// in the order of the names, so that the first error does not depend on the map
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p, ok := param(e.Name, name)
+		if !ok {
+			return fmt.Errorf("effect %q has no %s parameter", e.Name, name)
+		}
+		var v interface{}
+		var err error
+		switch p.Kind {
+		case NumberParam:
+			var f float64
+			err = json.Unmarshal(fields[name], &f)
+			v = f
+		case IntParam:
+			var f float64
+			err = json.Unmarshal(fields[name], &f)
+			if err == nil && (f != math.Trunc(f) || math.Abs(f) > math.MaxInt32) {
+				return fmt.Errorf("%s must be a whole number", name)
+			}
+			v = int(f)
+		case StringParam:
+			var s string
+			err = json.Unmarshal(fields[name], &s)
+			v = s
+		case KernelParam:
+			var rows [][]float64
+			err = json.Unmarshal(fields[name], &rows)
+			v = rows
+		}
+		if err != nil {
+			return fmt.Errorf("%s must be %s", name, kindNames[p.Kind])
+		}
+		if e.Params == nil {
+			e.Params = map[string]interface{}{}
+		}
+		e.Params[name] = v
+	}
+	return nil
+}
+
+// MarshalJSON writes effects without parameters back as their legacy letter
+func (e EffectSpec) MarshalJSON() ([]byte, error) {
+	if len(e.Params) == 0 {
+		return json.Marshal(e.Name)
+	}
+	fields := map[string]interface{}{"name": e.Name}
+	for name, v := range e.Params {
+		fields[name] = v
+	}
+	return json.Marshal(fields)
+}
+
+// Validate reports unknown effects, parameters the effect does not take and invalid values
+func (e EffectSpec) Validate() error {
+	declared, ok := effectParams[e.Name]
+	if !ok {
+		return fmt.Errorf("unknown effect %q", e.Name)
+	}
+	for _, p := range declared {
+		v, ok := e.Params[p.Name]
+		if !ok {
+			if p.Required {
+				return fmt.Errorf("the %s effect needs a %s", e.Name, p.Name)
+			}
+			continue
+		}
+		if wrongKind(p.Kind, v) {
+			return fmt.Errorf("%s must be %s", p.Name, kindNames[p.Kind])
+		}
+		var err error
+		switch v := v.(type) {
+		case float64:
+			err = p.check(v)
+		case int:
+			err = p.check(float64(v))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for name := range e.Params {
+		if _, ok := param(e.Name, name); !ok {
+			return fmt.Errorf("effect %q has no %s parameter", e.Name, name)
+		}
+	}
+
+	if _, err := ParseBorderMode(e.Text("border", "")); err != nil {
+		return err
+	}
+	switch e.Name {
+	case "G":
+		if _, err := ParseGrayMethod(e.Text("method", "")); err != nil {
+			return err
+		}
+	case SobelEffect, ScharrEffect, PrewittEffect:
+		if output := e.Text("output", GradientMagnitude); output != GradientMagnitude && output != GradientOrientation {
+			return fmt.Errorf("unknown gradient output %q", output)
+		}
+	case CannyEffect:
+		if _, err := ParseGradientOperator(e.Text("operator", "")); err != nil {
+			return err
+		}
+		if c := e.Canny(); c.Low > c.High {
+			return fmt.Errorf("low must be at most high")
+		}
+	case ResizeEffect:
+		if _, err := ParseResampleMethod(e.Text("method", "")); err != nil {
+			return err
+		}
+		if !e.Has("width") && !e.Has("height") && !e.Has("scale") {
+			return fmt.Errorf("resize needs a width, a height or a scale")
+		}
+		if e.Int("width", 0)*e.Int("height", 0) > maxPixels {
+			return fmt.Errorf("the resized image would have more than %d pixels", maxPixels)
+		}
+	case RotateEffect:
+		if _, err := ParseResampleMethod(e.Text("method", "")); err != nil {
+			return err
+		}
+	case FlipEffect:
+		if axis := e.Text("axis", FlipHorizontal); axis != FlipHorizontal && axis != FlipVertical {
+			return fmt.Errorf("axis must be %q or %q", FlipHorizontal, FlipVertical)
+		}
+	case ErodeEffect, DilateEffect, OpenEffect, CloseEffect, TopHatEffect, BlackHatEffect, MorphEdgeEffect:
+		if _, err := ParseStructuringElement(e.Text("element", "")); err != nil {
+			return err
+		}
+	case BilateralEffect:
+		if method := e.Text("method", "exact"); method != "exact" && method != "grid" {
+			return fmt.Errorf("method must be \"exact\" or \"grid\"")
+		}
+	case WienerEffect, RichardsonLucyEffect:
+		if err := e.validatePSF(); err != nil {
+			return err
+		}
+	case ExprEffect:
+		if _, err := e.Expression(); err != nil {
+			return err
+		}
+	case LUTEffect:
+		if e.Text("lut", "") == "" {
+			return fmt.Errorf("lut needs the path of a .cube file")
+		}
+		if _, err := ParseLUTInterpolation(e.Text("method", "")); err != nil {
+			return err
+		}
+	case KernelEffect:
+		rows := e.kernelRows()
+		if len(rows)%2 == 0 || len(rows) > maxKernelSize {
+			return fmt.Errorf("kernel must have an odd number of rows up to %d", maxKernelSize)
+		}
+		width := len(rows[0])
+		if width%2 == 0 || width > maxKernelSize {
+			return fmt.Errorf("kernel rows must have an odd number of values up to %d", maxKernelSize)
+		}
+		for _, row := range rows {
+			if len(row) != width {
+				return fmt.Errorf("kernel rows must all have %d values", width)
+			}
+			for _, v := range row {
+				if math.IsNaN(v) || math.IsInf(v, 0) {
+					return fmt.Errorf("kernel values must be finite")
+				}
+			}
+		}
+		if e.Has("divisor") && e.Number("divisor", 1) == 0 {
+			return fmt.Errorf("divisor must not be 0")
+		}
+		if e.Has("scale") && e.Number("scale", 1) == 0 {
+			return fmt.Errorf("scale must not be 0")
+		}
+	default:
+		// effects registered by other packages
+		if validate := registry[e.Name].validate; validate != nil {
+			return validate(e)
+		}
+	}
+	return nil
+}
+
+// wrongKind reports whether a parameter value does not have the Go type of its kind
+func wrongKind(kind ParamKind, v interface{}) bool {
+	switch v.(type) {
+	case float64:
+		return kind != NumberParam
+	case int:
+		return kind != IntParam
+	case string:
+		return kind != StringParam
+	case [][]float64:
+		return kind != KernelParam
+	}
+	return true
+}
+
+// validatePSF checks the PSF of a deblur effect; the parameters of the built-in ones are those of their shape
+func (e EffectSpec) validatePSF() error {
+	switch e.Text("psf", PSFDisk) {
+	case "", PSFDisk:
+		if e.Has("length") || e.Has("angle") {
+			return fmt.Errorf("the disk PSF takes a radius only")
+		}
+	case PSFMotion:
+		if e.Has("radius") {
+			return fmt.Errorf("the motion PSF takes a length and an angle")
+		}
+	default:
+		if e.Has("radius") || e.Has("length") || e.Has("angle") {
+			return fmt.Errorf("a PSF file takes no radius, length or angle")
+		}
+	}
+	return nil
+}
+
+// Has reports whether the parameter is given
+func (e EffectSpec) Has(name string) bool {
+	_, ok := e.Params[name]
+	return ok
+}
+
+// Number returns a NumberParam, or def when it is not given
+func (e EffectSpec) Number(name string, def float64) float64 {
+	if v, ok := e.Params[name].(float64); ok {
+		return v
+	}
+	return def
+}
+
+// Int returns an IntParam, or def when it is not given
+func (e EffectSpec) Int(name string, def int) int {
+	if v, ok := e.Params[name].(int); ok {
+		return v
+	}
+	return def
+}
+
+// Text returns a StringParam, or def when it is not given
+func (e EffectSpec) Text(name string, def string) string {
+	if v, ok := e.Params[name].(string); ok {
+		return v
+	}
+	return def
+}
+
+// kernelRows returns the rows of the kernel of a KernelEffect
+func (e EffectSpec) kernelRows() [][]float64 {
+	rows, _ := e.Params["kernel"].([][]float64)
+	return rows
+}
+
+// GrayMethod returns the grayscale method of a validated "G" effect
+func (e EffectSpec) GrayMethod() GrayMethod {
+	m, _ := ParseGrayMethod(e.Text("method", ""))
+	return m
+}
+
+// ConvolutionKernel returns the kernel of a validated "S", "E", "B", GaussianEffect or KernelEffect effect
+// The legacy effects without parameters use exactly the original kernels
+func (e EffectSpec) ConvolutionKernel() Kernel {
+	kernel := e.kernel()
+	kernel.Border, _ = ParseBorderMode(e.Text("border", ""))
+	return kernel
+}
+
+// kernel builds the values, scale and bias of ConvolutionKernel
+func (e EffectSpec) kernel() Kernel {
+	switch e.Name {
+	case "S":
+		a := e.Number("amount", 1)
+		if a == 1 {
+			return sharpenKernel
+		}
+		return kernel3([9]float64{0, -a, 0, -a, 1 + 4*a, -a, 0, -a, 0})
+	case "E":
+		return edgeDetectionKernel
+	case "B":
+		radius := e.Int("radius", 1)
+		if radius == 1 {
+			return blurKernel
+		}
+		return boxKernel(radius)
+	case GaussianEffect:
+		// a radius of 0 is ceil(3 sigma)
+		return gaussianKernel(e.Number("sigma", 1), e.Int("radius", 0))
+	}
+
+	// Validate already checked the shape of the rows
+	kernel, _ := NewKernel(e.kernelRows())
+	if e.Has("divisor") {
+		kernel = kernel.Divide(e.Number("divisor", 1))
+	} else {
+		kernel = kernel.Normalize()
+	}
+	if e.Has("scale") {
+		kernel.Scale = e.Number("scale", 1)
+	}
+	kernel.Bias = e.Number("bias", 0)
+	return kernel
+}
+
+// borderOr returns the border mode of a validated effect, or def when it has none
+func (e EffectSpec) borderOr(def BorderMode) BorderMode {
+	if !e.Has("border") {
+		return def
+	}
+	m, _ := ParseBorderMode(e.Text("border", ""))
+	return m
+}
+
+// RankFilter returns the filter of a validated median, min, max or percentile effect
+// The window defaults to 3x3, and to clamped borders since zero padding would turn the borders of a min or median black
+func (e EffectSpec) RankFilter() RankFilter {
+	f := RankFilter{Radius: e.Int("radius", 1), Percentile: e.Number("percentile", 0), Border: e.borderOr(BorderClamp)}
+	switch e.Name {
+	case MedianEffect:
+		f.Percentile = 50
+	case MinEffect:
+		f.Percentile = 0
+	case MaxEffect:
+		f.Percentile = 100
+	}
+	return f
+}
+
+// Gradient returns the gradient effect of a validated Sobel, Scharr or Prewitt effect, with clamped borders by default
+func (e EffectSpec) Gradient() Gradient {
+	return Gradient{
+		Operator: GradientOperator(e.Name),
+		Output:   e.Text("output", GradientMagnitude),
+		Border:   e.borderOr(BorderClamp),
+	}
+}
+
+// Canny returns the edge detection of a CannyEffect, filling in the defaults
+// A missing threshold defaults so that the given one stays between low and high
+func (e EffectSpec) Canny() Canny {
+	c := Canny{Sigma: e.Number("sigma", cannySigma)}
+	c.Operator, _ = ParseGradientOperator(e.Text("operator", ""))
+	c.High = e.Number("high", math.Max(cannyHigh, e.Number("low", 0)))
+	c.Low = e.Number("low", math.Min(cannyLow, c.High))
+	return c
+}
+
+// Resize returns the resize of a validated ResizeEffect
+func (e EffectSpec) Resize() Resize {
+	return Resize{Width: e.Int("width", 0), Height: e.Int("height", 0), Scale: e.Number("scale", 0), Method: e.ResampleMethod()}
+}
+
+// ResampleMethod returns the interpolation of a validated ResizeEffect or RotateEffect
+func (e EffectSpec) ResampleMethod() ResampleMethod {
+	m, _ := ParseResampleMethod(e.Text("method", ""))
+	return m
+}
+
+// RotateAngle returns the counter-clockwise angle of a validated RotateEffect in degrees
+func (e EffectSpec) RotateAngle() float64 {
+	return e.Number("angle", 0)
+}
+
+// FlipAxis returns the axis of a validated FlipEffect
+func (e EffectSpec) FlipAxis() string {
+	return e.Text("axis", FlipHorizontal)
+}
+
+// CropRect returns the rectangle of a validated CropEffect, relative to the top-left corner of the image
+func (e EffectSpec) CropRect() image.Rectangle {
+	x, y := e.Int("x", 0), e.Int("y", 0)
+	return image.Rect(x, y, x+e.Int("width", 0), y+e.Int("height", 0))
+}
+
+// Morphology returns the operator of a validated morphological effect, whose name is the operator
+// The element defaults to a 3x3 square, and the border to clamped like for the rank filters
+func (e EffectSpec) Morphology() Morphology {
+	m := Morphology{Op: MorphOp(e.Name), Radius: e.Int("radius", 1), Border: e.borderOr(BorderClamp)}
+	m.Element, _ = ParseStructuringElement(e.Text("element", ""))
+	return m
+}
+
+// BoxRadius returns the window radius of a validated BoxEffect, StdDevEffect or VarianceEffect, 1 by default
+func (e EffectSpec) BoxRadius() int {
+	return e.Int("radius", 1)
+}
+
+// Bilateral returns the filter of a validated BilateralEffect, filling in the defaults
+func (e EffectSpec) Bilateral() Bilateral {
+	return Bilateral{
+		Sigma:  e.Number("sigma", bilateralSigma),
+		Range:  e.Number("range", bilateralRange),
+		Radius: e.Int("radius", 0), // ceil(2 sigma)
+		Grid:   e.Text("method", "") == "grid",
+	}
+}
+
+// Guided returns the filter of a validated GuidedEffect, filling in the defaults
+func (e EffectSpec) Guided() Guided {
+	return Guided{Radius: e.Int("radius", guidedRadius), Eps: e.Number("eps", guidedEps)}
+}
+
+// PointSpread returns the PSF of a validated deblur effect; a PSF file is read relative to dir
+func (e EffectSpec) PointSpread(dir string) (Kernel, error) {
+	switch psf := e.Text("psf", PSFDisk); psf {
+	case "", PSFDisk:
+		return DiskPSF(float64(e.Int("radius", psfRadius))), nil
+	case PSFMotion:
+		return MotionPSF(e.Number("length", 0), e.Number("angle", 0)), nil
+	default:
+		if !filepath.IsAbs(psf) {
+			psf = filepath.Join(dir, psf)
+		}
+		return LoadPSF(psf)
+	}
+}
+
+// WienerNoise returns the noise-to-signal ratio of a validated WienerEffect, 0.01 by default
+func (e EffectSpec) WienerNoise() float64 {
+	return e.Number("noise", wienerNoise)
+}
+
+// Expression compiles the program of an ExprEffect
+func (e EffectSpec) Expression() (*Expression, error) {
+	return CompileExpression(e.Text("expr", ""))
+}
+
+// ColorLUT loads the LUT of a validated LUTEffect; a relative path is relative to dir, the directory of the input
+func (e EffectSpec) ColorLUT(dir string) (*LUT3D, error) {
+	path := e.Text("lut", "")
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	return LoadCube(path)
+}
+
+// LUTInterpolation returns the interpolation of a validated LUTEffect
+func (e EffectSpec) LUTInterpolation() LUTInterpolation {
+	m, _ := ParseLUTInterpolation(e.Text("method", ""))
+	return m
+}
+
+// DeblurIterations returns the iterations of a validated RichardsonLucyEffect, 10 by default
+func (e EffectSpec) DeblurIterations() int {
+	return e.Int("iterations", deblurIters)
+}
+
+// CLAHE returns the equalization of a validated CLAHEEffect, filling in the defaults
+func (e EffectSpec) CLAHE() CLAHE {
+	return CLAHE{Tiles: e.Int("tiles", claheTiles), Clip: e.Number("clip", claheClip)}
+}
+
+// Adjustment reports whether the effect is a tonal or color adjustment, which runs fused with its neighbors unless
+// the optimization is exact
+func (e EffectSpec) Adjustment() bool {
+	switch e.Name {
+	case BrightnessEffect, ContrastEffect, GammaEffect, ExposureEffect, SaturationEffect,
+		HueEffect, InvertEffect, SepiaEffect, PosterizeEffect, ThresholdEffect:
+		return true
+	}
+	return false
+}
+
+// convolution reports whether the effect is a convolution with a kernel
+func (e EffectSpec) convolution() bool {
+	switch e.Name {
+	case "S", "E", "B", KernelEffect, GaussianEffect:
+		return true
+	}
+	return false
+}
+
+// AdjustmentRun returns the end of the run of consecutive adjustments that starts at effects[i]
+func AdjustmentRun(effects []EffectSpec, i int) int {
+	for i < len(effects) && effects[i].Adjustment() {
+		i++
+	}
+	return i
+}
@@ -0,0 +1,858 @@
+// Package png allows for loading png images and applying image flitering effects on them
+// Streaming path: decode, filter and encode an image one row at a time so that images larger than RAM can be processed
+// PNG format reference: https://www.w3.org/TR/png/
+package png
+
+import (
+	"bufio"
+	"compress/zlib"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// PNG color types
+const (
+	ctGray      = 0
+	ctRGB       = 2
+	ctPalette   = 3
+	ctGrayAlpha = 4
+	ctRGBA      = 6
+)
+
+// PNG row filter types
+const (
+	ftNone    = 0
+	ftSub     = 1
+	ftUp      = 2
+	ftAverage = 3
+	ftPaeth   = 4
+)
+
+// rowSource yields the rows of an image from top to bottom
+// each row holds 4 premultiplied uint16 samples (r, g, b, a) per pixel
+// the returned slice is only valid until the next call of readRow
+type rowSource interface {
+	readRow() ([]uint16, error)
+}
+
+//
+// Row-oriented PNG decoder
+//
+
+type rowDecoder struct {
+	r         *bufio.Reader
+	width     int
+	height    int
+	depth     int
+	colorType int
+	channels  int
+	bpp       int // bytes per complete pixel, rounded up to 1 (used by the row filters)
+	palette   []color.NRGBA
+	trns      []byte
+	hasAlpha  bool
+	ancillary []Chunk // ancillary chunks met before the image data
+
+	idat    *idatReader
+	zr      io.ReadCloser
+	cur     []byte // current filtered row, including the leading filter byte
+	prev    []byte // previous unfiltered row, including the leading filter byte
+	row     []uint16
+	y       int
+	crcBuf  [4]byte
+	chunkHd [8]byte
+}
+
+// newRowDecoder reads the PNG header chunks up to the first IDAT chunk
+func newRowDecoder(r io.Reader) (*rowDecoder, error) {
+	d := &rowDecoder{r: bufio.NewReaderSize(r, 1<<16)}
+
+	sig := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(d.r, sig); err != nil {
+		return nil, err
+	}
+	if string(sig) != pngSignature {
+		return nil, errors.New("png: not a PNG file")
+	}
+
+	for {
+		length, typ, err := d.readChunkHeader()
+		if err != nil {
+			return nil, err
+		}
+		if typ == "IDAT" {
+			if d.width == 0 {
+				return nil, errors.New("png: IDAT before IHDR")
+			}
+			d.idat = &idatReader{d: d, remaining: length}
+			break
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(d.r, data); err != nil {
+			return nil, err
+		}
+		if err := d.verifyCRC(typ, data); err != nil {
+			return nil, err
+		}
+		switch typ {
+		case "IHDR":
+			if err := d.parseIHDR(data); err != nil {
+				return nil, err
+			}
+		case "PLTE":
+			if len(data)%3 != 0 {
+				return nil, errors.New("png: invalid PLTE length")
+			}
+			d.palette = make([]color.NRGBA, len(data)/3)
+			for i := range d.palette {
+				d.palette[i] = color.NRGBA{data[3*i], data[3*i+1], data[3*i+2], 0xff}
+			}
+		case "tRNS":
+			d.trns = data
+			d.hasAlpha = true
+		case "IEND":
+			return nil, errors.New("png: no image data")
+		default:
+			if ancillaryTypes[typ] {
+				d.ancillary = append(d.ancillary, Chunk{Type: typ, Data: data})
+			}
+		}
+	}
+
+	if d.colorType == ctPalette {
+		if d.palette == nil {
+			return nil, errors.New("png: missing PLTE chunk")
+		}
+		for i := 0; i < len(d.trns) && i < len(d.palette); i++ {
+			d.palette[i].A = d.trns[i]
+		}
+	}
+
+	zr, err := zlib.NewReader(d.idat)
+	if err != nil {
+		return nil, err
+	}
+	d.zr = zr
+
+	rowBytes := (d.width*d.channels*d.depth + 7) / 8
+	d.cur = make([]byte, rowBytes+1)
+	d.prev = make([]byte, rowBytes+1)
+	d.row = make([]uint16, 4*d.width)
+	return d, nil
+}
+
+func (d *rowDecoder) parseIHDR(data []byte) error {
+	if len(data) != 13 {
+		return errors.New("png: invalid IHDR length")
+	}
+	d.width = int(binary.BigEndian.Uint32(data[0:4]))
+	d.height = int(binary.BigEndian.Uint32(data[4:8]))
+	d.depth = int(data[8])
+	d.colorType = int(data[9])
+	if data[10] != 0 || data[11] != 0 {
+		return errors.New("png: unsupported compression or filter method")
+	}
+	if data[12] != 0 {
+		// Adam7 passes cannot be emitted in row order
+		return errors.New("png: interlaced images cannot be streamed")
+	}
+	if d.width <= 0 || d.height <= 0 {
+		return errors.New("png: invalid image size")
+	}
+
+	switch d.colorType {
+	case ctGray:
+		d.channels = 1
+	case ctRGB:
+		d.channels = 3
+	case ctPalette:
+		d.channels = 1
+	case ctGrayAlpha:
+		d.channels = 2
+		d.hasAlpha = true
+	case ctRGBA:
+		d.channels = 4
+		d.hasAlpha = true
+	default:
+		return fmt.Errorf("png: invalid color type %d", d.colorType)
+	}
+
+	switch d.depth {
+	case 1, 2, 4:
+		if d.colorType != ctGray && d.colorType != ctPalette {
+			return fmt.Errorf("png: invalid bit depth %d for color type %d", d.depth, d.colorType)
+		}
+	case 8:
+	case 16:
+		if d.colorType == ctPalette {
+			return errors.New("png: invalid bit depth 16 for paletted image")
+		}
+	default:
+		return fmt.Errorf("png: invalid bit depth %d", d.depth)
+	}
+
+	d.bpp = (d.channels*d.depth + 7) / 8
+	return nil
+}
+
+func (d *rowDecoder) readChunkHeader() (int, string, error) {
+	if _, err := io.ReadFull(d.r, d.chunkHd[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, "", err
+	}
+	length := binary.BigEndian.Uint32(d.chunkHd[0:4])
+	if length > 0x7fffffff {
+		return 0, "", errors.New("png: chunk too large")
+	}
+	return int(length), string(d.chunkHd[4:8]), nil
+}
+
+func (d *rowDecoder) verifyCRC(typ string, data []byte) error {
+	if _, err := io.ReadFull(d.r, d.crcBuf[:]); err != nil {
+		return err
+	}
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(typ))
+	crc.Write(data)
+	if crc.Sum32() != binary.BigEndian.Uint32(d.crcBuf[:]) {
+		return fmt.Errorf("png: invalid checksum in %s chunk", typ)
+	}
+	return nil
+}
+
+// readRow inflates, unfilters and converts the next row of the image
+func (d *rowDecoder) readRow() ([]uint16, error) {
+	if d.y >= d.height {
+		return nil, io.EOF
+	}
+	if _, err := io.ReadFull(d.zr, d.cur); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if err := unfilter(d.cur, d.prev, d.bpp); err != nil {
+		return nil, err
+	}
+	d.convertRow(d.cur[1:])
+	d.cur, d.prev = d.prev, d.cur
+	d.y++
+	return d.row, nil
+}
+
+// unfilter reverses the filter selected by cur[0] in place, using the previous unfiltered row
+func unfilter(cur, prev []byte, bpp int) error {
+	c, p := cur[1:], prev[1:]
+	switch cur[0] {
+	case ftNone:
+	case ftSub:
+		for i := bpp; i < len(c); i++ {
+			c[i] += c[i-bpp]
+		}
+	case ftUp:
+		for i := range c {
+			c[i] += p[i]
+		}
+	case ftAverage:
+		for i := 0; i < bpp; i++ {
+			c[i] += p[i] / 2
+		}
+		for i := bpp; i < len(c); i++ {
+			c[i] += uint8((int(c[i-bpp]) + int(p[i])) / 2)
+		}
+	case ftPaeth:
+		for i := 0; i < bpp; i++ {
+			c[i] += p[i]
+		}
+		for i := bpp; i < len(c); i++ {
+			c[i] += paeth(c[i-bpp], p[i], p[i-bpp])
+		}
+	default:
+		return fmt.Errorf("png: invalid filter type %d", cur[0])
+	}
+	return nil
+}
+
+func paeth(a, b, c uint8) uint8 {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	} else if pb <= pc {
+		return b
+	}
+	return c
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// convertRow expands the raw samples to premultiplied RGBA64, matching what Load gets from image/png
+func (d *rowDecoder) convertRow(raw []byte) {
+	var c color.Color
+	for x := 0; x < d.width; x++ {
+		switch d.colorType {
+		case ctGray:
+			v := d.sample(raw, x)
+			g := d.scale(v)
+			if len(d.trns) >= 2 && v == int(binary.BigEndian.Uint16(d.trns)) {
+				c = color.NRGBA64{}
+			} else {
+				c = color.Gray16{g}
+			}
+		case ctPalette:
+			i := d.sample(raw, x)
+			if i < len(d.palette) {
+				c = d.palette[i]
+			} else {
+				c = color.NRGBA{A: 0xff}
+			}
+		case ctGrayAlpha:
+			if d.depth == 8 {
+				c = color.NRGBA{raw[2*x], raw[2*x], raw[2*x], raw[2*x+1]}
+			} else {
+				g := binary.BigEndian.Uint16(raw[4*x:])
+				c = color.NRGBA64{g, g, g, binary.BigEndian.Uint16(raw[4*x+2:])}
+			}
+		case ctRGB:
+			var r, g, b uint16
+			if d.depth == 8 {
+				r, g, b = uint16(raw[3*x])*0x101, uint16(raw[3*x+1])*0x101, uint16(raw[3*x+2])*0x101
+			} else {
+				r, g, b = binary.BigEndian.Uint16(raw[6*x:]), binary.BigEndian.Uint16(raw[6*x+2:]), binary.BigEndian.Uint16(raw[6*x+4:])
+			}
+			c = color.RGBA64{r, g, b, 0xffff}
+			if len(d.trns) >= 6 {
+				key := [3]uint16{binary.BigEndian.Uint16(d.trns), binary.BigEndian.Uint16(d.trns[2:]), binary.BigEndian.Uint16(d.trns[4:])}
+				if d.depth == 8 {
+					key[0], key[1], key[2] = key[0]*0x101, key[1]*0x101, key[2]*0x101
+				}
+				if key == [3]uint16{r, g, b} {
+					c = color.RGBA64{}
+				}
+			}
+		case ctRGBA:
+			if d.depth == 8 {
+				c = color.NRGBA{raw[4*x], raw[4*x+1], raw[4*x+2], raw[4*x+3]}
+			} else {
+				c = color.NRGBA64{binary.BigEndian.Uint16(raw[8*x:]), binary.BigEndian.Uint16(raw[8*x+2:]),
+					binary.BigEndian.Uint16(raw[8*x+4:]), binary.BigEndian.Uint16(raw[8*x+6:])}
+			}
+		}
+		r, g, b, a := c.RGBA()
+		d.row[4*x], d.row[4*x+1], d.row[4*x+2], d.row[4*x+3] = uint16(r), uint16(g), uint16(b), uint16(a)
+	}
+}
+
+// sample returns the x-th single-channel sample of a gray or paletted row at the image bit depth
+func (d *rowDecoder) sample(raw []byte, x int) int {
+	switch d.depth {
+	case 16:
+		return int(binary.BigEndian.Uint16(raw[2*x:]))
+	case 8:
+		return int(raw[x])
+	}
+	perByte := 8 / d.depth
+	shift := uint(8 - d.depth*(x%perByte+1))
+	return int(raw[x/perByte]>>shift) & (1<<uint(d.depth) - 1)
+}
+
+// scale maps a gray sample at the image bit depth to the full 16-bit range
+func (d *rowDecoder) scale(v int) uint16 {
+	return uint16(v * 0xffff / (1<<uint(d.depth) - 1))
+}
+
+// finish consumes the rest of the image data and returns the ancillary chunks that follow it
+func (d *rowDecoder) finish() ([]Chunk, error) {
+	if _, err := io.Copy(io.Discard, d.zr); err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(io.Discard, d.idat); err != nil {
+		return nil, err
+	}
+
+	var trailing []Chunk
+	length, typ := d.idat.nextLength, d.idat.nextType
+	for typ != "IEND" {
+		data := make([]byte, length)
+		if _, err := io.ReadFull(d.r, data); err != nil {
+			return nil, err
+		}
+		if err := d.verifyCRC(typ, data); err != nil {
+			return nil, err
+		}
+		if ancillaryTypes[typ] {
+			trailing = append(trailing, Chunk{Type: typ, Data: data})
+		}
+		var err error
+		if length, typ, err = d.readChunkHeader(); err != nil {
+			return nil, err
+		}
+	}
+	// IEND has no payload, only a checksum
+	if _, err := io.ReadFull(d.r, d.crcBuf[:]); err != nil {
+		return nil, err
+	}
+	return trailing, nil
+}
+
+func (d *rowDecoder) Close() error {
+	return d.zr.Close()
+}
+
+// idatReader concatenates the payload of consecutive IDAT chunks
+type idatReader struct {
+	d         *rowDecoder
+	remaining int
+	crc       uint32
+	started   bool
+	done      bool
+
+	// header of the first chunk after the image data
+	nextLength int
+	nextType   string
+}
+
+func (ir *idatReader) Read(p []byte) (int, error) {
+	d := ir.d
+	if !ir.started {
+		ir.crc = crc32.Update(0, crc32.IEEETable, []byte("IDAT"))
+		ir.started = true
+	}
+	for ir.remaining == 0 {
+		if ir.done {
+			return 0, io.EOF
+		}
+		if _, err := io.ReadFull(d.r, d.crcBuf[:]); err != nil {
+			return 0, err
+		}
+		if ir.crc != binary.BigEndian.Uint32(d.crcBuf[:]) {
+			return 0, errors.New("png: invalid checksum in IDAT chunk")
+		}
+		length, typ, err := d.readChunkHeader()
+		if err != nil {
+			return 0, err
+		}
+		if typ != "IDAT" {
+			ir.done = true
+			ir.nextLength, ir.nextType = length, typ
+			return 0, io.EOF
+		}
+		ir.remaining = length
+		ir.crc = crc32.Update(0, crc32.IEEETable, []byte("IDAT"))
+	}
+	if len(p) > ir.remaining {
+		p = p[:ir.remaining]
+	}
+	n, err := d.r.Read(p)
+	ir.crc = crc32.Update(ir.crc, crc32.IEEETable, p[:n])
+	ir.remaining -= n
+	return n, err
+}
+
+//
+// Row-oriented PNG encoder
+//
+
+type rowEncoder struct {
+	w        *bufio.Writer
+	width    int
+	height   int
+	hasAlpha bool
+	bpp      int
+
+	idat   *bufio.Writer
+	zw     *zlib.Writer
+	cur    []byte
+	prev   []byte
+	trial  [5][]byte
+	y      int
+	header [8]byte
+}
+
+// newRowEncoder writes the PNG header followed by the given ancillary chunks;
+// 16-bit RGBA is used for images with an alpha channel, 16-bit RGB otherwise
+func newRowEncoder(w io.Writer, width, height int, hasAlpha bool, chunks []Chunk) (*rowEncoder, error) {
+	e := &rowEncoder{w: bufio.NewWriterSize(w, 1<<16), width: width, height: height, hasAlpha: hasAlpha}
+	e.bpp = 6
+	colorType := byte(ctRGB)
+	if hasAlpha {
+		e.bpp = 8
+		colorType = ctRGBA
+	}
+
+	if _, err := io.WriteString(e.w, pngSignature); err != nil {
+		return nil, err
+	}
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:4], uint32(width))
+	binary.BigEndian.PutUint32(ihdr[4:8], uint32(height))
+	ihdr[8] = 16
+	ihdr[9] = colorType
+	if err := e.writeChunk("IHDR", ihdr); err != nil {
+		return nil, err
+	}
+	for _, c := range chunks {
+		if err := writeChunk(e.w, c); err != nil {
+			return nil, err
+		}
+	}
+
+	// every flush of the buffer becomes one IDAT chunk
+	e.idat = bufio.NewWriterSize(chunkWriterFunc(func(p []byte) error { return e.writeChunk("IDAT", p) }), 1<<16)
+	e.zw = zlib.NewWriter(e.idat)
+
+	rowBytes := width*e.bpp + 1
+	e.cur = make([]byte, rowBytes)
+	e.prev = make([]byte, rowBytes)
+	for i := range e.trial {
+		e.trial[i] = make([]byte, rowBytes)
+	}
+	return e, nil
+}
+
+func (e *rowEncoder) writeChunk(typ string, data []byte) error {
+	binary.BigEndian.PutUint32(e.header[0:4], uint32(len(data)))
+	copy(e.header[4:8], typ)
+	crc := crc32.NewIEEE()
+	crc.Write(e.header[4:8])
+	crc.Write(data)
+	if _, err := e.w.Write(e.header[:]); err != nil {
+		return err
+	}
+	if _, err := e.w.Write(data); err != nil {
+		return err
+	}
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc.Sum32())
+	_, err := e.w.Write(sum[:])
+	return err
+}
+
+// writeRow un-premultiplies, filters and deflates one row of premultiplied RGBA64 samples
+func (e *rowEncoder) writeRow(row []uint16) error {
+	if e.y >= e.height {
+		return errors.New("png: too many rows written")
+	}
+	raw := e.cur[1:]
+	for x := 0; x < e.width; x++ {
+		r, g, b, a := row[4*x], row[4*x+1], row[4*x+2], row[4*x+3]
+		if e.hasAlpha {
+			// same conversion image/png applies to non-opaque RGBA64 images
+			n := color.NRGBA64Model.Convert(color.RGBA64{r, g, b, a}).(color.NRGBA64)
+			binary.BigEndian.PutUint16(raw[8*x:], n.R)
+			binary.BigEndian.PutUint16(raw[8*x+2:], n.G)
+			binary.BigEndian.PutUint16(raw[8*x+4:], n.B)
+			binary.BigEndian.PutUint16(raw[8*x+6:], n.A)
+		} else {
+			binary.BigEndian.PutUint16(raw[6*x:], r)
+			binary.BigEndian.PutUint16(raw[6*x+2:], g)
+			binary.BigEndian.PutUint16(raw[6*x+4:], b)
+		}
+	}
+
+	best := e.filter()
+	if _, err := e.zw.Write(best); err != nil {
+		return err
+	}
+	e.cur, e.prev = e.prev, e.cur
+	e.y++
+	return nil
+}
+
+// filter tries every filter type and returns the one with the smallest sum of absolute differences,
+// the same heuristic image/png uses
+func (e *rowEncoder) filter() []byte {
+	c, p := e.cur[1:], e.prev[1:]
+	bpp := e.bpp
+	bestSum := -1
+	var best []byte
+	for ft := ftNone; ft <= ftPaeth; ft++ {
+		out := e.trial[ft]
+		out[0] = byte(ft)
+		o := out[1:]
+		for i := range c {
+			var left, upLeft byte
+			if i >= bpp {
+				left, upLeft = c[i-bpp], p[i-bpp]
+			}
+			switch ft {
+			case ftNone:
+				o[i] = c[i]
+			case ftSub:
+				o[i] = c[i] - left
+			case ftUp:
+				o[i] = c[i] - p[i]
+			case ftAverage:
+				o[i] = c[i] - uint8((int(left)+int(p[i]))/2)
+			case ftPaeth:
+				o[i] = c[i] - paeth(left, p[i], upLeft)
+			}
+		}
+		sum := 0
+		for _, v := range o {
+			sum += abs(int(int8(v)))
+		}
+		if bestSum < 0 || sum < bestSum {
+			bestSum, best = sum, out
+		}
+	}
+	return best
+}
+
+// Close flushes the compressed stream and writes the trailing ancillary chunks and the IEND chunk
+func (e *rowEncoder) Close(trailing []Chunk) error {
+	if e.y != e.height {
+		return fmt.Errorf("png: wrote %d of %d rows", e.y, e.height)
+	}
+	if err := e.zw.Close(); err != nil {
+		return err
+	}
+	if err := e.idat.Flush(); err != nil {
+		return err
+	}
+	for _, c := range trailing {
+		if err := writeChunk(e.w, c); err != nil {
+			return err
+		}
+	}
+	if err := e.writeChunk("IEND", nil); err != nil {
+		return err
+	}
+	return e.w.Flush()
+}
+
+type chunkWriterFunc func(p []byte) error
+
+func (f chunkWriterFunc) Write(p []byte) (int, error) {
+	if err := f(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+//
+// Effect stages
+//
+
+// streamBlock is the least number of rows an effect stage computes per Apply call
+const streamBlock = 32
+
+// effectStage runs an effect of the registry on a rolling window of input rows: it computes a block of rows at
+// a time from the rows within the halo of the block, so it keeps at most block + 2 halo input rows
+type effectStage struct {
+	src    rowSource
+	effect Effect
+	halo   int
+	block  int
+	height int
+	in     *image.RGBA64 // input rows [in.Rect.Min.Y, next)
+	out    *image.RGBA64 // the rows of the current block
+	next   int           // index of the next upstream row
+	y      int
+	row    []uint16
+}
+
+func newEffectStage(src rowSource, effect Effect, width, height int) *effectStage {
+	halo := effect.Info().Halo
+	block := streamBlock
+	if block < 2*halo {
+		block = 2 * halo
+	}
+	s := &effectStage{src: src, effect: effect, halo: halo, block: block, height: height, row: make([]uint16, 4*width)}
+	s.in = image.NewRGBA64(image.Rect(0, 0, width, block+2*halo))
+	s.out = image.NewRGBA64(image.Rect(0, 0, width, block))
+	s.in.Rect.Max.Y, s.out.Rect.Max.Y = 0, 0 // no rows yet
+	return s
+}
+
+// fill drops the rows above the halo of the next block, reads those below it and computes the block
+func (s *effectStage) fill() error {
+	end := s.y + s.block
+	if end > s.height {
+		end = s.height
+	}
+	if top := s.y - s.halo; top > s.in.Rect.Min.Y {
+		copy(s.in.Pix, s.in.Pix[(top-s.in.Rect.Min.Y)*s.in.Stride:(s.next-s.in.Rect.Min.Y)*s.in.Stride])
+		s.in.Rect.Min.Y = top
+	}
+	last := end + s.halo
+	if last > s.height {
+		last = s.height
+	}
+	for ; s.next < last; s.next++ {
+		row, err := s.src.readRow()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		pix := s.in.Pix[(s.next-s.in.Rect.Min.Y)*s.in.Stride:]
+		for i, v := range row {
+			pix[2*i], pix[2*i+1] = uint8(v>>8), uint8(v)
+		}
+	}
+	s.in.Rect.Max.Y = s.next
+	s.out.Rect.Min.Y, s.out.Rect.Max.Y = s.y, end
+	s.effect.Apply(s.in, s.out, Rows{s.y, end})
+	return nil
+}
+
+func (s *effectStage) readRow() ([]uint16, error) {
+	if s.y >= s.height {
+		return nil, io.EOF
+	}
+	if s.y >= s.out.Rect.Max.Y {
+		if err := s.fill(); err != nil {
+			return nil, err
+		}
+	}
+	pix := s.out.Pix[(s.y-s.out.Rect.Min.Y)*s.out.Stride:]
+	for i := range s.row {
+		s.row[i] = uint16(pix[2*i])<<8 | uint16(pix[2*i+1])
+	}
+	s.y++
+	return s.row, nil
+}
+
+// lutStage is a pointwise stage that applies a transfer curve lookup table, e.g. to enter or leave linear light
+type lutStage struct {
+	src rowSource
+	lut *[65536]uint16
+	out []uint16
+}
+
+func (s *lutStage) readRow() ([]uint16, error) {
+	row, err := s.src.readRow()
+	if err != nil {
+		return nil, err
+	}
+	if s.out == nil {
+		s.out = make([]uint16, len(row))
+	}
+	for i := 0; i < len(row); i += 4 {
+		c := convertPixel(s.lut, color.RGBA64{row[i], row[i+1], row[i+2], row[i+3]})
+		s.out[i], s.out[i+1], s.out[i+2], s.out[i+3] = c.R, c.G, c.B, c.A
+	}
+	return s.out, nil
+}
+
+// StreamEffects applies the passes of task (see ImageTask.Plan) to the PNG at inPath and writes the result to outPath
+// without ever holding the whole image in memory: every pass runs its effect (see registry.go) on a stage that
+// keeps the rows within the halo of a block of output rows, so effects whose halo is the whole image, or that
+// change the size of the image, cannot be streamed
+// Ancillary chunks are carried over, and the task provenance is recorded once the input hash is known
+func StreamEffects(task ImageTask, passes []Pass, inPath, outPath string) error {
+	alpha, err := ParseAlphaMode(task.Alpha)
+	if err != nil {
+		return err
+	}
+	if formatFromPath(outPath) != FormatPNG {
+		return fmt.Errorf("png: streaming only writes PNG images, not %s", outPath)
+	}
+	inFile, err := os.Open(inPath)
+	if err != nil {
+		return err
+	}
+	defer inFile.Close()
+
+	hash := sha256.New()
+	tee := io.TeeReader(inFile, hash)
+	dec, err := newRowDecoder(tee)
+	if err != nil {
+		return err
+	}
+	defer dec.Close()
+
+	// chain one stage per effect, each pulling rows from the previous one
+	var src rowSource = dec
+	hasAlpha := dec.hasAlpha
+	// linear light only matters when there are effects, like in the sequential and BSP versions
+	linear := task.LinearLight() && len(passes) > 0
+	curve := transferCurveFor(dec.ancillary)
+	if linear {
+		src = &lutStage{src: src, lut: &curve.toLinear}
+	}
+	// the effects are built for an image of the size of the input, without its pixels
+	header := &Image{Bounds: image.Rect(0, 0, dec.width, dec.height), AlphaMode: alpha, Ancillary: dec.ancillary, Dir: filepath.Dir(inPath)}
+	if linear {
+		header.linear = curve
+	}
+	for _, pass := range passes {
+		name := pass.Effects[0].Name
+		effect, err := NewEffect(pass, header)
+		if err != nil {
+			return err
+		}
+		// a stage only keeps the rows within the halo of its block, and its output has the size of its input
+		info := effect.Info()
+		if info.Halo == WholeImage || effect.Bounds(header.Bounds) != header.Bounds {
+			return fmt.Errorf("png: the %s effect needs the whole image and cannot be streamed", name)
+		}
+		// convolving alpha (the straight and premultiplied modes) can make an opaque input transparent at the borders
+		hasAlpha = hasAlpha || !info.KeepsAlpha
+		src = newEffectStage(src, effect, dec.width, dec.height)
+	}
+	if linear {
+		src = &lutStage{src: src, lut: &curve.fromLinear}
+	}
+
+	outFile, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	// chunks before the image data stay in front of it, since color space chunks must precede IDAT
+	img := &Image{Ancillary: dec.ancillary}
+	leading, err := img.outputChunks()
+	if err != nil {
+		return err
+	}
+	enc, err := newRowEncoder(outFile, dec.width, dec.height, hasAlpha, leading)
+	if err != nil {
+		return err
+	}
+	for y := 0; y < dec.height; y++ {
+		row, err := src.readRow()
+		if err != nil {
+			return err
+		}
+		if err := enc.writeRow(row); err != nil {
+			return err
+		}
+	}
+
+	trailing, err := dec.finish()
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.Discard, tee); err != nil {
+		return err
+	}
+	img = &Image{Ancillary: trailing, Provenance: task.Provenance(inPath), InputSHA256: hex.EncodeToString(hash.Sum(nil))}
+	if trailing, err = img.outputChunks(); err != nil {
+		return err
+	}
+	if err := enc.Close(trailing); err != nil {
+		return err
+	}
+	return outFile.Close()
+}
@@ -0,0 +1,325 @@
+package png
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testPNG is a PNG written byte by byte, so that the tests pick its row filters and IDAT chunks
+type testPNG struct {
+	name             string
+	width, height    int
+	depth, colorType int
+	idatSize         int // the most bytes of an IDAT chunk, 0 for a single chunk
+}
+
+// channels returns the samples per pixel of the color type
+func (p testPNG) channels() int {
+	return map[int]int{ctGray: 1, ctRGB: 3, ctPalette: 1, ctGrayAlpha: 2, ctRGBA: 4}[p.colorType]
+}
+
+// write writes the image with random samples to path, filtering row y with filter type y mod 5
+// A palette image gets a full palette of 1 << depth colors, some of them transparent
+func (p testPNG) write(path string, seed int64) error {
+	rng := rand.New(rand.NewSource(seed))
+	var buf bytes.Buffer
+	buf.WriteString(pngSignature)
+	chunk := func(typ string, data []byte) {
+		var n [4]byte
+		binary.BigEndian.PutUint32(n[:], uint32(len(data)))
+		buf.Write(n[:])
+		buf.WriteString(typ)
+		buf.Write(data)
+		binary.BigEndian.PutUint32(n[:], crc32.ChecksumIEEE(append([]byte(typ), data...)))
+		buf.Write(n[:])
+	}
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:4], uint32(p.width))
+	binary.BigEndian.PutUint32(ihdr[4:8], uint32(p.height))
+	ihdr[8], ihdr[9] = byte(p.depth), byte(p.colorType)
+	chunk("IHDR", ihdr)
+	if p.colorType == ctPalette {
+		plte, trns := make([]byte, 3<<p.depth), make([]byte, 1<<p.depth)
+		rng.Read(plte)
+		for i := range trns {
+			trns[i] = byte(255 - 40*(i%4))
+		}
+		chunk("PLTE", plte)
+		chunk("tRNS", trns)
+	}
+
+	bits := p.channels() * p.depth
+	bpp := (bits + 7) / 8
+	rowBytes := (p.width*bits + 7) / 8
+	var data bytes.Buffer
+	zw := zlib.NewWriter(&data)
+	prev, cur, out := make([]byte, rowBytes), make([]byte, rowBytes), make([]byte, rowBytes+1)
+	for y := 0; y < p.height; y++ {
+		rng.Read(cur)
+		ft := y % 5
+		out[0] = byte(ft)
+		for i, c := range cur {
+			var left, upLeft byte
+			if i >= bpp {
+				left, upLeft = cur[i-bpp], prev[i-bpp]
+			}
+			switch ft {
+			case ftNone:
+				out[i+1] = c
+			case ftSub:
+				out[i+1] = c - left
+			case ftUp:
+				out[i+1] = c - prev[i]
+			case ftAverage:
+				out[i+1] = c - uint8((int(left)+int(prev[i]))/2)
+			case ftPaeth:
+				out[i+1] = c - paeth(left, prev[i], upLeft)
+			}
+		}
+		zw.Write(out)
+		prev, cur = cur, prev
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	idat := data.Bytes()
+	size := p.idatSize
+	if size == 0 {
+		size = len(idat)
+	}
+	for len(idat) > 0 {
+		n := size
+		if n > len(idat) {
+			n = len(idat)
+		}
+		chunk("IDAT", idat[:n])
+		idat = idat[n:]
+	}
+	chunk("IEND", nil)
+	return os.WriteFile(path, buf.Bytes(), 0o644)
+}
+
+var testPNGs = []testPNG{
+	{"rgb8 in IDAT chunks of 37 bytes", 23, 11, 8, ctRGB, 37},
+	{"rgb8 taller than two blocks of the stream", 9, 75, 8, ctRGB, 200},
+	{"rgba16", 17, 10, 16, ctRGBA, 0},
+	{"rgba8 in IDAT chunks of 1 byte", 9, 6, 8, ctRGBA, 1},
+	{"gray1", 13, 10, 1, ctGray, 0},
+	{"gray2", 13, 10, 2, ctGray, 5},
+	{"gray4", 11, 10, 4, ctGray, 0},
+	{"gray16", 12, 7, 16, ctGray, 0},
+	{"gray alpha8", 15, 9, 8, ctGrayAlpha, 0},
+	{"palette1", 21, 5, 1, ctPalette, 0},
+	{"palette2", 13, 10, 2, ctPalette, 3},
+	{"palette4", 7, 10, 4, ctPalette, 0},
+	{"palette8", 19, 12, 8, ctPalette, 50},
+}
+
+func TestRowDecoderMatchesLoad(t *testing.T) {
+	dir := t.TempDir()
+	for i, p := range testPNGs {
+		path := filepath.Join(dir, fmt.Sprintf("in%d.png", i))
+		if err := p.write(path, int64(i)); err != nil {
+			t.Fatal(err)
+		}
+		img, err := Load(path)
+		if err != nil {
+			t.Fatalf("%s: %v", p.name, err)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dec, err := newRowDecoder(f)
+		if err != nil {
+			t.Fatalf("%s: %v", p.name, err)
+		}
+		for y := 0; y < p.height; y++ {
+			row, err := dec.readRow()
+			if err != nil {
+				t.Fatalf("%s: row %d: %v", p.name, y, err)
+			}
+			for x := 0; x < p.width; x++ {
+				c := img.In.RGBA64At(x, y)
+				if got := [4]uint16{row[4*x], row[4*x+1], row[4*x+2], row[4*x+3]}; got != [4]uint16{c.R, c.G, c.B, c.A} {
+					t.Fatalf("%s: pixel (%d, %d) is %v, Load gives %v", p.name, x, y, got, c)
+				}
+			}
+		}
+		if _, err := dec.readRow(); err != io.EOF {
+			t.Errorf("%s: reading past the last row gives %v", p.name, err)
+		}
+		dec.Close()
+		f.Close()
+	}
+}
+
+// applyTask runs the passes of task on img like the sequential scheduler
+func applyTask(t *testing.T, task ImageTask, img *Image) {
+	t.Helper()
+	passes, _, err := task.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.AlphaMode, err = ParseAlphaMode(task.Alpha); err != nil {
+		t.Fatal(err)
+	}
+	if len(passes) == 0 {
+		return
+	}
+	img.EffectsApplied = true
+	if task.LinearLight() {
+		img.ToLinear()
+	}
+	for i, pass := range passes {
+		effect, err := NewEffect(pass, img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img.ApplyEffect(effect, 1)
+		if i < len(passes)-1 {
+			img.SwapBuffers()
+		}
+	}
+	if task.LinearLight() {
+		img.FromLinear()
+	}
+}
+
+func TestStreamMatchesLoadApplySave(t *testing.T) {
+	tasks := []string{
+		`{"effects":[]}`,
+		`{"effects":["S","E","B","G"]}`,
+		`{"effects":[{"name":"gaussian","sigma":2,"border":"reflect"},{"name":"brightness","amount":0.1},"invert"]}`,
+		`{"alpha":"straight","effects":[{"name":"median","radius":2},{"name":"dilate","element":"disk"},"box"]}`,
+		`{"alpha":"premultiplied","linear":true,"effects":["sobel",{"name":"bilateral","radius":3},"guided",{"name":"stddev","radius":2}]}`,
+		`{"effects":[{"name":"expr","expr":"r = (r(0, 2) + g(-1, -1)) / 2"},{"kernel":[[1,2,1],[2,4,2],[1,2,1]],"divisor":16,"border":"valid"}]}`,
+	}
+	dir := t.TempDir()
+	for i, p := range testPNGs {
+		inPath := filepath.Join(dir, fmt.Sprintf("in%d.png", i))
+		if err := p.write(inPath, int64(i)); err != nil {
+			t.Fatal(err)
+		}
+		for j, text := range tasks {
+			var task ImageTask
+			if err := json.Unmarshal([]byte(text), &task); err != nil {
+				t.Fatal(err)
+			}
+			label := fmt.Sprintf("%s, task %d", p.name, j)
+			img, err := Load(inPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			applyTask(t, task, img)
+			savedPath := filepath.Join(dir, "saved.png")
+			if err := img.Save(savedPath); err != nil {
+				t.Fatal(err)
+			}
+			passes, _, err := task.Plan()
+			if err != nil {
+				t.Fatal(err)
+			}
+			streamedPath := filepath.Join(dir, "streamed.png")
+			if err := StreamEffects(task, passes, inPath, streamedPath); err != nil {
+				t.Fatalf("%s: %v", label, err)
+			}
+			saved, err := Load(savedPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			streamed, err := Load(streamedPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			samePixels(t, label, saved.In, streamed.In)
+		}
+	}
+}
+
+func TestStreamRejectsWholeImageEffects(t *testing.T) {
+	dir := t.TempDir()
+	inPath := filepath.Join(dir, "in.png")
+	if err := testPNGs[0].write(inPath, 1); err != nil {
+		t.Fatal(err)
+	}
+	for _, text := range []string{
+		`{"effects":[{"name":"gaussian","sigma":1,"border":"wrap"}]}`,
+		`{"effects":["canny"]}`,
+		`{"effects":["equalize"]}`,
+		`{"effects":[{"name":"resize","scale":2}]}`,
+	} {
+		var task ImageTask
+		if err := json.Unmarshal([]byte(text), &task); err != nil {
+			t.Fatal(err)
+		}
+		passes, _, err := task.Plan()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := StreamEffects(task, passes, inPath, filepath.Join(dir, "out.png")); err == nil {
+			t.Errorf("%s is streamed", text)
+		}
+	}
+}
+
+func TestStreamAboveMaxPixels(t *testing.T) {
+	// a 9000x9000 header, more than maxPixels, over the data of its first 3 rows only
+	dir := t.TempDir()
+	inPath := filepath.Join(dir, "in.png")
+	if err := (testPNG{"gray1", 9000, 3, 1, ctGray, 0}).write(inPath, 1); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(inPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint32(data[20:24], 9000)
+	binary.BigEndian.PutUint32(data[29:33], crc32.ChecksumIEEE(data[12:29]))
+	if err := os.WriteFile(inPath, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, text := range []string{`{"effects":["G"]}`, `{"effects":["B"]}`} {
+		var task ImageTask
+		if err := json.Unmarshal([]byte(text), &task); err != nil {
+			t.Fatal(err)
+		}
+		passes, _, err := task.Plan()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the effects keep the size, so the stream runs until the rows run out
+		err = StreamEffects(task, passes, inPath, filepath.Join(dir, "out.png"))
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("%s: streaming gives %v, want it to run out of rows", text, err)
+		}
+	}
+}
+
+func TestNewEffectLimitsResizedImages(t *testing.T) {
+	header := &Image{Bounds: image.Rect(0, 0, 9000, 9000)}
+	for text, fails := range map[string]bool{`{"effects":["G"]}`: false, `{"effects":[{"name":"resize","scale":0.5}]}`: false, `{"effects":[{"name":"resize","scale":2}]}`: true} {
+		var task ImageTask
+		if err := json.Unmarshal([]byte(text), &task); err != nil {
+			t.Fatal(err)
+		}
+		passes, _, err := task.Plan()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewEffect(passes[0], header); (err != nil) != fails {
+			t.Errorf("%s: NewEffect gives %v on a 9000x9000 image", text, err)
+		}
+	}
+}
@@ -12,6 +12,7 @@ For each effect:
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 	"sync"
@@ -65,9 +66,13 @@ func RunBSP(config Config) {
 		for {
 			var task png.ImageTask
 			if err := reader.Decode(&task); err != nil {
-				break
+				if err == io.EOF {
+					break
+				}
+				// an invalid effect list is reported instead of silently ending the queue
+				panic(err)
 			}
-			task.DataDir = dataDir
+			setupTask(&task, config, dataDir)
 			tasks = append(tasks, task)
 		}
 	}
@@ -111,9 +116,13 @@ func RunBSPSteal(config Config) {
 		for {
 			var task png.ImageTask
 			if err := reader.Decode(&task); err != nil {
-				break
+				if err == io.EOF {
+					break
+				}
+				// an invalid effect list is reported instead of silently ending the queue
+				panic(err)
 			}
-			task.DataDir = dataDir
+			setupTask(&task, config, dataDir)
 			workers[workerIndex].deque.Push(&task)
 			workerIndex = (workerIndex + 1) % numWorkers
 		}
@@ -147,15 +156,18 @@ func processImageBSP(task png.ImageTask, numThreads int) {
 	inPath := fmt.Sprintf("../data/in/%s/%s", task.DataDir, task.InPath)
 	outPath := fmt.Sprintf("../data/out/%s_%s", task.DataDir, task.OutPath)
 
-	img, err := png.Load(inPath)
-	if err != nil {
-		panic(err)
-	}
+	img := loadTask(task, inPath)
 
 	if len(task.Effects) > 0 {
 		img.EffectsApplied = true
 		start := time.Now()
-		applyEffectsSliced(img, task.Effects, numThreads)
+		if task.LinearLight() {
+			img.BSPToLinear(numThreads)
+		}
+		applyEffects(img, plan(task), numThreads)
+		if task.LinearLight() {
+			img.BSPFromLinear(numThreads)
+		}
 		end := time.Since(start).Seconds()
 		fmt.Printf("parslices: %.2f\n", end)
 	}
@@ -163,25 +175,3 @@ func processImageBSP(task png.ImageTask, numThreads int) {
 		panic(err)
 	}
 }
-
-// applyEffectsSliced applies effects with parallel slices
-func applyEffectsSliced(img *png.Image, effects []string, threads int) {
-	for i, effect := range effects {
-		switch effect {
-		case "S":
-			img.BSPSharpen(threads)
-		case "E":
-			img.BSPEdgeDetection(threads)
-		case "B":
-			img.BSPBlur(threads)
-		case "G":
-			img.BSPGrayscale(threads)
-		default:
-			panic("unknown effect")
-		}
-
-		if i < len(effects)-1 {
-			img.SwapBuffers()
-		}
-	}
-}
@@ -2,6 +2,7 @@ package scheduler
 
 import (
 	"encoding/json"
+	"io"
 	"os"
 	"proj3/png"
 	"strings"
@@ -43,9 +44,13 @@ func RunParallelFiles(config Config) {
 		for {
 			var task png.ImageTask
 			if err := reader.Decode(&task); err != nil {
-				break
+				if err == io.EOF {
+					break
+				}
+				// an invalid effect list is reported instead of silently ending the queue
+				panic(err)
 			}
-			task.DataDir = dataDir
+			setupTask(&task, config, dataDir)
 			tasks = append(tasks, task)
 		}
 	}
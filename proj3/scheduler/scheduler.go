@@ -1,9 +1,17 @@
 package scheduler
 
+import (
+	"fmt"
+
+	"proj3/png"
+)
+
 type Config struct {
 	DataDirs    string //Represents the data directories to use to load the images.
 	Mode        string // Represents which scheduler scheme to use
 	ThreadCount int    // Runs parallel version with the specified number of threads
+	Linear      bool   // Applies the effects of the tasks that do not set "linear" in linear light
+	Optimize    string // Optimization of the tasks that do not pick their own (see png/optimize.go)
 }
 
 // Run the correct version based on the Mode field of the configuration value
@@ -16,7 +24,68 @@ func Schedule(config Config) {
 		RunBSPSteal(config)
 	} else if config.Mode == "bsp" {
 		RunBSP(config)
+	} else if config.Mode == "stream" {
+		RunStream(config)
 	} else {
 		panic("Invalid scheduling scheme given.")
 	}
 }
+
+// setupTask completes a task read from effects.txt with the settings of the run: its data directory, the mode and
+// thread count recorded in its provenance, and the editor's linear light and optimization unless the task sets them
+func setupTask(task *png.ImageTask, config Config, dataDir string) {
+	task.DataDir = dataDir
+	task.Mode = config.Mode
+	task.Threads = config.ThreadCount
+	if task.Linear == nil {
+		linear := config.Linear
+		task.Linear = &linear
+	}
+	if task.Optimize == "" {
+		task.Optimize = config.Optimize
+	}
+}
+
+// loadTask loads the input image of a task with its output settings
+func loadTask(task png.ImageTask, inPath string) *png.Image {
+	img, err := png.Load(inPath)
+	if err != nil {
+		panic(err)
+	}
+	img.Quality = task.Quality
+	img.Depth = task.Depth
+	img.Provenance = task.Provenance(inPath)
+	if img.AlphaMode, err = png.ParseAlphaMode(task.Alpha); err != nil {
+		panic(err)
+	}
+	return img
+}
+
+// plan returns the passes that apply the effects of a task and prints what the optimizer rewrote
+func plan(task png.ImageTask) []png.Pass {
+	passes, report, err := task.Plan()
+	if err != nil {
+		panic(err)
+	}
+	for _, line := range report {
+		fmt.Printf("optimize %s: %s\n", task.InPath, line)
+	}
+	return passes
+}
+
+// applyEffects applies the passes of a task one after the other, each with threads parallel slices
+// (one runs sequentially); every effect comes from the png registry, so custom effects run like built-in ones
+func applyEffects(img *png.Image, passes []png.Pass, threads int) {
+	for i, pass := range passes {
+		effect, err := png.NewEffect(pass, img)
+		if err != nil {
+			panic(err)
+		}
+		img.ApplyEffect(effect, threads)
+
+		// swap buffers between effects except for last one
+		if i < len(passes)-1 {
+			img.SwapBuffers() // the output of the previous effect becomes the input for the next effect
+		}
+	}
+}
@@ -3,6 +3,7 @@ package scheduler
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 	"time"
@@ -41,11 +42,15 @@ func RunSequential(config Config) {
 			   When the decoder reaches the end of the file, it returns an io.EOF error to break the loop
 			*/
 			if err := reader.Decode(&task); err != nil {
-				break
+				if err == io.EOF {
+					break
+				}
+				// an invalid effect list is reported instead of silently ending the queue
+				panic(err)
 			}
 
 			// process current ImageTask
-			task.DataDir = dataDir
+			setupTask(&task, config, dataDir)
 			processImageTask(task)
 		}
 	}
@@ -57,15 +62,17 @@ func processImageTask(task png.ImageTask) {
 	inPath := fmt.Sprintf("../data/in/%s/%s", task.DataDir, task.InPath)
 	outPath := fmt.Sprintf("../data/out/%s_%s", task.DataDir, task.OutPath)
 
-	img, err := png.Load(inPath)
-	if err != nil {
-		panic(err)
-	}
+	img := loadTask(task, inPath)
 	if len(task.Effects) > 0 {
 		img.EffectsApplied = true
 
-		applyEffects(img, task.Effects)
-
+		if task.LinearLight() {
+			img.ToLinear()
+		}
+		applyEffects(img, plan(task), 1)
+		if task.LinearLight() {
+			img.FromLinear()
+		}
 	}
 	if err := img.Save(outPath); err != nil {
 		panic(err)
@@ -73,26 +80,3 @@ func processImageTask(task png.ImageTask) {
 	end := time.Since(start).Seconds()
 	fmt.Printf("parfiles: %.2f\n", end)
 }
-
-func applyEffects(img *png.Image, effects []string) {
-
-	for i, effect := range effects {
-		switch effect {
-		case "S":
-			img.Sharpen()
-		case "E":
-			img.EdgeDetection()
-		case "B":
-			img.Blur()
-		case "G":
-			img.Grayscale()
-		default:
-			panic("Unknown effect: " + effect)
-		}
-
-		// swap buffers between effects except for last one
-		if i < len(effects)-1 {
-			img.SwapBuffers() // the output of the previous effect becomes the input for the next effect
-		}
-	}
-}
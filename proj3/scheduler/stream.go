@@ -0,0 +1,55 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"proj3/png"
+)
+
+// RunStream processes images one at a time through the row-streaming pipeline,
+// so memory use stays constant no matter how large the images are
+func RunStream(config Config) {
+	dataDirs := strings.Split(config.DataDirs, "+")
+
+	for _, dataDir := range dataDirs {
+		// open effects.txt file
+		effectsPath := "../data/effects.txt"
+		effectsFile, err := os.Open(effectsPath)
+		if err != nil {
+			panic(err)
+		}
+		defer effectsFile.Close()
+
+		reader := json.NewDecoder(effectsFile)
+		for {
+			var task png.ImageTask
+			if err := reader.Decode(&task); err != nil {
+				if err == io.EOF {
+					break
+				}
+				// an invalid effect list is reported instead of silently ending the queue
+				panic(err)
+			}
+			setupTask(&task, config, dataDir)
+			processImageStream(task)
+		}
+	}
+}
+
+// processImageStream decodes, filters and encodes a task row by row without loading the whole image
+func processImageStream(task png.ImageTask) {
+	start := time.Now()
+	inPath := fmt.Sprintf("../data/in/%s/%s", task.DataDir, task.InPath)
+	outPath := fmt.Sprintf("../data/out/%s_%s", task.DataDir, task.OutPath)
+
+	if err := png.StreamEffects(task, plan(task), inPath, outPath); err != nil {
+		panic(err)
+	}
+	end := time.Since(start).Seconds()
+	fmt.Printf("stream: %.2f\n", end)
+}